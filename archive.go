@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnknownArchive = errors.New("not a supported archive")
+
+// archiveFormat returns the format of an archive by its name: "zip",
+// "tar" or "tgz", or "" for other files.
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"), strings.HasSuffix(name, ".jar"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	}
+	return ""
+}
+
+// openArchive reads the index of an archive. open must return the
+// archive from its start, and is called again to read members of
+// compressed archives. Members of ZIP files that are stored without
+// compression and of plain tar files can be read at any offset, the
+// rest only from their start.
+func openArchive(format string, ra io.ReaderAt, size int64, open func() (io.ReadCloser, error)) (fs.FS, error) {
+	switch format {
+	case "zip":
+		return zipFS(ra, size)
+	case "tar":
+		return tarFS(nil, ra, size)
+	case "tgz":
+		return tarFS(func() (io.ReadCloser, error) {
+			r, err := open()
+			if err != nil {
+				return nil, err
+			}
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			return readCloser{gz, r}, nil
+		}, nil, 0)
+	}
+	return nil, errUnknownArchive
+}
+
+func zipFS(ra io.ReaderAt, size int64) (fs.FS, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	a := newArchiveFS()
+	for _, f := range zr.File {
+		f := f
+		if strings.HasSuffix(f.Name, "/") {
+			a.add(f.Name, true, 0, f.Modified, nil)
+			continue
+		}
+		a.add(f.Name, false, int64(f.UncompressedSize64), f.Modified, func() (io.ReadSeekCloser, error) {
+			if f.Method == zip.Store {
+				offset, err := f.DataOffset()
+				if err != nil {
+					return nil, err
+				}
+				return nopSeekCloser{io.NewSectionReader(ra, offset, int64(f.UncompressedSize64))}, nil
+			}
+			return &streamSeeker{open: f.Open, size: int64(f.UncompressedSize64)}, nil
+		})
+	}
+	return a, nil
+}
+
+// tarFS indexes a tar file. With ra, the headers are read at their
+// offsets and the contents skipped with Seek, and members are read at
+// their offset; otherwise the archive is read through from open, and
+// scanned up to a member again to read it.
+func tarFS(open func() (io.ReadCloser, error), ra io.ReaderAt, size int64) (fs.FS, error) {
+	var r io.Reader
+	var sr *io.SectionReader
+	if ra != nil {
+		sr = io.NewSectionReader(ra, 0, size)
+		r = sr
+	} else {
+		rc, err := open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	tr := tar.NewReader(r)
+	a := newArchiveFS()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			a.add(hdr.Name, true, 0, hdr.ModTime, nil)
+		case tar.TypeReg:
+			name, size := hdr.Name, hdr.Size
+			if sr != nil {
+				// tar.Reader reads no further than the header.
+				offset, err := sr.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return nil, err
+				}
+				a.add(name, false, size, hdr.ModTime, func() (io.ReadSeekCloser, error) {
+					return nopSeekCloser{io.NewSectionReader(ra, offset, size)}, nil
+				})
+				continue
+			}
+			a.add(name, false, size, hdr.ModTime, func() (io.ReadSeekCloser, error) {
+				member := func() (io.ReadCloser, error) { return tarMember(open, name) }
+				return &streamSeeker{open: member, size: size}, nil
+			})
+		}
+	}
+	return a, nil
+}
+
+// tarMember scans the archive for a member and returns its content.
+func tarMember(open func() (io.ReadCloser, error), name string) (io.ReadCloser, error) {
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			r.Close()
+			if err == io.EOF {
+				err = fs.ErrNotExist
+			}
+			return nil, err
+		}
+		if hdr.Name == name {
+			return readCloser{tr, r}, nil
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// archiveFS is an fs.FS of the members of an archive. Directories that
+// are only implied by the names of members are added as well.
+type archiveFS struct {
+	nodes map[string]*archiveNode
+}
+
+type archiveNode struct {
+	info     *fileInfo
+	open     func() (io.ReadSeekCloser, error) // nil for directories
+	children []fs.DirEntry
+}
+
+func newArchiveFS() *archiveFS {
+	return &archiveFS{nodes: map[string]*archiveNode{
+		".": {info: &fileInfo{name: ".", isDir: true}},
+	}}
+}
+
+// add adds a member. Names that are unsafe or repeated are skipped.
+func (a *archiveFS) add(name string, isDir bool, size int64, modTime time.Time, open func() (io.ReadSeekCloser, error)) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" || !fs.ValidPath(name) {
+		return
+	}
+	if n, ok := a.nodes[name]; ok {
+		if isDir && n.info.isDir {
+			n.info.modTime = modTime
+		}
+		return
+	}
+	a.dir(path.Dir(name))
+	a.link(name, &archiveNode{
+		info: &fileInfo{name: path.Base(name), size: size, modTime: modTime, isDir: isDir},
+		open: open,
+	})
+}
+
+// dir returns the node of a directory, adding it and its parents if
+// needed.
+func (a *archiveFS) dir(name string) *archiveNode {
+	if n, ok := a.nodes[name]; ok {
+		return n
+	}
+	a.dir(path.Dir(name))
+	return a.link(name, &archiveNode{info: &fileInfo{name: path.Base(name), isDir: true}})
+}
+
+func (a *archiveFS) link(name string, n *archiveNode) *archiveNode {
+	a.nodes[name] = n
+	parent := a.nodes[path.Dir(name)]
+	parent.children = append(parent.children, fs.FileInfoToDirEntry(n.info))
+	return n
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n, ok := a.nodes[name]
+	if !ok || (n.open == nil && !n.info.isDir) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.info.isDir {
+		entries := append([]fs.DirEntry(nil), n.children...)
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		return &archiveDir{info: n.info, entries: entries}, nil
+	}
+	r, err := n.open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &archiveFile{r, n.info}, nil
+}
+
+type archiveFile struct {
+	io.ReadSeekCloser
+	info *fileInfo
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+type archiveDir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *archiveDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// findArchive returns the path of the archive a request path lies in,
+// such as /files/site.zip for /files/site.zip/ and /files/site.zip/a.txt.
+// The archive itself, without a trailing slash, is served as a file.
+func findArchive(upath string) (string, bool) {
+	clean := path.Clean(upath)
+	segments := strings.Split(clean, "/")
+	for i := 1; i < len(segments); i++ {
+		if archiveFormat(segments[i]) == "" {
+			continue
+		}
+		if i == len(segments)-1 && !strings.HasSuffix(upath, "/") {
+			return "", false
+		}
+		archive := strings.Join(segments[:i+1], "/")
+		if info, err := storage.Stat(archive); err == nil && !info.IsDir() {
+			return archive, true
+		}
+	}
+	return "", false
+}
+
+// serveArchive serves a listing or member of the archive at archive.
+// The index of a ZIP or tar file is read for every request, from its
+// central directory or its headers, skipping the contents. That of a compressed tar file takes
+// decompressing the whole archive, so it is cached.
+func serveArchive(w http.ResponseWriter, r *http.Request, archive, name string) {
+	info, err := storage.Stat(archive)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	var fsys fs.FS
+	if format := archiveFormat(archive); format == "tgz" {
+		fsys, err = tgzIndex(archive, info)
+	} else {
+		var f io.ReadSeekCloser
+		f, err = storage.Open(archive)
+		if err != nil {
+			serveError(w, r, err)
+			return
+		}
+		defer f.Close()
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			ra = &seekReaderAt{rs: f}
+		}
+		open := func() (io.ReadCloser, error) { return storage.Open(archive) }
+		fsys, err = openArchive(format, ra, info.Size(), open)
+	}
+	if err != nil {
+		errorPage(w, r, http.StatusUnprocessableEntity, "invalid archive")
+		return
+	}
+	serveFile(w, r, archiveFileSystem{backendFS{&fsBackend{fsys}}, archive}, name, true)
+}
+
+// Indexes of compressed tar files that are kept.
+const tgzIndexCacheSize = 32
+
+// tgzIndexes holds the indexes of compressed tar files by path, for as
+// long as the size and modification time of the archive stay the same.
+var tgzIndexes = struct {
+	mu      sync.Mutex
+	indexes map[string]*cachedIndex
+}{indexes: map[string]*cachedIndex{}}
+
+type cachedIndex struct {
+	size    int64
+	modTime time.Time
+	used    time.Time
+	fsys    fs.FS
+}
+
+// tgzIndex returns the index of the compressed tar file at archive,
+// whose stat is info, reading it if it isn't cached.
+func tgzIndex(archive string, info fs.FileInfo) (fs.FS, error) {
+	tgzIndexes.mu.Lock()
+	c := tgzIndexes.indexes[archive]
+	if c != nil && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		c.used = time.Now()
+		tgzIndexes.mu.Unlock()
+		return c.fsys, nil
+	}
+	tgzIndexes.mu.Unlock()
+
+	// Members are read by scanning the archive again.
+	open := func() (io.ReadCloser, error) { return storage.Open(archive) }
+	fsys, err := openArchive("tgz", nil, info.Size(), open)
+	if err != nil {
+		return nil, err
+	}
+
+	tgzIndexes.mu.Lock()
+	defer tgzIndexes.mu.Unlock()
+	if _, ok := tgzIndexes.indexes[archive]; !ok && len(tgzIndexes.indexes) >= tgzIndexCacheSize {
+		oldest := ""
+		for p, c := range tgzIndexes.indexes {
+			if oldest == "" || c.used.Before(tgzIndexes.indexes[oldest].used) {
+				oldest = p
+			}
+		}
+		delete(tgzIndexes.indexes, oldest)
+	}
+	tgzIndexes.indexes[archive] = &cachedIndex{info.Size(), info.ModTime(), time.Now(), fsys}
+	return fsys, nil
+}
+
+// archiveFileSystem serves the members of an archive at their full URL
+// path, so listings get the right title.
+type archiveFileSystem struct {
+	http.FileSystem
+	prefix string
+}
+
+func (a archiveFileSystem) Open(name string) (http.File, error) {
+	return a.FileSystem.Open(strings.TrimPrefix(name, a.prefix))
+}
+
+// seekReaderAt implements io.ReaderAt with Seek and Read, for backends
+// whose files have no ReadAt.
+type seekReaderAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.rs, p)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeInvalidArchive(t *testing.T) {
+	root := testStorage(t)
+	for _, name := range []string{"bad.zip", "bad.tar", "bad.tar.gz"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("not an archive\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/"+name+"/", nil)
+		serveArchive(w, r, "/"+name, "/"+name+"/")
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d", name, w.Code)
+		}
+	}
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	ra io.ReaderAt
+	n  int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.ra.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+// The index of a tar file comes from its headers alone.
+func TestTarIndexSkipsContents(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a.bin", "b.bin", "c.txt"} {
+		size := int64(1 << 20)
+		if name == "c.txt" {
+			size = 5
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg})
+		tw.Write(bytes.Repeat([]byte(name[:1]), int(size)))
+	}
+	tw.Close()
+
+	ra := &countingReaderAt{ra: bytes.NewReader(buf.Bytes())}
+	fsys, err := openArchive("tar", ra, int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.n > 64<<10 {
+		t.Errorf("read %d bytes of a %d byte archive for its index", ra.n, buf.Len())
+	}
+	f, err := fsys.Open("c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != strings.Repeat("c", 5) {
+		t.Errorf("c.txt: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent is one line of the audit log.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`           // What happened, e.g. "retention.remove"
+	User   string    `json:"user,omitempty"`   // Who did it, empty for the server itself
+	IP     string    `json:"ip,omitempty"`     // Address of the client
+	Paths  []string  `json:"paths,omitempty"`  // Affected paths
+	Detail string    `json:"detail,omitempty"` // Anything else worth knowing
+	Prev   string    `json:"prev,omitempty"`   // Hash of the previous line, empty for the first
+}
+
+// Every line of the audit log ends with the hash of everything before
+// it, so a line can't be changed, removed or inserted without breaking
+// the chain for all lines after it:
+//
+//	{"time":...,"prev":"<hash of the previous line>","hash":"<hex SHA-256>"}
+//
+// The hash is taken over the line as if it ended after prev, with the
+// closing brace. A plain SHA-256 chain can be recomputed by anyone who
+// can write the file, so with -audit-key the hash is an HMAC-SHA256
+// with a key that only the server and the auditors have.
+const auditHashField = `,"hash":"`
+
+// Shortest key accepted for -audit-key.
+const auditKeyMin = 16
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File // Opened by setupAudit, nil without -audit-log
+	auditLast string   // Hash of the last line written
+	auditKey  []byte   // Key of the HMAC, nil for plain SHA-256
+)
+
+// setupAudit opens the -audit-log file for appending and continues the
+// chain of the lines already in it.
+func setupAudit() error {
+	if auditLog == "" {
+		if auditKeyFile != "" {
+			return errors.New("-audit-key needs -audit-log.")
+		}
+		return nil
+	}
+	if auditKeyFile != "" {
+		key, err := readAuditKey(auditKeyFile)
+		if err != nil {
+			return err
+		}
+		auditKey = key
+	}
+	f, err := os.OpenFile(auditLog, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	last, err := lastAuditHash(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v, check it with `%s verify-audit`", auditLog, err, NAME)
+	}
+	auditFile, auditLast = f, last
+	return nil
+}
+
+// readAuditKey reads the key of the chain from a file.
+func readAuditKey(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < auditKeyMin {
+		return nil, fmt.Errorf("The key in %s must be at least %d bytes long.", name, auditKeyMin)
+	}
+	return key, nil
+}
+
+// lastAuditHash returns the hash of the last line of an audit log, after
+// checking that it was made with the current key.
+func lastAuditHash(r io.Reader) (string, error) {
+	var last []byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil || last == nil {
+		return "", err
+	}
+	body, hash, err := splitAuditLine(last)
+	if err == nil && auditHash(body) != hash {
+		err = errors.New("the last line doesn't match its hash, or was written with another -audit-key")
+	}
+	return hash, err
+}
+
+// splitAuditLine splits a line of the audit log into the hashed part and
+// the hash.
+func splitAuditLine(line []byte) (body []byte, hash string, err error) {
+	i := bytes.LastIndex(line, []byte(auditHashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", errors.New("line without hash")
+	}
+	hash = string(line[i+len(auditHashField) : len(line)-2])
+	return append(line[:i:i], '}'), hash, nil
+}
+
+// auditHash returns the hash of a line: its HMAC with auditKey, or
+// its SHA-256 without a key.
+func auditHash(body []byte) string {
+	if auditKey != nil {
+		mac := hmac.New(sha256.New, auditKey)
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// audit appends an event to the audit log as a line of JSON. Changes to
+// files also go to the change feed.
+func audit(e auditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if changes != nil && changeActions[e.Action] {
+		changes.record(e.Time, e.Paths)
+	}
+	if auditFile == nil {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	e.Prev = auditLast
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	hash := auditHash(body)
+	line := append(body[:len(body)-1:len(body)-1], auditHashField+hash+"\"}\n"...)
+	if _, err := auditFile.Write(line); err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	auditLast = hash
+}
+
+// auditRequest writes an event for something a client did. user may be
+// nil for anonymous clients.
+func auditRequest(r *http.Request, user *account, action, detail string, paths ...string) {
+	e := auditEvent{Action: action, IP: clientIP(r), Paths: paths, Detail: detail}
+	if user != nil {
+		e.User = user.Name
+	}
+	audit(e)
+}
+
+// verifyAudit checks the chain of an audit log. It returns the number of
+// lines checked and an error naming the first line that doesn't fit.
+func verifyAudit(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	prev := ""
+	n := 0
+	for scanner.Scan() {
+		n++
+		body, hash, err := splitAuditLine(scanner.Bytes())
+		if err != nil {
+			return n - 1, fmt.Errorf("line %d: %v", n, err)
+		}
+		var e auditEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return n - 1, fmt.Errorf("line %d: %v", n, err)
+		}
+		if e.Prev != prev {
+			return n - 1, fmt.Errorf("line %d: does not follow line %d, lines are missing or were reordered", n, n-1)
+		}
+		if auditHash(body) != hash {
+			if n == 1 {
+				return 0, errors.New("line 1: hash mismatch, the line was changed or the key is wrong")
+			}
+			return n - 1, fmt.Errorf("line %d: hash mismatch, the line was changed", n)
+		}
+		prev = hash
+	}
+	return n, scanner.Err()
+}
+
+// verifyAuditCommand implements `fileserver verify-audit [-key FILE] FILE`.
+func verifyAuditCommand(args []string) int {
+	fl := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	fl.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify-audit [-key FILE] FILE\n", COMMAND)
+		fl.PrintDefaults()
+	}
+	keyFile := fl.String("key", "", "File with the -audit-key the log was written with.")
+	fl.Parse(args)
+	if fl.NArg() != 1 {
+		fl.Usage()
+		return 2
+	}
+	if *keyFile != "" {
+		key, err := readAuditKey(*keyFile)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		auditKey = key
+	}
+	name := fl.Arg(0)
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer f.Close()
+	n, err := verifyAudit(f)
+	if err != nil {
+		fmt.Printf("%s: %v (%d lines are intact)\n", name, err, n)
+		return 1
+	}
+	fmt.Printf("%s: %d lines, chain intact.\n", name, n)
+	return 0
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PBKDF2 parameters of new password hashes.
+const (
+	hashIterations = 100000
+	hashSaltLen    = 16
+	hashKeyLen     = 32
+)
+
+// Permissions a user can be given in the users file.
+const (
+	permWrite = "write" // may change files
+	permAdmin = "admin" // may run administrative operations
+)
+
+// account is one user from the -users file.
+type account struct {
+	Name  string
+	hash  string
+	perms map[string]bool
+}
+
+func (a *account) can(perm string) bool {
+	return a != nil && (a.perms[perm] || a.perms[permAdmin])
+}
+
+var accounts map[string]*account // Users by name, nil if -users is not set
+
+// loadUsers reads the users file. Every line has the form
+//
+//	name:hash[:perm,perm...]
+//
+// where hash is made by -hash-password and perm is write or admin.
+// Users without permissions may only read. Empty lines and lines
+// starting with # are ignored.
+func loadUsers(name string) (map[string]*account, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]*account)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:hash[:permissions]", name, n)
+		}
+		a := &account{Name: fields[0], hash: fields[1], perms: make(map[string]bool)}
+		if len(fields) == 3 {
+			for _, p := range strings.Split(fields[2], ",") {
+				p = strings.TrimSpace(p)
+				if p != permWrite && p != permAdmin {
+					return nil, fmt.Errorf("%s:%d: unknown permission %q", name, n, p)
+				}
+				a.perms[p] = true
+			}
+		}
+		users[a.Name] = a
+	}
+	return users, scanner.Err()
+}
+
+// hashPassword returns a salted PBKDF2-SHA256 hash for the users file.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, hashIterations, hashKeyLen)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("{PBKDF2}%d$%s$%s", hashIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassword compares a password with a hash from the users file.
+// Besides the hashes made by hashPassword, {SHA256} followed by the hex
+// digest is accepted.
+func checkPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{PBKDF2}"):
+		parts := strings.Split(hash[len("{PBKDF2}"):], "$")
+		if len(parts) != 3 {
+			return false
+		}
+		iter, err := strconv.Atoi(parts[0])
+		if err != nil || iter <= 0 {
+			return false
+		}
+		enc := base64.RawStdEncoding
+		salt, err1 := enc.DecodeString(parts[1])
+		want, err2 := enc.DecodeString(parts[2])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+		return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+	case strings.HasPrefix(hash, "{SHA256}"):
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(hash[len("{SHA256}"):]))) == 1
+	}
+	return false
+}
+
+// printPasswordHash reads a password from the first line of stdin and
+// prints its hash.
+func printPasswordHash() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Println("Error reading password.")
+		os.Exit(1)
+	}
+	hash, err := hashPassword(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
+
+var errBadCredentials = errors.New("invalid user name or password")
+
+// usersMu guards the contents of accounts, which reloadUsers replaces.
+var usersMu sync.RWMutex
+
+// login checks a user name and password against the users file.
+func login(name, password string) (*account, error) {
+	usersMu.RLock()
+	a, ok := accounts[name]
+	usersMu.RUnlock()
+	if !ok || !checkPassword(a.hash, password) {
+		return nil, errBadCredentials
+	}
+	return a, nil
+}
+
+// userByName returns a user from the users file, or nil.
+func userByName(name string) *account {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return accounts[name]
+}
+
+// authenticate returns the user of the request, or nil for anonymous
+// requests. An error means the request carried invalid credentials.
+func authenticate(r *http.Request) (*account, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return login(name, password)
+}
+
+// sameSiteJSON refuses requests that change something unless they are
+// JSON from the server's own pages or a non-browser client. Browsers
+// only send other sites' JSON after a CORS preflight, which the server
+// never answers, so basic auth credentials can't be used by other sites
+// to change files.
+func sameSiteJSON(w http.ResponseWriter, r *http.Request) bool {
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType != "application/json" {
+		errorPage(w, r, http.StatusUnsupportedMediaType, "the request must be application/json")
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		errorPage(w, r, http.StatusForbidden, "cross-site request refused")
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			errorPage(w, r, http.StatusForbidden, "cross-site request refused")
+			return false
+		}
+	}
+	return true
+}
+
+// requireUser authenticates the request and checks that the user has perm.
+// If not, it replies with 401 or 403 and returns nil.
+func requireUser(w http.ResponseWriter, r *http.Request, perm string) *account {
+	if accounts == nil {
+		errorPage(w, r, http.StatusForbidden, "this server has no users, start it with -users")
+		return nil
+	}
+	a, err := authenticate(r)
+	if a == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+NAME+`", charset="UTF-8"`)
+		message := ""
+		if err != nil {
+			message = err.Error()
+			name, _, _ := r.BasicAuth()
+			audit(auditEvent{Action: "auth.failure", User: name, IP: clientIP(r), Paths: []string{r.URL.Path}, Detail: message})
+		}
+		errorPage(w, r, http.StatusUnauthorized, message)
+		return nil
+	}
+	if !a.can(perm) {
+		auditRequest(r, a, "auth.denied", "permission "+perm+" required", r.URL.Path)
+		errorPage(w, r, http.StatusForbidden, "permission "+perm+" required")
+		return nil
+	}
+	return a
+}
+
+// reloadUsers reads the users file again, on SIGHUP. If it has become
+// invalid, the old users stay.
+func reloadUsers() {
+	if accounts == nil {
+		return
+	}
+	users, err := loadUsers(usersFile)
+	if err != nil {
+		log.Printf("Not reloading the users file: %v", err)
+		audit(auditEvent{Action: "config.reload", Paths: []string{usersFile}, Detail: "failed: " + err.Error()})
+		return
+	}
+	usersMu.Lock()
+	for name := range accounts {
+		delete(accounts, name)
+	}
+	for name, a := range users {
+		accounts[name] = a
+	}
+	usersMu.Unlock()
+	log.Printf("Reloaded %d users from %s.", len(users), usersFile)
+	audit(auditEvent{Action: "config.reload", Paths: []string{usersFile}, Detail: fmt.Sprintf("%d users", len(users))})
+}
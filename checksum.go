@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Most digests remembered. When there are more, the cache starts over.
+const checksumCacheSize = 100000
+
+// checksums remembers the digests of files for ?checksum, which anyone
+// may ask for, so that asking again doesn't read the files again. A
+// digest is used as long as the size and modification time of the file
+// stay the same.
+var checksums = struct {
+	mu   sync.Mutex
+	sums map[string]cachedChecksum
+}{sums: make(map[string]cachedChecksum)}
+
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// Files hashed at the same time; more requests wait for their turn.
+var checksumSlots = make(chan struct{}, max(2, runtime.NumCPU()/2))
+
+// fileChecksum returns the hex SHA-256 digest of a file, whose stat is
+// info.
+func fileChecksum(fs http.FileSystem, name string, info os.FileInfo) (string, error) {
+	checksums.mu.Lock()
+	c, ok := checksums.sums[name]
+	checksums.mu.Unlock()
+	if ok && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.sum, nil
+	}
+
+	checksumSlots <- struct{}{}
+	defer func() { <-checksumSlots }()
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	checksums.mu.Lock()
+	if len(checksums.sums) >= checksumCacheSize {
+		clear(checksums.sums)
+	}
+	checksums.sums[name] = cachedChecksum{info.Size(), info.ModTime(), sum}
+	checksums.mu.Unlock()
+	return sum, nil
+}
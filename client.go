@@ -0,0 +1,739 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ls, get, put and sync commands talk to another fileserver over
+// HTTP: they read the JSON listings, download files with range requests
+// and upload them with PUT. The user name and password go into the URL,
+// e.g. http://alice@host:8080/dir/; a password left out is taken from
+// $FILESERVER_PASSWORD.
+
+// Files are downloaded in blocks of this size, so that several of them
+// can be fetched at once and an interrupted download can continue with
+// the blocks that are still missing.
+const clientBlockSize = 8 << 20
+
+// Attempts to fetch a block before a download gives up.
+const clientRetries = 3
+
+// httpClient is used by the commands, the replica and the caching proxy.
+// Requests have no overall deadline, since downloads may take long, but
+// a server that doesn't take the connection or never answers is given
+// up on. The header timeout leaves time for a server hashing a large
+// file for ?checksum.
+var httpClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	ForceAttemptHTTP2:     true,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 5 * time.Minute,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   16,
+}}
+
+var (
+	errNotDirectory  = errors.New("not a directory")
+	errIsDirectory   = errors.New("is a directory")
+	errRemoteChanged = errors.New("the file changed on the server during the download, start it again")
+	errBadName       = errors.New("invalid file name in listing")
+)
+
+// statusError is an error reply of the server.
+type statusError struct {
+	url     string
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.url + ": " + e.message
+}
+
+// remoteError turns an unexpected reply into an error, with the message
+// of the JSON error body if there is one.
+func remoteError(resp *http.Response) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+	msg := resp.Status
+	if body.Message != "" {
+		msg += ", " + body.Message
+	}
+	return &statusError{resp.Request.URL.Redacted(), resp.StatusCode, msg}
+}
+
+// isRemote reports whether a command argument is a URL rather than a
+// local path.
+func isRemote(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// remoteURL parses the URL of a remote file or directory.
+func remoteURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%s: not an http or https URL", s)
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); !ok {
+			u.User = url.UserPassword(u.User.Username(), os.Getenv("FILESERVER_PASSWORD"))
+		}
+	}
+	u.Path = "/" + strings.TrimPrefix(u.Path, "/")
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	return u, nil
+}
+
+// childURL returns the URL of the slash separated path name below u,
+// with a trailing slash for directories.
+func childURL(u *url.URL, name string, dir bool) *url.URL {
+	c := *u
+	c.Path = path.Join(u.Path, name)
+	if dir && !strings.HasSuffix(c.Path, "/") {
+		c.Path += "/"
+	}
+	return &c
+}
+
+// remoteList returns the entries of the remote directory u.
+func remoteList(u *url.URL, checksum bool) ([]listEntry, error) {
+	u = childURL(u, "", true)
+	if checksum {
+		u.RawQuery = "checksum"
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteError(resp)
+	}
+	// Files are redirected to their URL without the slash.
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasSuffix(resp.Request.URL.Path, "/") || contentType != "application/json" {
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), errNotDirectory)
+	}
+	var entries []listEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", u.Redacted(), err)
+	}
+	// The names end up in local paths, so a server must not be able to
+	// point outside the directory or back up the tree.
+	for _, e := range entries {
+		if !safeName(e.Name) {
+			return nil, fmt.Errorf("%s: %w %q", u.Redacted(), errBadName, e.Name)
+		}
+	}
+	return entries, nil
+}
+
+// safeName reports whether name is a single path element.
+func safeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// walkRemote lists everything below the remote directory u by slash
+// separated paths relative to it.
+func walkRemote(u *url.URL, checksum bool) (map[string]listEntry, error) {
+	all := make(map[string]listEntry)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := remoteList(childURL(u, dir, true), checksum)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			rel := path.Join(dir, e.Name)
+			all[rel] = e
+			if e.IsDir {
+				if err := walk(rel); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return all, walk("")
+}
+
+// remoteStat returns the size and modification time of a remote file and
+// whether it can be fetched in ranges. The size is -1 if unknown.
+func remoteStat(u *url.URL) (size int64, modTime time.Time, ranges bool, err error) {
+	resp, err := httpClient.Head(u.String())
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, false, remoteError(resp)
+	}
+	if strings.HasSuffix(resp.Request.URL.Path, "/") {
+		return 0, time.Time{}, false, fmt.Errorf("%s: %w", u.Redacted(), errIsDirectory)
+	}
+	modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	ranges = resp.ContentLength >= 0 && !modTime.IsZero() && resp.Header.Get("Accept-Ranges") == "bytes"
+	return resp.ContentLength, modTime, ranges, nil
+}
+
+// download fetches the remote file u to dst, parallel blocks at a time.
+// The data goes to dst.part first and the number of every finished block
+// is appended to dst.part.blocks, so that a download that was interrupted
+// continues with the missing blocks when it is started again. If sum is
+// not empty the file must have that SHA-256 digest.
+func download(u *url.URL, dst string, parallel int, sum string) error {
+	size, modTime, ranges, err := remoteStat(u)
+	if err != nil {
+		return err
+	}
+	part, progress := dst+".part", dst+".part.blocks"
+	blocks := 1
+	if ranges {
+		blocks = int((size + clientBlockSize - 1) / clientBlockSize)
+	} else {
+		parallel = 1
+	}
+	// The first line of the progress file names the version of the file
+	// the blocks belong to.
+	version := fmt.Sprintf("%d %d", size, modTime.Unix())
+	done := make([]bool, blocks)
+	resume := false
+	if data, err := os.ReadFile(progress); err == nil && ranges {
+		lines := strings.Split(string(data), "\n")
+		if resume = lines[0] == version; resume {
+			for _, line := range lines[1:] {
+				if b, err := strconv.Atoi(line); err == nil && b >= 0 && b < blocks {
+					done[b] = true
+				}
+			}
+		}
+	}
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	flags := os.O_WRONLY | os.O_APPEND
+	if !resume {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	finished, err := os.OpenFile(progress, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer finished.Close()
+	if !resume {
+		if _, err := fmt.Fprintln(finished, version); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	todo := make(chan int)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range todo {
+				err := fetchBlock(ctx, u, f, b, size, modTime, ranges)
+				mu.Lock()
+				if err == nil {
+					_, err = fmt.Fprintln(finished, b)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for b := 0; b < blocks && size != 0; b++ {
+		if done[b] {
+			continue
+		}
+		select {
+		case todo <- b:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr != nil {
+		if errors.Is(firstErr, errRemoteChanged) {
+			os.Remove(progress)
+		}
+		return firstErr
+	}
+
+	if sum != "" {
+		got, err := localChecksum(part)
+		if err != nil {
+			return err
+		}
+		if got != sum {
+			os.Remove(progress)
+			return fmt.Errorf("%s: checksum mismatch, expected %s and got %s", u.Redacted(), sum, got)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return err
+	}
+	finished.Close()
+	os.Remove(progress)
+	if !modTime.IsZero() {
+		os.Chtimes(dst, modTime, modTime)
+	}
+	return nil
+}
+
+// fetchBlock downloads block b of the file into f and tries again a few
+// times if the connection fails.
+func fetchBlock(ctx context.Context, u *url.URL, f *os.File, b int, size int64, modTime time.Time, ranges bool) error {
+	var err error
+	for try := 0; try < clientRetries; try++ {
+		if try > 0 {
+			select {
+			case <-time.After(time.Duration(try) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err = fetchRange(ctx, u, f, b, size, modTime, ranges)
+		var netErr net.Error
+		if !errors.As(err, &netErr) && !errors.Is(err, io.ErrUnexpectedEOF) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// fetchRange fetches block b once. Without ranges the whole file is one
+// block.
+func fetchRange(ctx context.Context, u *url.URL, f *os.File, b int, size int64, modTime time.Time, ranges bool) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	start, end := int64(0), size
+	if ranges {
+		start = int64(b) * clientBlockSize
+		end = min(start+clientBlockSize, size)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+		req.Header.Set("If-Range", modTime.UTC().Format(http.TimeFormat))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case ranges && resp.StatusCode == http.StatusOK:
+		// If-Range didn't match.
+		return errRemoteChanged
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent:
+		return remoteError(resp)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(f, start), resp.Body)
+	if err == nil && end >= 0 && n != end-start {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// upload stores a local file at the remote URL u.
+func upload(name string, u *url.URL) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: %w", name, errIsDirectory)
+	}
+	var body io.Reader = f
+	if info.Size() == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest("PUT", u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return remoteError(resp)
+	}
+	return nil
+}
+
+// localChecksum returns the hex SHA-256 digest of a local file.
+func localChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newer reports whether a is newer than b. Modification times are
+// compared in seconds, which is all HTTP dates and some backends keep.
+func newer(a, b time.Time) bool {
+	return a.Truncate(time.Second).After(b.Truncate(time.Second))
+}
+
+// runJobs runs the jobs, n at a time, and returns the number that failed.
+// Errors are printed as they happen.
+func runJobs(n int, jobs []func() error) int {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	todo := make(chan func() error)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range todo {
+				if err := job(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		todo <- job
+	}
+	close(todo)
+	wg.Wait()
+	return failed
+}
+
+// clientFlags returns the flag set of a client command.
+func clientFlags(name, usage string) *flag.FlagSet {
+	fl := flag.NewFlagSet(name, flag.ExitOnError)
+	fl.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", COMMAND, name, usage)
+		fl.PrintDefaults()
+	}
+	return fl
+}
+
+// lsCommand implements `fileserver ls URL`.
+func lsCommand(args []string) int {
+	fl := clientFlags("ls", "[-r] URL")
+	recursive := fl.Bool("r", false, "List subdirectories too.")
+	fl.Parse(args)
+	if fl.NArg() != 1 {
+		fl.Usage()
+		return 2
+	}
+	u, err := remoteURL(fl.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var all map[string]listEntry
+	if *recursive {
+		all, err = walkRemote(u, false)
+	} else {
+		var entries []listEntry
+		entries, err = remoteList(u, false)
+		all = make(map[string]listEntry)
+		for _, e := range entries {
+			all[e.Name] = e
+		}
+	}
+	if errors.Is(err, errNotDirectory) {
+		var e listEntry
+		e.Size, e.ModTime, _, err = remoteStat(u)
+		all = map[string]listEntry{path.Base(u.Path): e}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e, size := all[name], "-"
+		if e.IsDir {
+			name += "/"
+		} else if e.Size >= 0 {
+			size = formatSize(e.Size)
+		}
+		fmt.Printf("%s  %10s  %s\n", e.ModTime.Local().Format(DATEFORMAT), size, name)
+	}
+	return 0
+}
+
+// getCommand implements `fileserver get URL [FILE]`.
+func getCommand(args []string) int {
+	fl := clientFlags("get", "[-parallel N] URL [FILE]")
+	parallel := fl.Int("parallel", 4, "Blocks downloaded at once.")
+	fl.Parse(args)
+	if fl.NArg() < 1 || fl.NArg() > 2 || *parallel < 1 {
+		fl.Usage()
+		return 2
+	}
+	u, err := remoteURL(fl.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	dst := path.Base(u.Path)
+	if fl.NArg() == 2 {
+		dst = fl.Arg(1)
+		if info, err := os.Stat(dst); err == nil && info.IsDir() {
+			dst = filepath.Join(dst, path.Base(u.Path))
+		}
+	}
+	if err := download(u, dst, *parallel, ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// putCommand implements `fileserver put FILE... URL`.
+func putCommand(args []string) int {
+	fl := clientFlags("put", "FILE... URL")
+	fl.Parse(args)
+	if fl.NArg() < 2 {
+		fl.Usage()
+		return 2
+	}
+	files := fl.Args()[:fl.NArg()-1]
+	u, err := remoteURL(fl.Arg(fl.NArg() - 1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// Several files, or a URL ending in a slash, go into a directory.
+	intoDir := len(files) > 1 || strings.HasSuffix(u.Path, "/")
+	status := 0
+	for _, name := range files {
+		target := u
+		if intoDir {
+			target = childURL(u, filepath.Base(name), false)
+		}
+		if err := upload(name, target); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// syncCommand implements `fileserver sync SOURCE TARGET`, where one of
+// them is a local directory and the other a URL. A file is transferred if
+// it is missing from the target, its size differs or the source is newer,
+// or with -checksum if its SHA-256 digest differs. Nothing is deleted.
+func syncCommand(args []string) int {
+	fl := clientFlags("sync", "[-checksum] [-dry-run] [-parallel N] SOURCE TARGET")
+	checksum := fl.Bool("checksum", false, "Compare SHA-256 digests instead of modification times.")
+	dryRun := fl.Bool("dry-run", false, "Only print what would be transferred.")
+	parallel := fl.Int("parallel", 4, "Files transferred at once.")
+	fl.Parse(args)
+	if fl.NArg() != 2 || isRemote(fl.Arg(0)) == isRemote(fl.Arg(1)) || *parallel < 1 {
+		fl.Usage()
+		return 2
+	}
+	local, remote := fl.Arg(1), fl.Arg(0)
+	up := isRemote(fl.Arg(1))
+	if up {
+		local, remote = remote, local
+	}
+	u, err := remoteURL(remote)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var jobs []func() error
+	if up {
+		jobs, err = syncUp(local, u, *checksum)
+	} else {
+		jobs, err = syncDown(u, local, *checksum)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *dryRun {
+		return 0
+	}
+	if failed := runJobs(*parallel, jobs); failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d files failed\n", failed, len(jobs))
+		return 1
+	}
+	return 0
+}
+
+// syncUp returns the uploads that bring the remote directory u up to
+// date with the local directory dir, after printing their paths.
+func syncUp(dir string, u *url.URL, checksum bool) ([]func() error, error) {
+	remote, err := walkRemote(u, checksum)
+	var se *statusError
+	if errors.As(err, &se) && se.code == http.StatusNotFound {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []func() error
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			// The server hides and refuses dot files.
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		r, found := remote[rel]
+		changed := !found || r.IsDir || r.Size != info.Size()
+		if !changed && checksum {
+			sum, err := localChecksum(p)
+			if err != nil {
+				return err
+			}
+			changed = sum != r.SHA256
+		} else if !changed {
+			changed = newer(info.ModTime(), r.ModTime)
+		}
+		if changed {
+			fmt.Println(rel)
+			target := childURL(u, rel, false)
+			jobs = append(jobs, func() error { return upload(p, target) })
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// syncDown returns the downloads that bring the local directory dir up to
+// date with the remote directory u, after printing their paths.
+func syncDown(u *url.URL, dir string, checksum bool) ([]func() error, error) {
+	remote, err := walkRemote(u, checksum)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(remote))
+	for rel := range remote {
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+	var jobs []func() error
+	for _, rel := range names {
+		r := remote[rel]
+		if r.IsDir {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, fmt.Errorf("%s: %w %q", u.Redacted(), errBadName, rel)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := os.Stat(dst)
+		changed := err != nil || info.Size() != r.Size
+		if !changed && checksum {
+			sum, err := localChecksum(dst)
+			if err != nil {
+				return nil, err
+			}
+			changed = sum != r.SHA256
+		} else if !changed {
+			changed = newer(r.ModTime, info.ModTime())
+		}
+		if changed {
+			fmt.Println(rel)
+			src := childURL(u, rel, false)
+			jobs = append(jobs, func() error {
+				if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+					return err
+				}
+				return download(src, dst, 1, r.SHA256)
+			})
+		}
+	}
+	return jobs, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a computed directory size is trusted when nothing changes
+// through the server, to catch changes made behind its back.
+const dirSizeTTL = 10 * time.Minute
+
+// How long ?du waits for the sizes of its directories before it shows
+// what it has.
+const duWait = 2 * time.Second
+
+const DUTABLE = `
+<table>
+	<thead>
+		<th>Name</th>
+		<th>Size</th>
+		<th></th>
+		<th>Files</th>
+	</thead>
+	<tr>
+		<td><b>Total</b></td>
+		<td><b>{{.DU.SizeText}}</b></td>
+		<td></td>
+		<td><b>{{.DU.Files}}</b></td>
+	</tr>
+	{{- range .DU.Entries}}
+	<tr>
+		<td><div class="{{if .IsDir}}directory{{else}}file{{end}} icon" style="display: inline-block; vertical-align: middle;"></div> {{if .IsDir}}<a href="{{.Path}}?du">{{.Name}}/</a>{{else}}<a href="{{.Path}}">{{.Name}}</a>{{end}}</td>
+		<td>{{.SizeText}}</td>
+		<td><div class="bar"><div style="width: {{.Percent}}%"></div></div></td>
+		<td>{{.Files}}</td>
+	</tr>
+	{{- end}}
+</table>
+{{- if .DU.Pending}}
+<p>Sizes shown as … are still being computed; reload the page to see them.</p>
+{{- end}}`
+
+// dirSize is the recursive size of a directory.
+type dirSize struct {
+	usage
+	computed time.Time
+}
+
+// sizeCache remembers directory sizes. Sizes are computed in the
+// background for listings and ?du, and dropped when files below change.
+type sizeCache struct {
+	mu      sync.Mutex
+	sizes   map[string]dirSize
+	walking bool
+	changed map[string]time.Time // When something below a directory last changed, during a walk
+	pending map[string]bool
+	queue   chan string
+	updated chan struct{} // Closed when a size was computed
+}
+
+var dirSizes = &sizeCache{
+	sizes:   map[string]dirSize{},
+	changed: map[string]time.Time{},
+	pending: map[string]bool{},
+	queue:   make(chan string, 1000),
+	updated: make(chan struct{}),
+}
+
+// get returns the cached size of a directory. If there is none, it is
+// computed in the background and ok is false.
+func (c *sizeCache) get(p string) (u usage, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.sizes[p]; ok && time.Since(s.computed) < dirSizeTTL {
+		return s.usage, true
+	}
+	if !c.pending[p] {
+		select {
+		case c.queue <- p:
+			c.pending[p] = true
+		default:
+			// Busy; the next listing asks again.
+		}
+	}
+	return usage{}, false
+}
+
+// run computes queued sizes, one at a time so large trees don't keep
+// the disk busy for everyone.
+func (c *sizeCache) run() {
+	for p := range c.queue {
+		c.mu.Lock()
+		c.walking = true
+		c.mu.Unlock()
+		c.compute(p)
+		c.mu.Lock()
+		c.walking = false
+		clear(c.changed)
+		delete(c.pending, p)
+		close(c.updated)
+		c.updated = make(chan struct{})
+		c.mu.Unlock()
+	}
+}
+
+// wait returns a channel that is closed when the next size has been
+// computed.
+func (c *sizeCache) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.updated
+}
+
+// compute walks a directory, using and filling the cache for every
+// directory below it. STATEDIR is left out. Only run calls it.
+func (c *sizeCache) compute(p string) (u usage) {
+	c.mu.Lock()
+	s, ok := c.sizes[p]
+	c.mu.Unlock()
+	if ok && time.Since(s.computed) < dirSizeTTL {
+		return s.usage
+	}
+	started := time.Now()
+	entries, err := storage.List(p)
+	if err != nil {
+		return u
+	}
+	for _, e := range entries {
+		name := path.Join(p, e.Name())
+		switch {
+		case isStatePath(name):
+		case e.IsDir():
+			u.add(c.compute(name), 1)
+		default:
+			u.add(usage{e.Size(), 1}, 1)
+		}
+	}
+	c.mu.Lock()
+	// Don't keep a size that may miss a change made during the walk.
+	if c.changed[p].Before(started) {
+		c.sizes[p] = dirSize{u, started}
+	}
+	c.mu.Unlock()
+	return u
+}
+
+// invalidate drops the sizes of p and every directory containing it,
+// after something below p changed.
+func (c *sizeCache) invalidate(p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for p = path.Clean("/" + p); ; p = path.Dir(p) {
+		delete(c.sizes, p)
+		if c.walking {
+			c.changed[p] = now
+		}
+		if p == "/" {
+			break
+		}
+	}
+}
+
+// sizesChanged is called by every operation that changes files.
+func sizesChanged(paths ...string) {
+	for _, p := range paths {
+		dirSizes.invalidate(p)
+	}
+}
+
+// duEntry is one row of the ?du view.
+type duEntry struct {
+	Name     string  `json:"name"`
+	Path     string  `json:"-"`
+	IsDir    bool    `json:"isDir"`
+	Size     int64   `json:"size"`
+	Files    int64   `json:"files"`
+	Pending  bool    `json:"pending,omitempty"`
+	SizeText string  `json:"-"`
+	Percent  float64 `json:"-"`
+}
+
+// duReport is the ?du view of a directory: its total and its entries,
+// largest first.
+type duReport struct {
+	Size     int64     `json:"size"`
+	Files    int64     `json:"files"`
+	Pending  bool      `json:"pending,omitempty"`
+	SizeText string    `json:"-"`
+	Entries  []duEntry `json:"entries"`
+}
+
+// serveDU handles ?du, the disk usage of the entries of a directory.
+// The sizes of subdirectories come from the background computation; what
+// isn't ready within duWait is marked pending, and the totals leave it
+// out.
+func serveDU(w http.ResponseWriter, r *http.Request, urlPath string) {
+	info, err := storage.Stat(urlPath)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	if !info.IsDir() {
+		errorPage(w, r, http.StatusBadRequest, "not a directory")
+		return
+	}
+	entries, err := storage.List(urlPath)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	var report *duReport
+	deadline := time.After(duWait)
+wait:
+	for {
+		updated := dirSizes.wait()
+		report = &duReport{Entries: []duEntry{}}
+		for _, e := range entries {
+			name := path.Join(urlPath, e.Name())
+			if isStatePath(name) {
+				continue
+			}
+			entry := duEntry{Name: e.Name(), Path: basePath + escapePath(name), IsDir: e.IsDir(), Size: e.Size(), Files: 1}
+			if e.IsDir() {
+				u, ok := dirSizes.get(name)
+				entry.Size, entry.Files, entry.Pending = u.Bytes, u.Files, !ok
+				report.Pending = report.Pending || !ok
+			}
+			report.Size += entry.Size
+			report.Files += entry.Files
+			report.Entries = append(report.Entries, entry)
+		}
+		if !report.Pending {
+			break
+		}
+		select {
+		case <-updated:
+		case <-deadline:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+	sort.Slice(report.Entries, func(i, j int) bool { return report.Entries[i].Size > report.Entries[j].Size })
+	report.SizeText = formatSize(report.Size)
+	if report.Pending {
+		report.SizeText += " + …"
+	}
+	for i := range report.Entries {
+		e := &report.Entries[i]
+		e.SizeText = formatSize(e.Size)
+		if e.Pending {
+			e.SizeText = "…"
+		}
+		if report.Size > 0 {
+			e.Percent = float64(e.Size*1000/report.Size) / 10
+		}
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	page := newPage(urlPath, r.URL.Path)
+	page.DU = report
+	renderPage(w, page, "du")
+}
+
+// dirSizeText returns the size shown for a directory in the listing,
+// "…" while it is being computed.
+func dirSizeText(p string) string {
+	if u, ok := dirSizes.get(p); ok {
+		return formatSize(u.Bytes)
+	}
+	return "…"
+}
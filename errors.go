@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// errorData is passed to the error page template.
+type errorData struct {
+	*page
+	Code    int    // HTTP status code, e.g. 404
+	Status  string // Status text, e.g. "Not Found"
+	Message string // Optional detail, may be empty
+}
+
+// statusForError maps an error from opening or reading a file to the
+// HTTP status that should be sent to the client.
+func statusForError(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errInvalidPath):
+		return http.StatusBadRequest
+	case os.IsExist(err):
+		return http.StatusConflict
+	case os.IsNotExist(err), errors.Is(err, errNotInTrash), errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.ENAMETOOLONG):
+		return http.StatusNotFound
+	case os.IsPermission(err), errors.Is(err, syscall.EROFS):
+		return http.StatusForbidden
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE),
+		errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EBUSY),
+		errors.Is(err, syscall.EINTR), errors.Is(err, syscall.ETIMEDOUT):
+		// Transient: running out of descriptors or the disk being busy
+		// usually goes away on its own.
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// serveError replies to the request with the page matching err. The
+// message never contains the local path of the file.
+func serveError(w http.ResponseWriter, r *http.Request, err error) {
+	code := statusForError(err)
+	message := errorReason(err)
+	if code >= 500 && code != http.StatusInsufficientStorage {
+		log.Printf("%s %s: %v", r.Method, r.URL, err)
+		message = ""
+	}
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	errorPage(w, r, code, message)
+}
+
+// errorReason describes err without the local path of the file.
+func errorReason(err error) string {
+	var pe *os.PathError
+	var le *os.LinkError
+	switch {
+	case errors.As(err, &pe):
+		return pe.Err.Error()
+	case errors.As(err, &le):
+		return le.Err.Error()
+	}
+	return err.Error()
+}
+
+// errorPage writes an error response with the given status. Clients
+// asking for JSON get a JSON body, everyone else the error template.
+func errorPage(w http.ResponseWriter, r *http.Request, code int, message string) {
+	status := http.StatusText(code)
+	if code == statusChecksumMismatch {
+		status = "Checksum Mismatch"
+	}
+	data := errorData{newPage(status, r.URL.Path), code, status, message}
+	h := w.Header()
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	delete(h, "Etag")
+	delete(h, "Last-Modified")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if wantsJSON(r) {
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Code    int    `json:"code"`
+			Error   string `json:"error"`
+			Message string `json:"message,omitempty"`
+		}{data.Code, data.Status, data.Message})
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := pageTemplates.ExecuteTemplate(w, "error", data); err != nil {
+		log.Printf("error template: %v", err)
+	}
+}
+
+// wantsJSON reports whether the client prefers JSON over HTML. API and
+// upload requests always get JSON.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, APIPREFIX) || strings.HasPrefix(r.URL.Path, TUSPREFIX) {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	jsonAt := strings.Index(accept, "application/json")
+	if jsonAt < 0 {
+		return false
+	}
+	htmlAt := strings.Index(accept, "text/html")
+	return htmlAt < 0 || jsonAt < htmlAt
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// Reverse proxies from -trusted-proxy. Requests from them are taken to
+// come from the client named in their forwarding headers.
+var (
+	trustedProxies []netip.Prefix
+	trustUnix      bool // Whether peers on a unix socket are trusted
+)
+
+// setupForwarding checks the -trusted-proxy and -base-path options.
+func setupForwarding() error {
+	for _, s := range trustedProxyFlags {
+		if s == "unix" {
+			trustUnix = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("Invalid -trusted-proxy `%s`. Use an address, a CIDR or unix.", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+	if proxyProtocol && len(trustedProxies) == 0 && !trustUnix {
+		// Anyone could name any address in a PROXY header.
+		return errors.New("-proxy-protocol needs -trusted-proxy for the balancers that send the header.")
+	}
+	if basePath != "" {
+		base := strings.TrimSuffix(basePath, "/")
+		// Links are made by putting the base in front, so it must be
+		// usable in a URL as it is.
+		if base != "" && (!strings.HasPrefix(base, "/") || path.Clean(base) != base || escapePath(base) != base) {
+			return fmt.Errorf("Invalid -base-path `%s`. Use a clean path like /files.", basePath)
+		}
+		basePath = base
+	}
+	return nil
+}
+
+// trustedIP reports whether s is the address of a trusted proxy.
+func trustedIP(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
+	}
+	addr = addr.WithZone("").Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedPeer reports whether a connection comes from a trusted proxy.
+func trustedPeer(addr net.Addr) bool {
+	if addr == nil || addr.Network() == "unix" {
+		return trustUnix
+	}
+	return trustedIP(hostOf(addr))
+}
+
+// fromTrustedProxy reports whether r was sent by a trusted proxy.
+func fromTrustedProxy(r *http.Request) bool {
+	ip := clientIP(r)
+	if _, err := netip.ParseAddr(ip); err == nil {
+		return trustedIP(ip)
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return trustUnix && local != nil && local.Network() == "unix"
+}
+
+// forwarded passes on requests from trusted proxies as if they came
+// straight from the client: with its address as RemoteAddr, so that logs,
+// rate limits and the audit log see it, and with the scheme and host it
+// used. Forwarded (RFC 7239) is used if present, X-Forwarded-For, -Proto
+// and -Host otherwise.
+func forwarded(handler http.Handler) http.Handler {
+	if len(trustedProxies) == 0 && !trustUnix {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fromTrustedProxy(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		hops, proto, host := forwardedFor(r.Header)
+		r2 := new(http.Request)
+		*r2 = *r
+		// Walk back from the nearest proxy to the first address that is
+		// not a trusted proxy, which is the client.
+		for i := len(hops) - 1; i >= 0; i-- {
+			if _, err := netip.ParseAddr(hops[i]); err != nil {
+				// Obfuscated or unknown, the last known hop has to do.
+				break
+			}
+			r2.RemoteAddr = hops[i]
+			if !trustedIP(hops[i]) {
+				break
+			}
+		}
+		if host != "" && !strings.ContainsAny(host, " /\\") {
+			r2.Host = host
+		}
+		if proto == "http" || proto == "https" {
+			u := *r.URL
+			u.Scheme, u.Host = proto, r2.Host
+			r2.URL = &u
+		}
+		handler.ServeHTTP(w, r2)
+	})
+}
+
+// forwardedFor returns the client addresses a request was forwarded for,
+// the client first, and the scheme and host of the original request as
+// seen by the nearest proxy.
+func forwardedFor(h http.Header) (hops []string, proto, host string) {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, element := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					value = strings.Trim(value, `"`)
+					switch strings.ToLower(key) {
+					case "for":
+						hops = append(hops, stripPort(value))
+					case "proto":
+						proto = strings.ToLower(value)
+					case "host":
+						host = value
+					}
+				}
+			}
+		}
+		return hops, proto, host
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(v, ",") {
+			hops = append(hops, stripPort(strings.TrimSpace(addr)))
+		}
+	}
+	return hops, strings.ToLower(lastValue(h, "X-Forwarded-Proto")), lastValue(h, "X-Forwarded-Host")
+}
+
+// stripPort returns the address of a forwarded node like 192.0.2.1:4711
+// or [2001:db8::1]:4711 without the port and brackets.
+func stripPort(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+// lastValue returns the last of the comma separated values of a header,
+// the one added by the nearest proxy.
+func lastValue(h http.Header, key string) string {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+	list := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(list[len(list)-1])
+}
+
+// stripBasePath serves the server under -base-path: requests for paths
+// below it reach handler without the base, everything else is not found.
+// Generated links and redirects put the base back in front.
+func stripBasePath(handler http.Handler) http.Handler {
+	if basePath == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			localRedirect(w, r, path.Base(basePath)+"/")
+			return
+		}
+		p, ok := strings.CutPrefix(r.URL.Path, basePath)
+		if !ok || !strings.HasPrefix(p, "/") {
+			errorPage(w, r, http.StatusNotFound, "")
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = p
+		u.RawPath = strings.TrimPrefix(r.URL.RawPath, basePath)
+		r2.URL = &u
+		handler.ServeHTTP(&baseWriter{w}, r2)
+	})
+}
+
+// baseWriter puts -base-path in front of the absolute redirects made
+// without it, like those of http.ServeMux to add a trailing slash.
+type baseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *baseWriter) WriteHeader(code int) {
+	h := w.Header()
+	if loc := h.Get("Location"); code >= 300 && code < 400 && strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		h.Set("Location", basePath+loc)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// ReadFrom keeps sendfile working for transferWriter.
+func (w *baseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Unwrap gives http.ResponseController the underlying writer.
+func (w *baseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
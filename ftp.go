@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An FTP server (RFC 959) for clients that can't do anything else, with
+// passive mode only (RFC 2428 for EPSV), explicit TLS (RFC 4217) and the
+// MLSD, MLST, SIZE and MDTM extensions of RFC 3659. Users log in with
+// the -users file and see the directory -ftp-home as their root.
+// Changes go through the same code as the file management API.
+
+const (
+	ftpIdleTimeout  = 5 * time.Minute  // Time a client may stay silent
+	ftpDataTimeout  = 30 * time.Second // Time a data connection may stall
+	ftpMaxLine      = 4096
+	ftpMaxFailures  = 3
+	ftpHomeUserWord = "{user}"
+)
+
+var (
+	ftpTLS           *tls.Config // Set if -ftp-cert is given
+	ftpPassiveLow    int         // Passive port range, 0 for any port
+	ftpPassiveHigh   int
+	ftpPassiveIPAddr net.IP // Address announced by PASV, nil for the local address
+)
+
+// setupFTP checks the FTP options and loads the TLS certificate.
+func setupFTP() error {
+	if ftpPassivePorts != "" {
+		low, high, ok := strings.Cut(ftpPassivePorts, "-")
+		var err1, err2 error
+		ftpPassiveLow, err1 = strconv.Atoi(low)
+		ftpPassiveHigh, err2 = strconv.Atoi(high)
+		if !ok || err1 != nil || err2 != nil || ftpPassiveLow < 1 || ftpPassiveHigh > 65535 || ftpPassiveLow > ftpPassiveHigh {
+			return fmt.Errorf("Invalid -ftp-passive-ports `%s`, expected LOW-HIGH.", ftpPassivePorts)
+		}
+	}
+	if ftpPublicIP != "" {
+		if ftpPassiveIPAddr = net.ParseIP(ftpPublicIP).To4(); ftpPassiveIPAddr == nil {
+			return fmt.Errorf("Invalid -ftp-public-ip `%s`, expected an IPv4 address.", ftpPublicIP)
+		}
+	}
+	if !strings.HasPrefix(ftpHome, "/") {
+		return fmt.Errorf("Invalid -ftp-home `%s`, it must start with /.", ftpHome)
+	}
+	if (ftpCertFile == "") != (ftpKeyFile == "") {
+		return errors.New("-ftp-cert and -ftp-key must be given together.")
+	}
+	if ftpCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(ftpCertFile, ftpKeyFile)
+		if err != nil {
+			return fmt.Errorf("Can't load the FTP certificate: %v", err)
+		}
+		ftpTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	} else if ftpRequireTLS {
+		return errors.New("-ftp-require-tls needs -ftp-cert and -ftp-key.")
+	}
+	return nil
+}
+
+// serveFTP accepts FTP control connections on l.
+func serveFTP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Printf("ftp: %v", err)
+			return
+		}
+		c := &ftpConn{conn: conn, r: bufio.NewReaderSize(conn, ftpMaxLine), cwd: "/"}
+		c.ip = hostOf(conn.RemoteAddr())
+		go c.serve()
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// ftpConn is the control connection of an FTP client.
+type ftpConn struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	ip         string
+	name       string   // Name given with USER
+	user       *account // Logged in user
+	failures   int
+	home       string // Backend directory the client sees as /
+	cwd        string // Working directory as the client sees it
+	secure     bool   // The control connection uses TLS
+	protect    bool   // Data connections use TLS (PROT P)
+	passive    net.Listener
+	rest       int64  // Offset given with REST for the next transfer
+	renameFrom string // Backend path given with RNFR
+}
+
+func (c *ftpConn) serve() {
+	defer func() {
+		c.closePassive()
+		c.conn.Close()
+	}()
+	c.reply(220, NAME+" "+VERSION+" ready.")
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := c.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			c.reply(500, "Line too long.")
+			return
+		}
+		if err != nil {
+			return
+		}
+		// Clients send Telnet interrupt codes before ABOR.
+		text := strings.TrimLeft(strings.TrimRight(string(line), "\r\n"), "\xff\xf4\xf2")
+		cmd, arg, _ := strings.Cut(text, " ")
+		if !c.handle(strings.ToUpper(cmd), arg) {
+			return
+		}
+	}
+}
+
+func (c *ftpConn) reply(code int, message string) {
+	fmt.Fprintf(c.conn, "%d %s\r\n", code, message)
+}
+
+// replyLines sends a multi-line reply.
+func (c *ftpConn) replyLines(code int, first string, lines []string, last string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d-%s\r\n", code, first)
+	for _, l := range lines {
+		fmt.Fprintf(&b, " %s\r\n", l)
+	}
+	fmt.Fprintf(&b, "%d %s\r\n", code, last)
+	io.WriteString(c.conn, b.String())
+}
+
+// replyError replies with the FTP code matching err, the way
+// statusForError does for HTTP.
+func (c *ftpConn) replyError(err error) {
+	message := errorReason(err)
+	switch statusForError(err) {
+	case http.StatusNotFound, http.StatusForbidden, http.StatusConflict:
+		c.reply(550, message+".")
+	case http.StatusBadRequest:
+		c.reply(553, "File name not allowed.")
+	case http.StatusInsufficientStorage, http.StatusRequestEntityTooLarge:
+		c.reply(552, message+".")
+	default:
+		log.Printf("ftp %s: %v", c.ip, err)
+		c.reply(451, "Local error: "+message+".")
+	}
+}
+
+// handle runs a command. It returns false to end the session.
+func (c *ftpConn) handle(cmd, arg string) bool {
+	switch cmd {
+	case "QUIT":
+		c.reply(221, "Goodbye.")
+		return false
+	case "NOOP":
+		c.reply(200, "OK.")
+		return true
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+		return true
+	case "FEAT":
+		features := []string{"EPSV", "MDTM", "MLST type*;size*;modify*;", "PASV", "REST STREAM", "SIZE", "UTF8"}
+		if ftpTLS != nil {
+			features = append([]string{"AUTH TLS", "PBSZ", "PROT"}, features...)
+		}
+		c.replyLines(211, "Features:", features, "End.")
+		return true
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			c.reply(200, "Always in UTF-8 mode.")
+		} else {
+			c.reply(501, "Option not understood.")
+		}
+		return true
+	case "AUTH":
+		return c.auth(arg)
+	case "PBSZ":
+		if !c.secure {
+			c.reply(503, "Use AUTH TLS first.")
+		} else {
+			c.reply(200, "PBSZ=0")
+		}
+		return true
+	case "PROT":
+		switch {
+		case !c.secure:
+			c.reply(503, "Use AUTH TLS first.")
+		case strings.EqualFold(arg, "P"):
+			c.protect = true
+			c.reply(200, "Data connections are protected.")
+		case strings.EqualFold(arg, "C") && !ftpRequireTLS:
+			c.protect = false
+			c.reply(200, "Data connections are not protected.")
+		default:
+			c.reply(536, "Protection level not supported.")
+		}
+		return true
+	case "USER":
+		if ftpRequireTLS && !c.secure {
+			c.reply(530, "Use AUTH TLS first.")
+			return true
+		}
+		c.name, c.user = arg, nil
+		c.reply(331, "Password required.")
+		return true
+	case "PASS":
+		return c.login(arg)
+	}
+	if c.user == nil {
+		c.reply(530, "Log in with USER and PASS.")
+		return true
+	}
+
+	switch cmd {
+	case "PWD", "XPWD":
+		c.reply(257, quotePath(c.cwd)+" is the current directory.")
+	case "CWD", "XCWD":
+		c.changeDir(arg)
+	case "CDUP", "XCUP":
+		c.changeDir("..")
+	case "TYPE":
+		switch strings.ToUpper(arg) {
+		case "A", "A N", "I", "L 8":
+			// Files are always sent unchanged.
+			c.reply(200, "Type set.")
+		default:
+			c.reply(504, "Type not supported.")
+		}
+	case "MODE":
+		c.replyIf(strings.EqualFold(arg, "S"), 200, "Mode set.", 504, "Only stream mode is supported.")
+	case "STRU":
+		c.replyIf(strings.EqualFold(arg, "F"), 200, "Structure set.", 504, "Only file structure is supported.")
+	case "ALLO":
+		c.reply(202, "No storage allocation necessary.")
+	case "PASV":
+		c.enterPassive(false)
+	case "EPSV":
+		if strings.EqualFold(arg, "ALL") {
+			c.reply(200, "EPSV ALL accepted.")
+		} else {
+			c.enterPassive(true)
+		}
+	case "PORT", "EPRT":
+		c.reply(502, "Active mode is not supported, use PASV or EPSV.")
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || offset < 0 {
+			c.reply(501, "Invalid offset.")
+		} else {
+			c.rest = offset
+			c.reply(350, "Restarting at "+arg+".")
+		}
+	case "LIST", "NLST", "MLSD":
+		c.list(cmd, arg)
+	case "MLST":
+		c.mlst(arg)
+	case "SIZE", "MDTM":
+		info, err := c.stat(c.resolve(arg))
+		switch {
+		case err != nil:
+			c.replyError(err)
+		case info.IsDir():
+			c.reply(550, "Not a file.")
+		case cmd == "SIZE":
+			c.reply(213, strconv.FormatInt(info.Size(), 10))
+		default:
+			c.reply(213, info.ModTime().UTC().Format("20060102150405"))
+		}
+	case "RETR":
+		c.retrieve(arg)
+	case "STOR", "APPE":
+		c.store(arg, cmd == "APPE")
+	case "DELE", "RMD", "XRMD":
+		if !c.mayWrite() {
+			break
+		}
+		p, err := fsRemoveEntry(c.resolve(arg), cmd != "DELE", c.user)
+		if err != nil {
+			c.replyError(err)
+			break
+		}
+		c.audit("fs.delete", p)
+		c.reply(250, "Removed.")
+	case "MKD", "XMKD":
+		if !c.mayWrite() {
+			break
+		}
+		p := c.resolve(arg)
+		if err := fsMkdir(p); err != nil {
+			c.replyError(err)
+			break
+		}
+		c.audit("fs.mkdir", p)
+		c.reply(257, quotePath(c.display(p))+" created.")
+	case "RNFR":
+		p := c.resolve(arg)
+		if _, err := c.stat(p); err != nil {
+			c.replyError(err)
+			break
+		}
+		c.renameFrom = p
+		c.reply(350, "Ready for RNTO.")
+	case "RNTO":
+		from := c.renameFrom
+		c.renameFrom = ""
+		if from == "" {
+			c.reply(503, "Use RNFR first.")
+			break
+		}
+		if !c.mayWrite() {
+			break
+		}
+		src, dst, err := fsMoveTo(from, c.resolve(arg))
+		if err != nil {
+			c.replyError(err)
+			break
+		}
+		c.audit("fs.move", src, dst)
+		c.reply(250, "Renamed.")
+	case "ABOR":
+		// Transfers finish before the next command is read.
+		c.reply(226, "No transfer to abort.")
+	default:
+		c.reply(502, "Command not implemented.")
+	}
+	return true
+}
+
+func (c *ftpConn) replyIf(ok bool, code int, message string, elseCode int, elseMessage string) {
+	if ok {
+		c.reply(code, message)
+	} else {
+		c.reply(elseCode, elseMessage)
+	}
+}
+
+// auth switches the control connection to TLS.
+func (c *ftpConn) auth(arg string) bool {
+	switch {
+	case ftpTLS == nil:
+		c.reply(502, "TLS is not configured.")
+		return true
+	case c.secure:
+		c.reply(503, "Already using TLS.")
+		return true
+	case !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "TLS-C") && !strings.EqualFold(arg, "SSL"):
+		c.reply(504, "Only AUTH TLS is supported.")
+		return true
+	}
+	c.reply(234, "Starting TLS.")
+	tc := tls.Server(c.conn, ftpTLS)
+	tc.SetDeadline(time.Now().Add(ftpDataTimeout))
+	if err := tc.Handshake(); err != nil {
+		return false
+	}
+	tc.SetDeadline(time.Time{})
+	c.conn, c.r, c.secure = tc, bufio.NewReaderSize(tc, ftpMaxLine), true
+	c.name, c.user = "", nil
+	return true
+}
+
+// login checks the password given with PASS and sets up the home
+// directory of the user.
+func (c *ftpConn) login(password string) bool {
+	if c.name == "" || c.user != nil {
+		c.reply(503, "Use USER first.")
+		return true
+	}
+	user, err := login(c.name, password)
+	if err != nil {
+		audit(auditEvent{Action: "auth.failure", User: c.name, IP: c.ip, Detail: "ftp password: " + err.Error()})
+		time.Sleep(time.Second)
+		c.reply(530, "Login incorrect.")
+		c.failures++
+		return c.failures < ftpMaxFailures
+	}
+	home, err := ftpHomeDir(user.Name)
+	if err != nil {
+		log.Printf("ftp %s: home of %s: %v", c.ip, user.Name, err)
+		c.reply(530, "Home directory not available.")
+		return true
+	}
+	c.user, c.home, c.cwd = user, home, "/"
+	c.reply(230, "Logged in.")
+	return true
+}
+
+// ftpHomeDir returns the directory a user sees as the root, creating it
+// if needed.
+func ftpHomeDir(name string) (string, error) {
+	home := path.Clean(strings.ReplaceAll(ftpHome, ftpHomeUserWord, name))
+	if home == "/" {
+		return home, nil
+	}
+	home, err := checkPath(home)
+	if err != nil {
+		return "", err
+	}
+	for i := 1; i <= len(home); i++ {
+		if i < len(home) && home[i] != '/' {
+			continue
+		}
+		dir := home[:i]
+		if info, err := storage.Stat(dir); err == nil && info.IsDir() {
+			continue
+		}
+		if err := storage.Mkdir(dir); err != nil {
+			return "", err
+		}
+	}
+	return home, nil
+}
+
+// resolve returns the backend path of a path given by the client.
+func (c *ftpConn) resolve(arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = path.Join(c.cwd, arg)
+	}
+	return path.Join(c.home, path.Clean("/"+arg))
+}
+
+// display returns the path the client sees for a backend path.
+func (c *ftpConn) display(p string) string {
+	return path.Clean("/" + strings.TrimPrefix(p, c.home))
+}
+
+func quotePath(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+}
+
+func (c *ftpConn) mayWrite() bool {
+	if !c.user.can(permWrite) {
+		c.reply(550, "Permission denied.")
+		return false
+	}
+	return true
+}
+
+func (c *ftpConn) audit(action string, paths ...string) {
+	audit(auditEvent{Action: action, User: c.user.Name, IP: c.ip, Paths: paths, Detail: "ftp"})
+}
+
+func (c *ftpConn) stat(p string) (os.FileInfo, error) {
+	if isStatePath(p) {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return storage.Stat(p)
+}
+
+func (c *ftpConn) changeDir(arg string) {
+	p := c.resolve(arg)
+	info, err := c.stat(p)
+	switch {
+	case err != nil:
+		c.replyError(err)
+	case !info.IsDir():
+		c.reply(550, "Not a directory.")
+	default:
+		c.cwd = c.display(p)
+		c.reply(250, "Directory changed to "+c.cwd+".")
+	}
+}
+
+// enterPassive opens a port for the next data connection.
+func (c *ftpConn) enterPassive(extended bool) {
+	c.closePassive()
+	if ftpRequireTLS && !c.protect {
+		c.reply(521, "Use PROT P first.")
+		return
+	}
+	ip := ftpPassiveIPAddr
+	if ip == nil {
+		ip = net.ParseIP(hostOf(c.conn.LocalAddr())).To4()
+	}
+	if !extended && ip == nil {
+		c.reply(425, "Use EPSV with IPv6.")
+		return
+	}
+	l, err := listenPassive(hostOf(c.conn.LocalAddr()))
+	if err != nil {
+		log.Printf("ftp %s: %v", c.ip, err)
+		c.reply(425, "No passive port available.")
+		return
+	}
+	c.passive = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|).", port))
+	} else {
+		c.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+	}
+}
+
+// listenPassive listens on a free port of the -ftp-passive-ports range.
+func listenPassive(host string) (net.Listener, error) {
+	if ftpPassiveLow == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	n := ftpPassiveHigh - ftpPassiveLow + 1
+	start := rand.Intn(n)
+	var err error
+	for i := 0; i < n; i++ {
+		port := ftpPassiveLow + (start+i)%n
+		var l net.Listener
+		if l, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return l, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *ftpConn) closePassive() {
+	if c.passive != nil {
+		c.passive.Close()
+		c.passive = nil
+	}
+}
+
+// dataConn accepts the data connection for a transfer. Only the client
+// of the control connection may connect.
+func (c *ftpConn) dataConn() (net.Conn, error) {
+	l := c.passive
+	if l == nil {
+		return nil, errors.New("use PASV or EPSV first")
+	}
+	c.passive = nil
+	defer l.Close()
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(ftpDataTimeout))
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if hostOf(conn.RemoteAddr()) != c.ip {
+			log.Printf("ftp %s: refused data connection from %s", c.ip, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		conn = &stallConn{conn}
+		if c.protect {
+			tc := tls.Server(conn, ftpTLS)
+			if err := tc.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tc
+		}
+		return conn, nil
+	}
+}
+
+// stallConn is a data connection that fails once it stalls for longer
+// than ftpDataTimeout.
+type stallConn struct {
+	net.Conn
+}
+
+func (s *stallConn) Read(p []byte) (int, error) {
+	s.Conn.SetDeadline(time.Now().Add(ftpDataTimeout))
+	return s.Conn.Read(p)
+}
+
+func (s *stallConn) Write(p []byte) (int, error) {
+	s.Conn.SetDeadline(time.Now().Add(ftpDataTimeout))
+	return s.Conn.Write(p)
+}
+
+// transfer sends 150, runs fn with the data connection and replies with
+// the outcome. fn's error is about the data connection.
+func (c *ftpConn) transfer(message string, fn func(conn net.Conn) error) bool {
+	c.reply(150, message)
+	conn, err := c.dataConn()
+	if err != nil {
+		c.reply(425, "Can't open data connection.")
+		return false
+	}
+	err = fn(conn)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.reply(426, "Connection closed, transfer aborted.")
+		return false
+	}
+	return true
+}
+
+// list implements LIST and NLST, in the format of ls -l or names only,
+// and MLSD.
+func (c *ftpConn) list(cmd, arg string) {
+	// Options such as -la are ignored.
+	var target string
+	for _, f := range strings.Fields(arg) {
+		if !strings.HasPrefix(f, "-") {
+			target = f
+		}
+	}
+	p := c.resolve(target)
+	info, err := c.stat(p)
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	entries := []os.FileInfo{info}
+	if info.IsDir() {
+		if entries, err = storage.List(p); err != nil {
+			c.replyError(err)
+			return
+		}
+	} else if cmd == "MLSD" {
+		c.reply(501, "Not a directory.")
+		return
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		if isStatePath(path.Join(p, e.Name())) {
+			continue
+		}
+		switch cmd {
+		case "LIST":
+			b.WriteString(longName(e))
+		case "NLST":
+			b.WriteString(e.Name())
+		case "MLSD":
+			b.WriteString(mlsxFacts(e) + " " + e.Name())
+		}
+		b.WriteString("\r\n")
+	}
+	if c.transfer("Opening data connection for the listing.", func(conn net.Conn) error {
+		_, err := io.WriteString(conn, b.String())
+		return err
+	}) {
+		c.reply(226, "Listing sent.")
+	}
+}
+
+// mlsxFacts returns the facts of a file for MLSD and MLST.
+func mlsxFacts(info os.FileInfo) string {
+	kind := "file"
+	if info.IsDir() {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;", kind, info.Size(), info.ModTime().UTC().Format("20060102150405"))
+}
+
+func (c *ftpConn) mlst(arg string) {
+	p := c.resolve(arg)
+	info, err := c.stat(p)
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	c.replyLines(250, "Listing "+c.display(p), []string{mlsxFacts(info) + " " + c.display(p)}, "End.")
+}
+
+// retrieve sends a file, from the offset of a preceding REST.
+func (c *ftpConn) retrieve(arg string) {
+	offset := c.rest
+	c.rest = 0
+	p := c.resolve(arg)
+	info, err := c.stat(p)
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	if info.IsDir() {
+		c.reply(550, "Not a file.")
+		return
+	}
+	f, err := storage.Open(p)
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		c.replyError(err)
+		return
+	}
+	message := fmt.Sprintf("Opening data connection for %s (%d bytes).", path.Base(p), info.Size()-offset)
+	if c.transfer(message, func(conn net.Conn) error {
+		_, err := io.Copy(conn, f)
+		return err
+	}) {
+		c.reply(226, "Transfer complete.")
+	}
+}
+
+// store receives a file. Like every upload it is written to a temporary
+// file first, which then replaces the target. With APPE or REST the
+// upload continues the existing content.
+func (c *ftpConn) store(arg string, appendTo bool) {
+	offset := c.rest
+	c.rest = 0
+	if !c.mayWrite() {
+		return
+	}
+	p, err := checkPath(c.resolve(arg))
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	if _, err := checkDir(path.Dir(p)); err != nil {
+		c.replyError(err)
+		return
+	}
+	info, statErr := storage.Stat(p)
+	if statErr == nil && info.IsDir() {
+		c.reply(550, "Is a directory.")
+		return
+	}
+	// The size isn't known in advance, so the space held grows while
+	// receiving.
+	hold, err := holdUpload(p, 0, c.user.Name)
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	defer hold.release()
+	tmp, err := tempFile("ftp-")
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if statErr == nil && (appendTo || offset > 0) {
+		r, err := storage.Open(p)
+		if err == nil {
+			if appendTo {
+				_, err = io.Copy(tmp, r)
+			} else {
+				_, err = io.CopyN(tmp, r, offset)
+				if err == io.EOF {
+					err = nil
+				}
+			}
+			r.Close()
+		}
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+	}
+	tooLarge, overQuota := false, false
+	if !c.transfer("Ready to receive "+path.Base(p)+".", func(conn net.Conn) error {
+		start, _ := tmp.Seek(0, io.SeekCurrent)
+		var body io.Reader = conn
+		if maxUploadSize > 0 {
+			body = io.LimitReader(conn, maxUploadSize-start+1)
+		}
+		_, err := io.Copy(&quotaWriter{w: tmp, hold: hold, n: start}, body)
+		if err == errQuotaExceeded {
+			overQuota, err = true, nil
+		}
+		end, _ := tmp.Seek(0, io.SeekCurrent)
+		tooLarge = maxUploadSize > 0 && end > maxUploadSize
+		return err
+	}) {
+		return
+	}
+	if tooLarge {
+		c.reply(552, "File too large.")
+		return
+	}
+	if overQuota {
+		c.replyError(errQuotaExceeded)
+		return
+	}
+	size, _ := tmp.Seek(0, io.SeekCurrent)
+	err = tmp.Close()
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = replaceFile(tmp.Name(), p, c.user.Name, hold)
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	audit(auditEvent{Action: "upload", User: c.user.Name, IP: c.ip, Paths: []string{p}, Detail: "ftp, " + formatSize(size)})
+	c.reply(226, "Transfer complete.")
+}
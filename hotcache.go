@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hotFile is the content of a small file kept in memory.
+type hotFile struct {
+	name    string
+	modTime time.Time
+	data    []byte
+	elem    *list.Element // In hotCache.lru
+}
+
+// hotCache keeps the content of small, often requested files in memory,
+// up to -hot-cache bytes, dropping the least recently used ones first.
+// A file is still stat'ed for every request, so changes made outside the
+// server are noticed by their size and modification time.
+type hotCache struct {
+	mu      sync.Mutex
+	max     int64
+	maxFile int64
+	size    int64
+	files   map[string]*hotFile
+	lru     *list.List // Front is most recently used
+}
+
+var hotFiles *hotCache // nil without -hot-cache
+
+// setupHotCache checks the -hot-cache options.
+func setupHotCache() error {
+	if hotCacheSize == "" {
+		return nil
+	}
+	limit, err := parseSize(hotCacheSize)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("Invalid -hot-cache `%s`.", hotCacheSize)
+	}
+	maxFile, err := parseSize(hotFileSize)
+	if err != nil || maxFile <= 0 {
+		return fmt.Errorf("Invalid -hot-file-size `%s`.", hotFileSize)
+	}
+	hotFiles = &hotCache{max: limit, maxFile: min(maxFile, limit), files: make(map[string]*hotFile), lru: list.New()}
+	return nil
+}
+
+// serve answers a request for a small file from memory. It returns false
+// for everything else, which is left to serveFile.
+func (c *hotCache) serve(w http.ResponseWriter, r *http.Request, name string) bool {
+	if strings.HasSuffix(r.URL.Path, "/") || wantsJSON(r) && r.URL.Query().Has("checksum") {
+		return false
+	}
+	info, err := storage.Stat(name)
+	if err != nil || info.IsDir() || info.Size() > c.maxFile {
+		return false
+	}
+	data, ok := c.get(name, info.Size(), info.ModTime())
+	if !ok {
+		f, err := storage.Open(name)
+		if err != nil {
+			return false
+		}
+		data, err = io.ReadAll(io.LimitReader(f, info.Size()+1))
+		f.Close()
+		if err != nil || int64(len(data)) != info.Size() {
+			// Changed while reading.
+			return false
+		}
+		c.put(name, info.ModTime(), data)
+	}
+	sizeFunc := func() (int64, error) { return int64(len(data)), nil }
+	serveContent(w, r, info.Name(), info.ModTime(), sizeFunc, bytes.NewReader(data))
+	return true
+}
+
+// get returns the cached content of a file if it is still current.
+func (c *hotCache) get(name string, size int64, modTime time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[name]
+	if f == nil {
+		return nil, false
+	}
+	if int64(len(f.data)) != size || !f.modTime.Equal(modTime) {
+		c.drop(f)
+		return nil, false
+	}
+	c.lru.MoveToFront(f.elem)
+	return f.data, true
+}
+
+// put adds the content of a file, evicting others to make room.
+func (c *hotCache) put(name string, modTime time.Time, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.files[name]; old != nil {
+		c.drop(old)
+	}
+	f := &hotFile{name: name, modTime: modTime, data: data}
+	f.elem = c.lru.PushFront(f)
+	c.files[name] = f
+	c.size += int64(len(data))
+	for c.size > c.max {
+		c.drop(c.lru.Back().Value.(*hotFile))
+	}
+}
+
+// drop removes a file. c.mu must be held.
+func (c *hotCache) drop(f *hotFile) {
+	c.lru.Remove(f.elem)
+	delete(c.files, f.name)
+	c.size -= int64(len(f.data))
+}
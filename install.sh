@@ -1,3 +1,3 @@
-go build -o fileserver server.go
+go build -o fileserver *.go
 echo "Install fileserver to /usr/local/bin"
 sudo cp -i ./fileserver /usr/local/bin
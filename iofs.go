@@ -0,0 +1,142 @@
+package main
+
+import (
+	"embed"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// Documentation bundled into the binary, served with -d embed:. Replace
+// the docs directory before building to ship a different bundle.
+//
+//go:embed docs
+var docsFS embed.FS
+
+// fsBackend serves a read-only fs.FS, such as an embed.FS or a mounted
+// archive.
+type fsBackend struct {
+	fsys fs.FS
+}
+
+// fsName turns a backend name into the unrooted form fs.FS expects.
+func fsName(name string) string {
+	if name = strings.TrimPrefix(path.Clean("/"+name), "/"); name == "" {
+		return "."
+	}
+	return name
+}
+
+func (b *fsBackend) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(b.fsys, fsName(name))
+}
+
+func (b *fsBackend) List(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(b.fsys, fsName(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (b *fsBackend) Open(name string) (io.ReadSeekCloser, error) {
+	f, err := b.fsys.Open(fsName(name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if rs, ok := f.(io.ReadSeekCloser); ok {
+		return rs, nil
+	}
+	// Compressed archive members can only be read from the start.
+	reopen := func() (io.ReadCloser, error) { return b.fsys.Open(fsName(name)) }
+	return &streamSeeker{open: reopen, size: info.Size(), r: f}, nil
+}
+
+func readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+func (b *fsBackend) Put(name, src string) error   { return readOnly("put", name) }
+func (b *fsBackend) Mkdir(name string) error      { return readOnly("mkdir", name) }
+func (b *fsBackend) Rename(from, to string) error { return readOnly("rename", from) }
+func (b *fsBackend) Copy(from, to string) error   { return readOnly("copy", to) }
+func (b *fsBackend) RemoveAll(name string) error  { return readOnly("remove", name) }
+
+// streamSeeker makes a stream that can only be read from the start
+// seekable. Seeking forward skips data, seeking backward opens the
+// stream again, so ranges work but cost as much as reading up to them.
+type streamSeeker struct {
+	open   func() (io.ReadCloser, error)
+	size   int64
+	r      io.ReadCloser // Open stream, nil before the first read
+	pos    int64         // Offset of r
+	offset int64         // Offset the next read starts at
+}
+
+func (s *streamSeeker) Read(p []byte) (int, error) {
+	if s.r != nil && s.offset < s.pos {
+		s.r.Close()
+		s.r = nil
+	}
+	if s.r == nil {
+		r, err := s.open()
+		if err != nil {
+			return 0, err
+		}
+		s.r, s.pos = r, 0
+	}
+	if s.offset > s.pos {
+		n, err := io.CopyN(io.Discard, s.r, s.offset-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.offset = s.pos
+	return n, err
+}
+
+func (s *streamSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: "", Err: syscall.EINVAL}
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *streamSeeker) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	err := s.r.Close()
+	s.r = nil
+	return err
+}
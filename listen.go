@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// Unix sockets created by listen, removed again on exit.
+var unixSockets []string
+
+// socketMode is the mode and group given to unix sockets with
+// -listen-mode.
+type socketMode struct {
+	mode os.FileMode
+	gid  int // -1 to keep the group
+}
+
+// listeners returns the listeners of the HTTP server: the sockets passed
+// by systemd, if any, and one for every -listen address. Without either,
+// the server listens on -port of all IPv4 addresses.
+func listeners() ([]net.Listener, error) {
+	ls, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	addrs := listenAddrs
+	if len(ls) == 0 && len(addrs) == 0 {
+		addrs = stringList{"0.0.0.0:" + port}
+	}
+	var mode *socketMode
+	if listenMode != "" {
+		mode, err = parseListenMode(listenMode)
+		if err == nil && !slices.ContainsFunc(addrs, func(a string) bool { return strings.HasPrefix(a, "unix:") }) {
+			err = errors.New("-listen-mode needs a -listen unix: socket.")
+		}
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+	}
+	for _, addr := range addrs {
+		l, err := listen(addr, mode)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// parseListenMode parses -listen-mode, an octal mode with an optional
+// group name or id, like 0660:www-data.
+func parseListenMode(s string) (*socketMode, error) {
+	modeText, group, _ := strings.Cut(s, ":")
+	m, err := strconv.ParseUint(modeText, 8, 32)
+	if err != nil || m > 0777 {
+		return nil, fmt.Errorf("Invalid -listen-mode `%s`. Use an octal mode like 0660, with :group to change the group.", s)
+	}
+	mode := &socketMode{mode: os.FileMode(m), gid: -1}
+	if group != "" {
+		if mode.gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, fmt.Errorf("Unknown group `%s` in -listen-mode.", group)
+			}
+			mode.gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return mode, nil
+}
+
+// listen opens a listener for a -listen address: host:port, [ipv6]:port
+// or unix:/path. Unix sockets get mode if it isn't nil.
+func listen(addr string, mode *socketMode) (net.Listener, error) {
+	name, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// Remove the socket of an earlier run, but nothing else.
+	if info, err := os.Lstat(name); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(name)
+	}
+	l, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+	unixSockets = append(unixSockets, name)
+	if mode != nil {
+		// Connecting takes write permission, which the umask usually
+		// leaves to the owner until the mode is set.
+		err := os.Chmod(name, mode.mode)
+		if err == nil && mode.gid >= 0 {
+			err = os.Chown(name, -1, mode.gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket
+// activation, as described in sd_listen_fds(3).
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS `%s`.", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Child processes must not take the sockets as theirs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %s: %v", name, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// listenerName describes where a listener accepts connections.
+func listenerName(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return "unix:" + l.Addr().String()
+	}
+	return l.Addr().String()
+}
+
+// removeSockets removes the unix sockets before the server exits.
+func removeSockets() {
+	for _, name := range unixSockets {
+		os.Remove(name)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Largest JSON body accepted by the file management API.
+const maxAPIBody = 1 << 20
+
+var errInvalidPath = errors.New("invalid path")
+
+// Script that adds selection boxes, row actions and a toolbar to the
+// listing when file management is enabled.
+const MANAGESCRIPT = `
+document.addEventListener("DOMContentLoaded", function() {
+	var dir = decodeURIComponent(location.pathname).slice("{{base}}".length);
+	var table = document.querySelector("table");
+	if (!table || !table.tHead) {
+		return;
+	}
+	function api(op, body) {
+		return fetch("{{base}}/_api/fs/" + op, {
+			method: "POST",
+			credentials: "same-origin",
+			headers: {"Content-Type": "application/json", "Accept": "application/json"},
+			body: JSON.stringify(body)
+		}).then(function(r) {
+			return r.json().catch(function() { return {}; }).then(function(data) {
+				if (!r.ok) {
+					var errors = (data.results || []).filter(function(res) { return res.error; }).map(function(res) { return res.path + ": " + res.error; });
+					alert(errors.length ? errors.join("\n") : (data.message || data.error || r.statusText));
+				}
+				location.reload();
+			});
+		});
+	}
+	function selected() {
+		return Array.prototype.map.call(table.querySelectorAll("input.select:checked"), function(box) { return dir + box.value; });
+	}
+	function ask(question, value) {
+		var answer = prompt(question, value);
+		return answer === null || answer === "" ? null : answer;
+	}
+	function moveOrCopy(op, paths) {
+		var to = ask((op === "move" ? "Move" : "Copy") + " " + paths.length + " item(s) to directory:", dir);
+		if (to !== null) {
+			api(op, {paths: paths, to: to});
+		}
+	}
+	function remove(paths) {
+		if (confirm("Delete " + paths.length + " item(s)?")) {
+			api("delete", {paths: paths});
+		}
+	}
+	function link(text, onclick) {
+		var a = document.createElement("a");
+		a.textContent = text;
+		a.onclick = onclick;
+		return a;
+	}
+	var head = table.tHead.rows[0] || table.tHead;
+	var all = document.createElement("input");
+	all.type = "checkbox";
+	all.onchange = function() {
+		table.querySelectorAll("input.select").forEach(function(box) { box.checked = all.checked; });
+	};
+	head.insertBefore(document.createElement("th"), head.firstChild).appendChild(all);
+	head.appendChild(document.createElement("th"));
+	function enhance(row) {
+		var name = row.getAttribute("data-name");
+		var box = document.createElement("input");
+		box.type = "checkbox";
+		box.className = "select";
+		box.value = name;
+		row.insertCell(0).appendChild(box);
+		var actions = row.insertCell(-1);
+		actions.className = "actions";
+		actions.appendChild(link("rename", function() {
+			var to = ask("Rename " + name + " to:", name);
+			if (to !== null && to !== name) {
+				api("rename", {path: dir + name, name: to});
+			}
+		}));
+		actions.appendChild(link("move", function() { moveOrCopy("move", [dir + name]); }));
+		actions.appendChild(link("copy", function() { moveOrCopy("copy", [dir + name]); }));
+		actions.appendChild(link("delete", function() { remove([dir + name]); }));
+		var a = row.querySelector("a[href]");
+		if (a && !/\/$/.test(a.getAttribute("href"))) {
+			actions.appendChild(link("versions", function() { location.href = a.getAttribute("href") + "?versions"; }));
+		}
+	}
+	table.querySelectorAll("tr[data-name]").forEach(enhance);
+	// Used by the upload script for rows added later.
+	window.fileserverEnhanceRow = enhance;
+	var toolbar = document.createElement("div");
+	toolbar.className = "toolbar";
+	toolbar.appendChild(link("trash", function() { location.href = "{{base}}/_trash/"; }));
+	toolbar.appendChild(link("new folder", function() {
+		var name = ask("Name of the new folder:", "");
+		if (name !== null) {
+			api("mkdir", {path: dir + name});
+		}
+	}));
+	[["move selected", function(paths) { moveOrCopy("move", paths); }],
+	 ["copy selected", function(paths) { moveOrCopy("copy", paths); }],
+	 ["delete selected", remove]].forEach(function(action) {
+		toolbar.appendChild(link(action[0], function() {
+			var paths = selected();
+			if (paths.length === 0) {
+				alert("Nothing selected.");
+				return;
+			}
+			action[1](paths);
+		}));
+	});
+	table.parentNode.insertBefore(toolbar, table);
+});
+`
+
+// fsRequest is the body of a file management API request.
+type fsRequest struct {
+	Path  string   `json:"path"`  // Path of a single file
+	Paths []string `json:"paths"` // Paths of several files, for bulk operations
+	Name  string   `json:"name"`  // New name, for rename
+	To    string   `json:"to"`    // Target directory, for move and copy
+}
+
+// fsResult is the outcome of an operation on one path.
+type fsResult struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+// manageHandler implements the file management API:
+//
+//	POST /_api/fs/mkdir   {"path": "/dir/new"}
+//	POST /_api/fs/rename  {"path": "/dir/old", "name": "new"}
+//	POST /_api/fs/move    {"paths": ["/a", "/b"], "to": "/dir"}
+//	POST /_api/fs/copy    {"paths": ["/a", "/b"], "to": "/dir"}
+//	POST /_api/fs/delete  {"paths": ["/a", "/b"]}
+//
+// Deleted files go to the trash, see trashHandler.
+// The reply lists the result for every path. Its status is 200 if all of
+// them succeeded and otherwise that of the first failure.
+type manageHandler struct{}
+
+func (m *manageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !sameSiteJSON(w, r) {
+		return
+	}
+	user := requireUser(w, r, permWrite)
+	if user == nil {
+		return
+	}
+	var req fsRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(&req); err != nil {
+		errorPage(w, r, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	paths := req.Paths
+	if req.Path != "" {
+		paths = append([]string{req.Path}, paths...)
+	}
+	if len(paths) == 0 {
+		errorPage(w, r, http.StatusBadRequest, "no path given")
+		return
+	}
+
+	var op func(p string) error
+	action := strings.TrimPrefix(r.URL.Path, APIPREFIX+"fs/")
+	switch action {
+	case "mkdir":
+		op = fsMkdir
+	case "rename":
+		op = func(p string) error { return fsRename(p, req.Name) }
+	case "move":
+		op = func(p string) error { return fsMove(p, req.To) }
+	case "copy":
+		op = func(p string) error { return fsCopy(p, req.To, user.Name) }
+	case "delete":
+		op = func(p string) error { return moveToTrash(p, user) }
+	default:
+		errorPage(w, r, http.StatusNotFound, "unknown operation")
+		return
+	}
+
+	replyResults(w, paths, func(p string) error {
+		if err := op(p); err != nil {
+			return err
+		}
+		switch action {
+		case "rename":
+			auditRequest(r, user, "fs.rename", "", p, path.Join(path.Dir(p), req.Name))
+		case "move", "copy":
+			auditRequest(r, user, "fs."+action, "", p, path.Join(req.To, path.Base(p)))
+		default:
+			auditRequest(r, user, "fs."+action, "", p)
+		}
+		return nil
+	})
+}
+
+// replyResults runs op for every path and replies with the results.
+func replyResults(w http.ResponseWriter, paths []string, op func(p string) error) {
+	code := http.StatusOK
+	results := make([]fsResult, len(paths))
+	for i, p := range paths {
+		results[i].Path = p
+		if err := op(p); err != nil {
+			results[i].Error = errorReason(err)
+			if code == http.StatusOK {
+				code = statusForError(err)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Results []fsResult `json:"results"`
+	}{results})
+}
+
+// checkPath cleans a slash separated path from a request with the same
+// path.Clean discipline as ServeHTTP. The root itself and hidden files
+// are refused, so they cannot be changed.
+func checkPath(p string) (string, error) {
+	clean := path.Clean("/" + p)
+	if clean == "/" {
+		return "", errInvalidPath
+	}
+	for _, name := range strings.Split(clean[1:], "/") {
+		if strings.HasPrefix(name, ".") {
+			return "", errInvalidPath
+		}
+	}
+	return clean, nil
+}
+
+// checkDir is like checkPath, but allows the root as well. The
+// directory must exist.
+func checkDir(p string) (string, error) {
+	clean := path.Clean("/" + p)
+	if clean != "/" {
+		var err error
+		if clean, err = checkPath(clean); err != nil {
+			return "", err
+		}
+	}
+	info, err := storage.Stat(clean)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", &os.PathError{Op: "stat", Path: clean, Err: syscall.ENOTDIR}
+	}
+	return clean, nil
+}
+
+// validName reports whether name can be used as a file name.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+func fsMkdir(p string) error {
+	p, err := checkPath(p)
+	if err != nil {
+		return err
+	}
+	if _, err := checkDir(path.Dir(p)); err != nil {
+		return err
+	}
+	return storage.Mkdir(p)
+}
+
+func fsRename(p, name string) error {
+	if !validName(name) {
+		return errInvalidPath
+	}
+	p, err := checkPath(p)
+	if err != nil {
+		return err
+	}
+	return moveNoReplace(p, path.Join(path.Dir(p), name))
+}
+
+func fsMove(p, to string) error {
+	src, dst, err := transferPaths(p, to)
+	if err != nil {
+		return err
+	}
+	return moveNoReplace(src, dst)
+}
+
+func fsCopy(p, to, user string) error {
+	src, dst, err := transferPaths(p, to)
+	if err != nil {
+		return err
+	}
+	if _, err := storage.Stat(src); err != nil {
+		return err
+	}
+	if _, err := storage.Stat(dst); err == nil {
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+	}
+	u := quotaMeasure(src)
+	release, err := reserveCopy(dst, user, u)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := storage.Copy(src, dst); err != nil {
+		return err
+	}
+	quotaCopied(dst, user, u)
+	sizesChanged(dst)
+	return nil
+}
+
+// fsRemoveEntry moves a single file, or a directory if dir is set, to
+// the trash. Directories must be empty, as protocols that remove one
+// file at a time expect. It returns the cleaned path.
+func fsRemoveEntry(p string, dir bool, user *account) (string, error) {
+	p, err := checkPath(p)
+	if err != nil {
+		return "", err
+	}
+	info, err := storage.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case dir && !info.IsDir():
+		return "", &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTDIR}
+	case !dir && info.IsDir():
+		return "", &os.PathError{Op: "remove", Path: p, Err: syscall.EISDIR}
+	case dir:
+		entries, err := storage.List(p)
+		if err != nil {
+			return "", err
+		}
+		if len(entries) > 0 {
+			return "", &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTEMPTY}
+		}
+	}
+	return p, moveToTrash(p, user)
+}
+
+// fsMoveTo moves p to the path to, which must not exist yet, unlike
+// fsMove which moves into a directory. It returns the cleaned paths.
+func fsMoveTo(p, to string) (src, dst string, err error) {
+	if src, err = checkPath(p); err != nil {
+		return "", "", err
+	}
+	if dst, err = checkPath(to); err != nil {
+		return "", "", err
+	}
+	if _, err := checkDir(path.Dir(dst)); err != nil {
+		return "", "", err
+	}
+	if hasPathPrefix(dst, src) {
+		return "", "", errInvalidPath
+	}
+	return src, dst, moveNoReplace(src, dst)
+}
+
+// transferPaths returns the source and target of moving or copying p
+// into the directory to.
+func transferPaths(p, to string) (src, dst string, err error) {
+	if src, err = checkPath(p); err != nil {
+		return "", "", err
+	}
+	target, err := checkDir(to)
+	if err != nil {
+		return "", "", err
+	}
+	if hasPathPrefix(target, src) {
+		// A directory can't go into itself.
+		return "", "", errInvalidPath
+	}
+	return src, path.Join(target, path.Base(src)), nil
+}
+
+// moveNoReplace moves a file in the backend, failing if the target
+// exists. Versions move along.
+func moveNoReplace(src, dst string) error {
+	defer lockVersions(src, dst)()
+	if _, err := storage.Stat(src); err != nil {
+		return err
+	}
+	if _, err := storage.Stat(dst); err == nil {
+		return &os.PathError{Op: "rename", Path: dst, Err: os.ErrExist}
+	}
+	u := quotaMeasure(src)
+	release, err := reserveMove(src, dst, u)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := storage.Rename(src, dst); err != nil {
+		return err
+	}
+	quotaMoved(src, dst, u)
+	if !isStatePath(src) && !isStatePath(dst) {
+		moveVersions(versionsRoot(src), versionsRoot(dst))
+	}
+	sizesChanged(src, dst)
+	return nil
+}
+
+// renameNoReplace renames a file, failing if the target exists.
+func renameNoReplace(src, dst string) error {
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.PathError{Op: "rename", Path: dst, Err: os.ErrExist}
+	}
+	return os.Rename(src, dst)
+}
+
+// copyTree copies a file, symbolic link or whole directory tree,
+// keeping permissions and modification times.
+func copyTree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := copyTree(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
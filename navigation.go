@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// URL prefix of the JSON API.
+const APIPREFIX = "/_api/"
+
+// Script of the directory tree sidebar. Subdirectories are fetched from
+// the tree API when a node is first expanded; the nodes leading to the
+// current directory are expanded right away.
+const TREESCRIPT = `
+(function() {
+	var current = decodeURIComponent(location.pathname).slice("{{base}}".length);
+	function load(ul, dir) {
+		fetch("{{base}}/_api/tree?path=" + encodeURIComponent(dir), {headers: {"Accept": "application/json"}})
+			.then(function(r) { return r.json(); })
+			.then(function(dirs) {
+				dirs.forEach(function(d) {
+					var li = document.createElement("li");
+					var toggle = document.createElement("span");
+					var a = document.createElement("a");
+					var sub = null;
+					toggle.className = "toggle";
+					toggle.textContent = d.hasChildren ? "+" : "";
+					a.href = d.url;
+					a.textContent = d.name;
+					if (d.path === current) {
+						a.className = "current";
+					}
+					li.appendChild(toggle);
+					li.appendChild(a);
+					ul.appendChild(li);
+					if (!d.hasChildren) {
+						return;
+					}
+					toggle.onclick = function() {
+						if (sub === null) {
+							sub = document.createElement("ul");
+							li.appendChild(sub);
+							load(sub, d.path);
+						} else {
+							sub.hidden = !sub.hidden;
+						}
+						toggle.textContent = sub.hidden ? "+" : "-";
+					};
+					if (current.indexOf(d.path) === 0 && d.path !== current) {
+						toggle.onclick();
+					}
+				});
+			});
+	}
+	load(document.getElementById("tree"), "/");
+	document.getElementById("sidebarToggle").onclick = function() {
+		document.getElementById("sidebar").classList.toggle("collapsed");
+	};
+})();
+`
+
+// crumb is one link of the breadcrumb navigation.
+type crumb struct {
+	Name string // Directory name, "Home" for the root
+	Path string // Escaped absolute URL of the directory
+}
+
+// breadcrumbs returns links to the root and every directory on the way
+// to urlPath.
+func breadcrumbs(urlPath string) []crumb {
+	link := basePath + "/"
+	crumbs := []crumb{{Name: "Home", Path: link}}
+	for _, name := range strings.Split(strings.Trim(path.Clean(urlPath), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		link += urlEscape(name) + "/"
+		crumbs = append(crumbs, crumb{Name: name, Path: link})
+	}
+	return crumbs
+}
+
+// treeNode is a directory returned by the tree API.
+type treeNode struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"` // Unescaped path, to request the children
+	URL         string `json:"url"`  // Escaped link to the listing
+	HasChildren bool   `json:"hasChildren"`
+}
+
+// treeHandler lists the subdirectories of ?path= as JSON.
+type treeHandler struct {
+	root http.FileSystem
+}
+
+func (t *treeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Query().Get("path"))
+	if isStatePath(name) {
+		errorPage(w, r, http.StatusNotFound, "")
+		return
+	}
+	f, err := t.root.Open(name)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	defer f.Close()
+	nodes := []treeNode{}
+	for {
+		dirs, err := f.Readdir(100)
+		if err != nil || len(dirs) == 0 {
+			break
+		}
+		for _, d := range dirs {
+			if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+				continue
+			}
+			child := path.Join(name, d.Name())
+			nodes = append(nodes, treeNode{
+				Name:        d.Name(),
+				Path:        child + "/",
+				URL:         basePath + escapePath(child) + "/",
+				HasChildren: t.hasSubdirs(child),
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(nodes)
+}
+
+// hasSubdirs reports whether the directory contains a visible directory.
+func (t *treeHandler) hasSubdirs(name string) bool {
+	f, err := t.root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	for {
+		dirs, err := f.Readdir(100)
+		if err != nil || len(dirs) == 0 {
+			return false
+		}
+		for _, d := range dirs {
+			if d.IsDir() && !strings.HasPrefix(d.Name(), ".") {
+				return true
+			}
+		}
+	}
+}
+
+// escapePath escapes every segment of an absolute slash separated path.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = urlEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -upstream the server is a caching proxy: a request is answered
+// from a copy in the cache directory, which is fetched from the upstream
+// server on a miss and revalidated with If-None-Match and
+// If-Modified-Since once it is older than -cache-ttl. Each object is
+// stored as KEY.data next to KEY.json with its headers, where KEY is the
+// SHA-256 of the upstream URL.
+
+// cacheMeta describes a cached object.
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Size         int64     `json:"size"`
+	Validated    time.Time `json:"validated"` // When upstream last confirmed the copy
+}
+
+// cacheEntry is an object in the cache.
+type cacheEntry struct {
+	key     string
+	meta    cacheMeta
+	readers int           // Requests serving the data file
+	elem    *list.Element // In cache.lru
+}
+
+// fetchCall is a fetch from upstream that other requests for the same
+// object wait for. While the body arrives, they read it from the
+// temporary file it is stored in, so nobody waits for the whole object.
+type fetchCall struct {
+	started chan struct{} // Closed when the body starts arriving
+	done    chan struct{}
+	entry   *cacheEntry
+	err     error
+
+	mu      sync.Mutex
+	tmp     string // The file the body goes to; "" once it is stored or failed
+	meta    cacheMeta
+	written int64
+	filled  bool
+	fillErr error
+	grew    chan struct{} // Closed and replaced when written or filled change
+}
+
+// cacheObject is an object being served: a copy in the cache, or one
+// that is still arriving from upstream when fill is set.
+type cacheObject struct {
+	meta  cacheMeta
+	entry *cacheEntry
+	fill  *fetchCall
+	file  *os.File
+}
+
+// objectCache is the index of the cache directory with least recently
+// used eviction.
+type objectCache struct {
+	mu       sync.Mutex
+	dir      string
+	max      int64
+	size     int64
+	entries  map[string]*cacheEntry
+	lru      *list.List // Front is most recently used
+	fetching map[string]*fetchCall
+}
+
+var (
+	upstreamURL *url.URL     // Set by setupProxy
+	cache       *objectCache // nil without -upstream
+)
+
+// errUpstreamGone is the reply of upstream that the object doesn't exist.
+var errUpstreamGone = &os.PathError{Op: "fetch", Path: "upstream", Err: os.ErrNotExist}
+
+// setupProxy checks the -upstream options and loads the index of the
+// cache directory.
+func setupProxy() error {
+	if upstream == "" {
+		return nil
+	}
+	u, err := url.Parse(upstream)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("Invalid -upstream `%s`, it must be an http or https URL.", upstream)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	limit, err := parseSize(cacheSize)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("Invalid -cache-size `%s`.", cacheSize)
+	}
+	dir := cacheDir
+	if dir == "" {
+		dir = filepath.Join(stateDir(), "cache")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	c := &objectCache{
+		dir:      dir,
+		max:      limit,
+		entries:  make(map[string]*cacheEntry),
+		lru:      list.New(),
+		fetching: make(map[string]*fetchCall),
+	}
+	if err := c.load(); err != nil {
+		return err
+	}
+	upstreamURL, cache = u, c
+	return nil
+}
+
+// load reads the index from the cache directory. Data files are ordered
+// by their modification time, which is when they were last used by an
+// earlier run.
+func (c *objectCache) load() error {
+	names, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	type found struct {
+		entry *cacheEntry
+		used  time.Time
+	}
+	var all []found
+	for _, name := range names {
+		key := strings.TrimSuffix(filepath.Base(name), ".json")
+		data, err := os.ReadFile(name)
+		info, statErr := os.Stat(c.dataFile(key))
+		e := &cacheEntry{key: key}
+		if err != nil || statErr != nil || json.Unmarshal(data, &e.meta) != nil || info.Size() != e.meta.Size {
+			c.remove(key)
+			continue
+		}
+		all = append(all, found{e, info.ModTime()})
+	}
+	// Leftovers of fetches that were interrupted.
+	tmps, _ := filepath.Glob(filepath.Join(c.dir, "*.tmp-*"))
+	for _, name := range tmps {
+		os.Remove(name)
+	}
+	for len(all) > 0 {
+		newest := 0
+		for i := range all {
+			if all[i].used.After(all[newest].used) {
+				newest = i
+			}
+		}
+		e := all[newest].entry
+		e.elem = c.lru.PushBack(e)
+		c.entries[e.key] = e
+		c.size += e.meta.Size
+		all = append(all[:newest], all[newest+1:]...)
+	}
+	c.evict()
+	return nil
+}
+
+func (c *objectCache) dataFile(key string) string {
+	return filepath.Join(c.dir, key+".data")
+}
+
+func (c *objectCache) metaFile(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// remove deletes the files of an object.
+func (c *objectCache) remove(key string) {
+	os.Remove(c.metaFile(key))
+	os.Remove(c.dataFile(key))
+}
+
+// evict removes the least recently used objects that aren't being served
+// until the cache fits in its size. c.mu must be held.
+func (c *objectCache) evict() {
+	for el := c.lru.Back(); el != nil && c.size > c.max; {
+		e := el.Value.(*cacheEntry)
+		el = el.Prev()
+		if e.readers > 0 {
+			continue
+		}
+		c.drop(e)
+	}
+}
+
+// drop takes an object out of the cache. c.mu must be held.
+func (c *objectCache) drop(e *cacheEntry) {
+	if c.entries[e.key] != e {
+		return
+	}
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.size -= e.meta.Size
+	c.remove(e.key)
+}
+
+// get returns the object for the upstream URL, fetching or revalidating
+// it first if needed. Concurrent requests for the same object share one
+// fetch, which goes on in the background even if they give up, and read
+// the body as it arrives. The object must be released after use.
+func (c *objectCache) get(ctx context.Context, u string) (*cacheObject, error) {
+	sum := sha256.Sum256([]byte(u))
+	key := hex.EncodeToString(sum[:])
+	for {
+		c.mu.Lock()
+		e := c.entries[key]
+		if e != nil && time.Since(e.meta.Validated) < cacheTTL {
+			obj, err := c.open(e)
+			c.mu.Unlock()
+			return obj, err
+		}
+		call := c.fetching[key]
+		if call == nil {
+			call = &fetchCall{started: make(chan struct{}), done: make(chan struct{}), grew: make(chan struct{})}
+			c.fetching[key] = call
+			go c.run(call, key, u, e)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-call.started:
+			if obj := call.open(); obj != nil {
+				return obj, nil
+			}
+			// Already stored or failed.
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		c.mu.Lock()
+		if c.entries[key] == call.entry {
+			// Possibly a stale copy, while upstream fails.
+			obj, err := c.open(call.entry)
+			c.mu.Unlock()
+			return obj, err
+		}
+		c.mu.Unlock()
+		// Replaced or evicted in the meantime.
+	}
+}
+
+// run fetches an object for the requests waiting on call.
+func (c *objectCache) run(call *fetchCall, key, u string, old *cacheEntry) {
+	call.entry, call.err = c.fetch(call, key, u, old)
+	c.mu.Lock()
+	delete(c.fetching, key)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// open opens the data file of an entry and adds a reader. The file is
+// opened with c.mu held, so it can't be a newer copy that replaced the
+// entry.
+func (c *objectCache) open(e *cacheEntry) (*cacheObject, error) {
+	f, err := os.Open(c.dataFile(e.key))
+	if err != nil {
+		return nil, err
+	}
+	c.use(e)
+	return &cacheObject{meta: e.meta, entry: e, file: f}, nil
+}
+
+// use marks an entry as used and adds a reader. c.mu must be held.
+func (c *objectCache) use(e *cacheEntry) {
+	c.lru.MoveToFront(e.elem)
+	e.readers++
+}
+
+// release ends the use of an object returned by get.
+func (c *objectCache) release(obj *cacheObject) {
+	obj.file.Close()
+	if obj.entry == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := obj.entry
+	e.readers--
+	if e.readers == 0 {
+		// Remember the use for the next run.
+		now := time.Now()
+		os.Chtimes(c.dataFile(e.key), now, now)
+	}
+	c.evict()
+}
+
+// fetch gets an object from upstream, or revalidates the stale entry old
+// if there is one. If upstream can't be reached, the stale copy is used.
+// A new body is published through call as it is stored.
+func (c *objectCache) fetch(call *fetchCall, key, u string, old *cacheEntry) (*cacheEntry, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		if old.meta.ETag != "" {
+			req.Header.Set("If-None-Match", old.meta.ETag)
+		}
+		if !old.meta.LastModified.IsZero() {
+			req.Header.Set("If-Modified-Since", old.meta.LastModified.UTC().Format(http.TimeFormat))
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if old != nil {
+			log.Printf("cache: revalidating %s: %v, serving the cached copy", u, err)
+			return old, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && old != nil:
+		meta := old.meta
+		meta.Validated = time.Now()
+		if err := c.writeMeta(key, meta); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		old.meta.Validated = meta.Validated
+		c.mu.Unlock()
+		return old, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		if old != nil {
+			c.mu.Lock()
+			c.drop(old)
+			c.mu.Unlock()
+		}
+		return nil, errUpstreamGone
+	case resp.StatusCode != http.StatusOK:
+		if old != nil && resp.StatusCode >= 500 {
+			log.Printf("cache: revalidating %s: %s, serving the cached copy", u, resp.Status)
+			return old, nil
+		}
+		return nil, fmt.Errorf("upstream: %s", resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(c.dir, key+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	meta := cacheMeta{
+		URL:         u,
+		ETag:        resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+	}
+	meta.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	call.mu.Lock()
+	call.tmp, call.meta = tmp.Name(), meta
+	call.mu.Unlock()
+	close(call.started)
+
+	n, err := call.store(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		err = fmt.Errorf("upstream: %v", err)
+		call.finish(err)
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	meta.Size, meta.Validated = n, time.Now()
+	e := &cacheEntry{key: key, meta: meta}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old != nil {
+		c.drop(old)
+	}
+	err = c.writeMeta(key, meta)
+	if err == nil {
+		if err = os.Rename(tmp.Name(), c.dataFile(key)); err != nil {
+			c.remove(key)
+		}
+	}
+	// Readers that opened the temporary file keep reading it.
+	call.finish(err)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.size += n
+	return e, nil
+}
+
+// store copies the body to the temporary file and tells the readers how
+// far it got.
+func (call *fetchCall) store(tmp *os.File, body io.Reader) (int64, error) {
+	buf := make([]byte, 64<<10)
+	var n int64
+	for {
+		m, err := body.Read(buf)
+		if m > 0 {
+			if _, err := tmp.Write(buf[:m]); err != nil {
+				return n, err
+			}
+			n += int64(m)
+			call.mu.Lock()
+			call.written = n
+			close(call.grew)
+			call.grew = make(chan struct{})
+			call.mu.Unlock()
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// finish ends the body: err tells readers that it is incomplete.
+func (call *fetchCall) finish(err error) {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	call.tmp, call.filled, call.fillErr = "", true, err
+	close(call.grew)
+}
+
+// open opens the temporary file while the body is still arriving, or
+// returns nil.
+func (call *fetchCall) open() *cacheObject {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	if call.tmp == "" {
+		return nil
+	}
+	f, err := os.Open(call.tmp)
+	if err != nil {
+		return nil
+	}
+	return &cacheObject{meta: call.meta, fill: call, file: f}
+}
+
+// fillReader reads the body of a fetch as far as it has arrived and then
+// waits for more.
+type fillReader struct {
+	ctx  context.Context
+	obj  *cacheObject
+	read int64
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	call := r.obj.fill
+	for {
+		call.mu.Lock()
+		written, filled, err, grew := call.written, call.filled, call.fillErr, call.grew
+		call.mu.Unlock()
+		if r.read < written {
+			n, err := r.obj.file.Read(p[:min(int64(len(p)), written-r.read)])
+			r.read += int64(n)
+			return n, err
+		}
+		if filled {
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-grew:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// writeMeta stores the headers of an object.
+func (c *objectCache) writeMeta(key string, meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	name := c.metaFile(key)
+	if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// proxyHandler serves the objects of upstream from the cache.
+type proxyHandler struct{}
+
+func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	u := *upstreamURL
+	u.Path += path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath, u.RawQuery = "", r.URL.RawQuery
+
+	obj, err := cache.get(r.Context(), u.String())
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("cache: %s: %v", u.Redacted(), err)
+			errorPage(w, r, http.StatusBadGateway, err.Error())
+			return
+		}
+		serveError(w, r, err)
+		return
+	}
+	defer cache.release(obj)
+	if obj.meta.ETag != "" {
+		w.Header().Set("Etag", obj.meta.ETag)
+	}
+	if obj.meta.ContentType != "" {
+		w.Header().Set("Content-Type", obj.meta.ContentType)
+	}
+	if obj.fill == nil {
+		sizeFunc := func() (int64, error) { return obj.meta.Size, nil }
+		serveContent(w, r, path.Base(u.Path), obj.meta.LastModified, sizeFunc, obj.file)
+		return
+	}
+
+	// Still arriving: the whole body, as upstream sends it. Ranges and
+	// conditions are answered once it is stored.
+	if !obj.meta.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", obj.meta.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if obj.meta.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.meta.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	rc := http.NewResponseController(w)
+	body := &fillReader{ctx: r.Context(), obj: obj}
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				// Let the client see that the body is incomplete.
+				log.Printf("cache: %s: %v", u.Redacted(), err)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+	}
+}
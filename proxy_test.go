@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testProxy serves upstream through a caching proxy with an empty cache.
+func testProxy(t *testing.T, upstream http.Handler) *httptest.Server {
+	t.Helper()
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+	u, _ := url.Parse(up.URL)
+	oldURL, oldCache, oldTTL := upstreamURL, cache, cacheTTL
+	upstreamURL, cacheTTL = u, time.Minute
+	cache = &objectCache{
+		dir:      t.TempDir(),
+		max:      1 << 20,
+		entries:  make(map[string]*cacheEntry),
+		lru:      list.New(),
+		fetching: make(map[string]*fetchCall),
+	}
+	ts := httptest.NewServer(&proxyHandler{})
+	t.Cleanup(func() {
+		ts.Close()
+		upstreamURL, cache, cacheTTL = oldURL, oldCache, oldTTL
+	})
+	return ts
+}
+
+func TestProxyStreamsMiss(t *testing.T) {
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	ts := testProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "01234")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "56789")
+	}))
+
+	// Both clients get the first half before upstream sends the rest.
+	var bodies [2]io.ReadCloser
+	for i := range bodies {
+		resp, err := http.Get(ts.URL + "/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies[i] = resp.Body
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "01234" {
+			t.Fatalf("client %d: %q, %v", i, buf, err)
+		}
+	}
+	close(release)
+	for i, body := range bodies {
+		rest, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || string(rest) != "56789" {
+			t.Errorf("client %d: rest %q, %v", i, rest, err)
+		}
+	}
+
+	// Once stored, ranges come from the cache.
+	req, _ := http.NewRequest("GET", ts.URL+"/f", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(data) != "345" {
+		t.Errorf("range: %s %q", resp.Status, data)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d fetches from upstream", n)
+	}
+}
+
+func TestProxyIncompleteUpstream(t *testing.T) {
+	abort := make(chan struct{})
+	ts := testProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "01234")
+		w.(http.Flusher).Flush()
+		<-abort
+		panic(http.ErrAbortHandler)
+	}))
+	resp, err := http.Get(ts.URL + "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	close(abort)
+	if rest, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("incomplete body %q read without an error", append(buf, rest...))
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) != 0 {
+		t.Errorf("incomplete object cached")
+	}
+}
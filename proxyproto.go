@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signature that starts a PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Longest PROXY protocol version 1 header, including the CRLF.
+const proxyV1MaxLen = 107
+
+// proxyListener accepts connections from a load balancer like HAProxy
+// that starts each with a PROXY protocol header naming the client.
+// Connections from anywhere but -trusted-proxy are refused, as their
+// header can't be believed.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !trustedPeer(c.RemoteAddr()) {
+			log.Printf("proxy protocol: refused connection from %s", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		return &proxyConn{Conn: c}, nil
+	}
+}
+
+// proxyConn reads the PROXY header when the connection is first used, in
+// the goroutine serving it, so a slow balancer doesn't hold up Accept.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.r = bufio.NewReader(c.Conn)
+		if readHeaderTimeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(readHeaderTimeout))
+		}
+		addr, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("proxy protocol: %s: %v", c.remote, err)
+			log.Print(c.err)
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the address of the client named in the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// ReadFrom keeps sendfile working on the underlying connection.
+func (c *proxyConn) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, src)
+}
+
+// readProxyHeader reads a PROXY protocol header of version 1 or 2 and
+// returns the client address it names. The address is nil for headers
+// that don't name one, like the health checks of the balancer itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(start) < 5 {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY")):
+		return readProxyV1(r)
+	}
+	return nil, errors.New("missing PROXY header")
+}
+
+// readProxyV1 reads a text header like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("PROXY header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header: the signature, version and command,
+// address family, length and the addresses.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY command %d", header[12]&0xf)
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// UDP, unix sockets or unspecified: keep the balancer's address.
+	return nil, nil
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Where the owners of uploaded files are kept, to charge users for them.
+const quotaFile = "/" + STATEDIR + "/quota.json"
+
+// quota limits the bytes and files of a user or below a directory. A
+// limit of 0 means no limit.
+type quota struct {
+	User     string // User the quota applies to, or empty
+	Dir      string // Directory the quota applies to, or empty
+	MaxBytes int64
+	MaxFiles int64
+}
+
+// usage counts bytes and files.
+type usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+func (u *usage) add(o usage, sign int64) {
+	u.Bytes += sign * o.Bytes
+	u.Files += sign * o.Files
+}
+
+// fileOwner records who uploaded a file and how large it was.
+type fileOwner struct {
+	User string `json:"user"`
+	Size int64  `json:"size"`
+}
+
+// quotaUsage is the usage of one quota, as shown in the footer and
+// returned by the quota API.
+type quotaUsage struct {
+	Name     string `json:"name"` // "user alice" or "/dir"
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+	MaxBytes int64  `json:"maxBytes"`
+	MaxFiles int64  `json:"maxFiles"`
+	Text     string `json:"-"`
+}
+
+// quotaTracker keeps the usage of every quota up to date as files are
+// uploaded, moved, copied and deleted. Directories are counted by
+// walking them at startup and on a rescan, users by the owners of the
+// files they uploaded. Earlier versions count for the owner of their
+// content, files in the trash for nobody.
+type quotaTracker struct {
+	mu      sync.Mutex
+	quotas  []quota
+	dirs    map[string]*usage
+	users   map[string]*usage
+	owners  map[string]fileOwner // By URL path, including the trash and versions
+	pending map[string]*usage    // Reserved for changes in progress, by quota name
+
+	dirty  chan struct{} // Signals the saver that the owners changed
+	saving sync.Mutex    // Held while the owners are stored
+}
+
+// How long the saver waits after storing the owners, so that the
+// changes of many uploads in a row are stored together.
+const quotaSaveDelay = time.Second
+
+var quotas *quotaTracker // nil without -quota
+
+// parseQuota parses a -quota value: user:NAME=SIZE[:FILES] or
+// /dir=SIZE[:FILES].
+func parseQuota(s string) (quota, error) {
+	var q quota
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return q, errors.New("missing =")
+	}
+	target, limits := s[:i], s[i+1:]
+	if strings.HasPrefix(target, "user:") {
+		q.User = strings.TrimPrefix(target, "user:")
+	} else if strings.HasPrefix(target, "/") {
+		q.Dir = path.Clean(target)
+	}
+	if q.User == "" && q.Dir == "" {
+		return q, errors.New("target must be user:NAME or a /path")
+	}
+	size, files, _ := strings.Cut(limits, ":")
+	var err error
+	if q.MaxBytes, err = parseSize(size); err != nil {
+		return q, err
+	}
+	if files != "" {
+		if q.MaxFiles, err = strconv.ParseInt(files, 10, 64); err != nil || q.MaxFiles < 0 {
+			return q, errors.New("invalid file count")
+		}
+	}
+	return q, nil
+}
+
+// setupQuotas parses the -quota options and counts the current usage.
+func setupQuotas() error {
+	if len(quotaFlags) == 0 {
+		return nil
+	}
+	t := &quotaTracker{owners: map[string]fileOwner{}, pending: map[string]*usage{}, dirty: make(chan struct{}, 1)}
+	for _, s := range quotaFlags {
+		q, err := parseQuota(s)
+		if err != nil {
+			return fmt.Errorf("Invalid -quota `%s`: %v", s, err)
+		}
+		t.quotas = append(t.quotas, q)
+	}
+	if err := getJSON(quotaFile, &t.owners); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Can't read %s: %v", quotaFile, err)
+	}
+	t.rescan()
+	quotas = t
+	go t.saver()
+	return nil
+}
+
+// measure counts the files below p. STATEDIR is skipped unless p lies
+// in it.
+func measure(p string) (u usage) {
+	walkStorage(p, func(name string, info os.FileInfo) error {
+		if isStatePath(name) && !isStatePath(p) {
+			return fs.SkipDir
+		}
+		if !info.IsDir() {
+			u.Bytes += info.Size()
+			u.Files++
+		}
+		return nil
+	})
+	return u
+}
+
+// rescan counts the usage of every quota from scratch. Owners of files
+// that no longer exist are forgotten.
+func (t *quotaTracker) rescan() {
+	dirs := map[string]*usage{}
+	for _, q := range t.quotas {
+		if q.Dir != "" {
+			u := measure(q.Dir)
+			dirs[q.Dir] = &u
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dirs = dirs
+	for p, o := range t.owners {
+		info, err := storage.Stat(p)
+		switch {
+		case os.IsNotExist(err) || (err == nil && info.IsDir()):
+			delete(t.owners, p)
+		case err == nil:
+			t.owners[p] = fileOwner{o.User, info.Size()}
+		}
+	}
+	t.countUsers()
+	t.save()
+}
+
+// countUsers sums the files of each user. Called with t.mu held.
+func (t *quotaTracker) countUsers() {
+	t.users = map[string]*usage{}
+	for p, o := range t.owners {
+		if !isStatePath(p) || isVersionPath(p) {
+			t.user(o.User).add(usage{o.Size, 1}, 1)
+		}
+	}
+}
+
+// isVersionPath reports whether p is an earlier version of a file.
+func isVersionPath(p string) bool {
+	return hasPathPrefix(p, path.Join("/", STATEDIR, "versions"))
+}
+
+func (t *quotaTracker) user(name string) *usage {
+	u := t.users[name]
+	if u == nil {
+		u = &usage{}
+		t.users[name] = u
+	}
+	return u
+}
+
+// save has the owners stored by the saver, so that no write to the
+// backend, which may be remote, happens with t.mu held. Changes made
+// while they are stored are stored again. Called with t.mu held.
+func (t *quotaTracker) save() {
+	select {
+	case t.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// saver stores the owners whenever they changed.
+func (t *quotaTracker) saver() {
+	for range t.dirty {
+		t.store()
+		time.Sleep(quotaSaveDelay)
+	}
+}
+
+// store stores a copy of the owners.
+func (t *quotaTracker) store() {
+	t.saving.Lock()
+	defer t.saving.Unlock()
+	t.mu.Lock()
+	owners := maps.Clone(t.owners)
+	t.mu.Unlock()
+	if err := putJSON(quotaFile, owners); err != nil {
+		log.Printf("quota: %v", err)
+	}
+}
+
+// flushQuotas stores the owners if the saver hasn't yet, before the
+// server exits.
+func flushQuotas() {
+	if quotas == nil {
+		return
+	}
+	select {
+	case <-quotas.dirty:
+		quotas.store()
+	default:
+	}
+}
+
+func (q quota) name() string {
+	if q.Dir != "" {
+		return q.Dir
+	}
+	return "user " + q.User
+}
+
+// after returns the usage of q once add is added below p and userAdd
+// to user, counting what other changes reserved, and the part of the
+// change that applies to q. ok is false if the change doesn't affect q.
+// Data moved from below from stays within the quotas of directories
+// containing both. Called with t.mu held.
+func (t *quotaTracker) after(q quota, p, from string, add usage, user string, userAdd usage) (u, change usage, ok bool) {
+	switch {
+	case q.Dir != "" && hasPathPrefix(p, q.Dir) && (from == "" || !hasPathPrefix(from, q.Dir)):
+		u, change = *t.dirs[q.Dir], add
+	case q.User != "" && q.User == user:
+		if t.users[user] != nil {
+			u = *t.users[user]
+		}
+		change = userAdd
+	default:
+		return u, change, false
+	}
+	if r := t.pending[q.name()]; r != nil {
+		u.add(*r, 1)
+	}
+	u.add(change, 1)
+	return u, change, true
+}
+
+// reservation is the space held for a change in progress, by quota
+// name.
+type reservation map[string]usage
+
+// check fails if adding add below p, and userAdd to user, would exceed
+// a quota. Otherwise the space stays reserved, so that changes running
+// at the same time can't pass the check together, until release is
+// called once the change is recorded or has failed.
+func (t *quotaTracker) check(p, from string, add usage, user string, userAdd usage) (release func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reserved, err := t.reserve(p, from, add, user, userAdd, nil)
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.unreserve(reserved)
+		})
+	}, nil
+}
+
+// reserve is check for a change that replaces the reservation held,
+// which stays as it is if the change doesn't fit. Called with t.mu
+// held.
+func (t *quotaTracker) reserve(p, from string, add usage, user string, userAdd usage, held reservation) (reservation, error) {
+	t.unreserve(held)
+	reserved := reservation{}
+	for _, q := range t.quotas {
+		u, change, ok := t.after(q, p, from, add, user, userAdd)
+		if !ok {
+			continue
+		}
+		if (q.MaxBytes > 0 && u.Bytes > q.MaxBytes) || (q.MaxFiles > 0 && u.Files > q.MaxFiles) {
+			t.addPending(held)
+			return nil, errQuotaExceeded
+		}
+		// Space that is freed is only counted once it is.
+		reserved[q.name()] = usage{max(change.Bytes, 0), max(change.Files, 0)}
+	}
+	t.addPending(reserved)
+	return reserved, nil
+}
+
+// addPending and unreserve add and remove reserved space. Called with
+// t.mu held.
+func (t *quotaTracker) addPending(r reservation) {
+	for name, u := range r {
+		if t.pending[name] == nil {
+			t.pending[name] = &usage{}
+		}
+		t.pending[name].add(u, 1)
+	}
+}
+
+func (t *quotaTracker) unreserve(r reservation) {
+	for name, u := range r {
+		t.pending[name].add(u, -1)
+	}
+}
+
+// uploadQuota holds the space of an upload from its start until it is
+// stored or given up, so that uploads running at the same time can't
+// each pass the quotas and overrun them together. The space grows with
+// uploads whose size isn't known in advance. A nil *uploadQuota, as
+// returned without quotas, holds nothing.
+type uploadQuota struct {
+	t            *quotaTracker
+	p, user      string
+	add, userAdd usage // The change of storing an empty file at p
+
+	// Guarded by t.mu.
+	size int64 // Bytes held
+	held reservation
+	done bool
+}
+
+// holdUpload fails with errQuotaExceeded if user may not store size
+// bytes at p, and holds the space otherwise. release is called once
+// the upload is stored, after replaceFile, or given up.
+func holdUpload(p string, size int64, user string) (*uploadQuota, error) {
+	if quotas == nil {
+		return nil, nil
+	}
+	return quotas.hold(p, size, user)
+}
+
+func (t *quotaTracker) hold(p string, size int64, user string) (*uploadQuota, error) {
+	add, userAdd := t.replaceUsage(p, 0, user)
+	u := &uploadQuota{t: t, p: p, user: user, add: add, userAdd: userAdd, size: -1}
+	if err := u.grow(size); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// grow holds size bytes for the upload if it holds fewer, and fails
+// with errQuotaExceeded if they don't fit.
+func (u *uploadQuota) grow(size int64) error {
+	if u == nil {
+		return nil
+	}
+	u.t.mu.Lock()
+	defer u.t.mu.Unlock()
+	if u.done || size <= u.size {
+		return nil
+	}
+	add, userAdd := u.add, u.userAdd
+	add.Bytes += size
+	userAdd.Bytes += size
+	held, err := u.t.reserve(u.p, "", add, u.user, userAdd, u.held)
+	if err != nil {
+		return err
+	}
+	u.held, u.size = held, size
+	return nil
+}
+
+// release gives up the space held. It may be called more than once.
+func (u *uploadQuota) release() {
+	if u == nil {
+		return
+	}
+	u.t.mu.Lock()
+	defer u.t.mu.Unlock()
+	if !u.done {
+		u.t.unreserve(u.held)
+		u.held, u.done = nil, true
+	}
+}
+
+// quotaWriter writes to w while the space held by hold can grow with
+// it, counting from n bytes.
+type quotaWriter struct {
+	w    io.Writer
+	hold *uploadQuota
+	n    int64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if err := q.hold.grow(q.n + int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := q.w.Write(p)
+	q.n += int64(n)
+	return n, err
+}
+
+// addDirs adds u, times sign, to the directories containing p.
+// Called with t.mu held.
+func (t *quotaTracker) addDirs(p string, u usage, sign int64) {
+	for dir, du := range t.dirs {
+		if hasPathPrefix(p, dir) {
+			du.add(u, sign)
+		}
+	}
+}
+
+// replaceUsage returns how storing size bytes at p changes the usage
+// below p and that of user. A replaced file that is kept as a version
+// still counts for its owner.
+func (t *quotaTracker) replaceUsage(p string, size int64, user string) (add, userAdd usage) {
+	add, userAdd = usage{size, 1}, usage{size, 1}
+	if info, err := storage.Stat(p); err == nil && !info.IsDir() {
+		add = usage{size - info.Size(), 0}
+		t.mu.Lock()
+		if o, ok := t.owners[p]; ok && o.User == user && keepVersions == 0 {
+			userAdd = usage{size - o.Size, 0}
+		}
+		t.mu.Unlock()
+	}
+	return add, userAdd
+}
+
+// quotaReplaced records that user stored a file of size bytes at p,
+// where a file with oldSize bytes may have been before.
+func quotaReplaced(p string, size int64, user string, replaced bool, oldSize int64) {
+	if quotas == nil {
+		return
+	}
+	t := quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	add := usage{size, 1}
+	if replaced {
+		add = usage{size - oldSize, 0}
+	}
+	t.addDirs(p, add, 1)
+	if o, ok := t.owners[p]; ok {
+		t.user(o.User).add(usage{o.Size, 1}, -1)
+	}
+	t.owners[p] = fileOwner{user, size}
+	t.user(user).add(usage{size, 1}, 1)
+	t.save()
+}
+
+// quotaVersioned records that the content of p has been kept as the
+// version name, which still counts for its owner.
+func quotaVersioned(p, name string, size int64) {
+	if quotas == nil {
+		return
+	}
+	t := quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if o, ok := t.owners[p]; ok {
+		t.owners[name] = fileOwner{o.User, size}
+		t.user(o.User).add(usage{size, 1}, 1)
+		t.save()
+	}
+}
+
+// quotaMeasure counts the files below p if there are quotas.
+func quotaMeasure(p string) usage {
+	if quotas == nil {
+		return usage{}
+	}
+	return measure(p)
+}
+
+// reserveMove fails if moving files counting u from below from to p
+// would exceed the quota of a directory. release is called after
+// quotaMoved.
+func reserveMove(from, p string, u usage) (release func(), err error) {
+	if quotas == nil {
+		return func() {}, nil
+	}
+	return quotas.check(p, from, u, "", usage{})
+}
+
+// reserveCopy fails if copying files counting u to p would exceed a
+// quota. The copies belong to user. release is called after
+// quotaCopied.
+func reserveCopy(p, user string, u usage) (release func(), err error) {
+	if quotas == nil {
+		return func() {}, nil
+	}
+	return quotas.check(p, "", u, user, u)
+}
+
+// quotaMoved records that the files below from, counting u, are now
+// below to. Their owners stay the same; in the trash they count for
+// nobody.
+func quotaMoved(from, to string, u usage) {
+	if quotas == nil {
+		return
+	}
+	t := quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !isStatePath(from) {
+		t.addDirs(from, u, -1)
+	}
+	if !isStatePath(to) {
+		t.addDirs(to, u, 1)
+	}
+	moved := map[string]fileOwner{}
+	for p, o := range t.owners {
+		if hasPathPrefix(p, from) {
+			delete(t.owners, p)
+			moved[to+strings.TrimPrefix(p, from)] = o
+		}
+	}
+	for p, o := range moved {
+		t.owners[p] = o
+	}
+	t.countUsers()
+	t.save()
+}
+
+// quotaCopied records that user copied files counting u to below to.
+func quotaCopied(to, user string, u usage) {
+	if quotas == nil {
+		return
+	}
+	t := quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addDirs(to, u, 1)
+	walkStorage(to, func(name string, info os.FileInfo) error {
+		if !info.IsDir() {
+			t.owners[name] = fileOwner{user, info.Size()}
+		}
+		return nil
+	})
+	t.countUsers()
+	t.save()
+}
+
+// quotaDeleted records that the files below p, counting u, have been
+// deleted for good.
+func quotaDeleted(p string, u usage) {
+	if quotas == nil {
+		return
+	}
+	quotas.mu.Lock()
+	quotas.addDirs(p, u, -1)
+	quotas.mu.Unlock()
+	quotaRemoved(p)
+}
+
+// quotaRemoved forgets the owners of the files below p, which has been
+// deleted for good.
+func quotaRemoved(p string) {
+	if quotas == nil {
+		return
+	}
+	t := quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.owners {
+		if hasPathPrefix(name, p) {
+			delete(t.owners, name)
+		}
+	}
+	t.countUsers()
+	t.save()
+}
+
+// usageFor returns the quotas shown in the footer of the listing of
+// urlPath: those of the directories containing it and that of the user
+// who is logged in.
+func usageFor(r *http.Request, urlPath string) []quotaUsage {
+	if quotas == nil {
+		return nil
+	}
+	user := ""
+	if a, err := authenticate(r); err == nil && a != nil {
+		user = a.Name
+	}
+	var list []quotaUsage
+	for _, u := range quotas.usage() {
+		if (u.Name == "user "+user && user != "") || (strings.HasPrefix(u.Name, "/") && hasPathPrefix(urlPath, u.Name)) {
+			list = append(list, u)
+		}
+	}
+	return list
+}
+
+// usage returns the usage of every quota.
+func (t *quotaTracker) usage() []quotaUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]quotaUsage, 0, len(t.quotas))
+	for _, q := range t.quotas {
+		qu := quotaUsage{MaxBytes: q.MaxBytes, MaxFiles: q.MaxFiles}
+		var u *usage
+		if q.Dir != "" {
+			qu.Name, u = q.Dir, t.dirs[q.Dir]
+		} else {
+			qu.Name, u = "user "+q.User, t.users[q.User]
+		}
+		if u != nil {
+			qu.Bytes, qu.Files = u.Bytes, u.Files
+		}
+		qu.Text = formatSize(qu.Bytes)
+		if q.MaxBytes > 0 {
+			qu.Text += " of " + formatSize(q.MaxBytes)
+		}
+		qu.Text += fmt.Sprintf(", %d", qu.Files)
+		if q.MaxFiles > 0 {
+			qu.Text += fmt.Sprintf(" of %d", q.MaxFiles)
+		}
+		qu.Text += " files"
+		list = append(list, qu)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// quotaHandler implements
+//
+//	GET  /_api/quota         usage of every quota
+//	POST /_api/quota/rescan  count the usage from scratch
+//
+// Both need the admin permission.
+type quotaHandler struct{}
+
+func (q *quotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r, permAdmin)
+	if user == nil {
+		return
+	}
+	if quotas == nil {
+		errorPage(w, r, http.StatusNotFound, "no quotas configured")
+		return
+	}
+	switch {
+	case r.URL.Path == APIPREFIX+"quota" && (r.Method == "GET" || r.Method == "HEAD"):
+	case r.URL.Path == APIPREFIX+"quota/rescan" && r.Method == "POST":
+		if !sameSiteJSON(w, r) {
+			return
+		}
+		quotas.rescan()
+		auditRequest(r, user, "quota.rescan", "")
+	case r.URL.Path == APIPREFIX+"quota/rescan":
+		w.Header().Set("Allow", "POST")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	case r.URL.Path == APIPREFIX+"quota":
+		w.Header().Set("Allow", "GET, HEAD")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	default:
+		errorPage(w, r, http.StatusNotFound, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(quotas.usage())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestQuotaReservation(t *testing.T) {
+	testStorage(t)
+	tracker := &quotaTracker{
+		quotas:  []quota{{User: "alice", MaxBytes: 10}, {Dir: "/docs", MaxFiles: 2}},
+		dirs:    map[string]*usage{"/docs": {}},
+		users:   map[string]*usage{},
+		owners:  map[string]fileOwner{},
+		pending: map[string]*usage{},
+	}
+
+	// Of uploads running at the same time, only as many pass as fit.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var releases []func()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if release, err := tracker.check("/docs/f", "", usage{4, 1}, "alice", usage{4, 1}); err == nil {
+				mu.Lock()
+				releases = append(releases, release)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(releases) != 2 {
+		t.Fatalf("%d uploads of 4 bytes passed a quota of 10", len(releases))
+	}
+
+	// An upload of unknown size grows into the space that is left,
+	// replacing what it held before.
+	hold, err := tracker.hold("/other", 0, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{1, 2, 2} {
+		if err := hold.grow(size); err != nil {
+			t.Errorf("growing to %d bytes: %v", size, err)
+		}
+	}
+	if err := hold.grow(3); err != errQuotaExceeded {
+		t.Errorf("growing to 3 bytes with 8 reserved: %v", err)
+	}
+	hold.release()
+	hold.release()
+	if _, err := tracker.hold("/docs/g", 0, "bob"); err != errQuotaExceeded {
+		t.Errorf("a third file in /docs: %v", err)
+	}
+
+	// Released space is available again, also when released twice.
+	releases[0]()
+	releases[0]()
+	if _, err := tracker.check("/x", "", usage{}, "alice", usage{7, 1}); err != errQuotaExceeded {
+		t.Errorf("7 bytes with 4 reserved: %v", err)
+	}
+	if _, err := tracker.check("/x", "", usage{}, "alice", usage{6, 1}); err != nil {
+		t.Errorf("6 bytes with 4 reserved: %v", err)
+	}
+
+	// Freeing space doesn't make room before it is freed.
+	if _, err := tracker.check("/x", "", usage{}, "alice", usage{-4, 0}); err != nil {
+		t.Errorf("shrinking: %v", err)
+	}
+	if _, err := tracker.check("/x", "", usage{}, "alice", usage{1, 0}); err != errQuotaExceeded {
+		t.Errorf("1 byte with 10 reserved: %v", err)
+	}
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL prefix of the replication status page.
+const REPLICAPREFIX = "/_replica/"
+
+// Changes kept in the feed. A replica that falls further behind copies
+// everything again.
+const changeFeedSize = 100000
+
+// Changes sent in one reply of the feed.
+const changeFeedPage = 1000
+
+const REPLICATABLE = `
+<table>
+	<tr><td>Primary</td><td>{{.Replica.Primary}}</td></tr>
+	<tr><td>State</td><td>{{.Replica.State}}{{if .Replica.Error}}: {{.Replica.Error}}{{end}}</td></tr>
+	<tr><td>Lag</td><td>{{.Replica.Lag}}</td></tr>
+	<tr><td>Changes behind</td><td>{{.Replica.Behind}}</td></tr>
+	<tr><td>Last change applied</td><td>{{.Replica.Seq}} of {{.Replica.PrimarySeq}}</td></tr>
+	<tr><td>Last up to date</td><td>{{if not .Replica.UpToDate.IsZero}}{{.Replica.UpToDate.Format "2006-01-02 15:04:05"}}{{else}}never{{end}}</td></tr>
+	<tr><td>Files fetched</td><td>{{.Replica.Fetched}}</td></tr>
+	<tr><td>Entries removed</td><td>{{.Replica.Removed}}</td></tr>
+</table>`
+
+// change is an entry of the change feed: paths at or below which
+// something changed. Replicas compare these paths with the primary, so
+// the feed doesn't need to say what happened to them.
+type change struct {
+	Seq   int64     `json:"seq"`
+	Time  time.Time `json:"time"`
+	Paths []string  `json:"paths"`
+}
+
+// Actions of the audit log that change the served files. Every change
+// goes through audit, which passes these on to the feed.
+var changeActions = map[string]bool{
+	"upload":           true,
+	"fs.mkdir":         true,
+	"fs.rename":        true,
+	"fs.move":          true,
+	"fs.copy":          true,
+	"fs.delete":        true,
+	"trash.restore":    true,
+	"version.restore":  true,
+	"retention.remove": true,
+	"replica.update":   true,
+	"replica.remove":   true,
+}
+
+// changeFeed is the journal of changes that replicas follow. It is kept
+// in changes.jsonl in the state directory, one change per line, so
+// replicas can continue after a restart of the primary. changes.id names
+// the journal; when it is lost, replicas notice the new name and copy
+// everything again.
+type changeFeed struct {
+	mu      sync.Mutex
+	id      string
+	file    *os.File
+	lines   int      // Lines in file
+	changes []change // The last changeFeedSize changes
+}
+
+var changes *changeFeed // nil without -change-feed
+
+// setupChangeFeed opens the journal for -change-feed.
+func setupChangeFeed() error {
+	if !changeFeedFlag {
+		return nil
+	}
+	dir := stateDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	c := &changeFeed{}
+	name := filepath.Join(dir, "changes.jsonl")
+	id, err := os.ReadFile(filepath.Join(dir, "changes.id"))
+	if err == nil {
+		c.id = strings.TrimSpace(string(id))
+		f, err := os.Open(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				var ch change
+				if json.Unmarshal(scanner.Bytes(), &ch) == nil {
+					c.append(ch)
+				}
+				c.lines++
+			}
+			f.Close()
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+		}
+	} else if os.IsNotExist(err) {
+		c.id = newID()
+		if err := os.WriteFile(filepath.Join(dir, "changes.id"), []byte(c.id+"\n"), 0644); err != nil {
+			return err
+		}
+		os.Remove(name)
+	} else {
+		return err
+	}
+	c.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	changes = c
+	return nil
+}
+
+// append adds a change to the ones kept in memory.
+func (c *changeFeed) append(ch change) {
+	if len(c.changes) == 2*changeFeedSize {
+		c.changes = append(c.changes[:0], c.changes[changeFeedSize:]...)
+	}
+	c.changes = append(c.changes, ch)
+}
+
+// last returns the number of the last change, 0 if there is none.
+func (c *changeFeed) last() int64 {
+	if len(c.changes) == 0 {
+		return 0
+	}
+	return c.changes[len(c.changes)-1].Seq
+}
+
+// record adds a change to the feed.
+func (c *changeFeed) record(t time.Time, paths []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := change{Seq: c.last() + 1, Time: t, Paths: paths}
+	c.append(ch)
+	line, _ := json.Marshal(ch)
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		log.Printf("change feed: %v", err)
+		return
+	}
+	c.lines++
+	if c.lines > 2*changeFeedSize {
+		if err := c.compact(); err != nil {
+			// The journal goes on as it is; try again later.
+			log.Printf("change feed: compacting: %v", err)
+			c.lines = changeFeedSize
+		}
+	}
+}
+
+// compact rewrites the journal with the changes kept in memory. The new
+// journal is written through the file that is then used for appending,
+// so once it has replaced the old one nothing can fail; until then the
+// old journal stays in use.
+func (c *changeFeed) compact() error {
+	name := c.file.Name()
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	keep := c.changes[max(0, len(c.changes)-changeFeedSize):]
+	for _, ch := range keep {
+		line, _ := json.Marshal(ch)
+		w.Write(append(line, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	c.file.Close()
+	c.file = f
+	c.lines = len(keep)
+	return nil
+}
+
+// changeReply is the reply of the change feed.
+type changeReply struct {
+	Journal string   `json:"journal"`
+	Seq     int64    `json:"seq"`   // Number of the last change
+	Reset   bool     `json:"reset"` // The changes since the request are gone, copy everything
+	Changes []change `json:"changes"`
+}
+
+// since returns the changes after seq of the journal id.
+func (c *changeFeed) since(id string, seq int64) changeReply {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply := changeReply{Journal: c.id, Seq: c.last(), Changes: []change{}}
+	first := c.last() + 1
+	if len(c.changes) > 0 {
+		first = c.changes[0].Seq
+	}
+	if id != c.id || seq < first-1 || seq > reply.Seq {
+		reply.Reset = true
+		return reply
+	}
+	i := int(seq - first + 1)
+	reply.Changes = append(reply.Changes, c.changes[i:min(len(c.changes), i+changeFeedPage)]...)
+	return reply
+}
+
+// changesHandler serves the change feed as JSON:
+//
+//	GET /_api/changes?journal=ID&since=SEQ
+//
+// A replica starts with an empty journal, copies everything when the
+// reply says reset, and then asks for the changes since the last one it
+// has applied.
+type changesHandler struct{}
+
+func (h *changesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if changes == nil {
+		errorPage(w, r, http.StatusNotFound, "the change feed is off, start the server with -change-feed")
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	q := r.URL.Query()
+	seq, _ := strconv.ParseInt(q.Get("since"), 10, 64)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(changes.since(q.Get("journal"), seq))
+}
+
+// replicaState is where a replica is in the feed of its primary, kept in
+// replica.json in the state directory.
+type replicaState struct {
+	Primary string `json:"primary"`
+	Journal string `json:"journal"`
+	Seq     int64  `json:"seq"`
+}
+
+// replicaStatus is shown on the replication status page.
+type replicaStatus struct {
+	Primary    string    `json:"primary"`
+	State      string    `json:"state"`           // "up to date", "copying", "catching up" or "failing"
+	Error      string    `json:"error,omitempty"` // Why the last attempt failed
+	Seq        int64     `json:"seq"`             // Last change applied
+	PrimarySeq int64     `json:"primarySeq"`      // Last change of the primary
+	Behind     int64     `json:"behind"`          // Changes not applied yet
+	UpToDate   time.Time `json:"upToDate"`        // When the replica last had every change
+	Lag        string    `json:"lag"`             // Time since then, while behind
+	LagSeconds float64   `json:"lagSeconds"`
+	Fetched    int64     `json:"fetched"`
+	Removed    int64     `json:"removed"`
+}
+
+var (
+	primaryURL     *url.URL // Set by setupReplica
+	replicaStarted time.Time
+
+	replicaMu sync.Mutex
+	replica   replicaStatus
+	replicaAt replicaState
+)
+
+// setupReplica checks -replicate and loads the position in the feed.
+func setupReplica() error {
+	if replicateFrom == "" {
+		return nil
+	}
+	u, err := remoteURL(replicateFrom)
+	if err != nil {
+		return err
+	}
+	primaryURL, replicaStarted = u, time.Now()
+	replica.Primary = u.Redacted()
+	replica.State = "starting"
+	data, err := os.ReadFile(filepath.Join(stateDir(), "replica.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &replicaAt); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Join(stateDir(), "replica.json"), err)
+		}
+	}
+	if replicaAt.Primary != u.Redacted() {
+		// A different primary, start from scratch.
+		replicaAt = replicaState{Primary: u.Redacted()}
+	}
+	replica.Seq = replicaAt.Seq
+	return nil
+}
+
+// saveReplicaState writes the position in the feed.
+func saveReplicaState() error {
+	data, err := json.Marshal(replicaAt)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(stateDir(), "replica.json")
+	if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// runReplica follows the primary, every -replicate-interval, and more
+// slowly while it can't be reached.
+func runReplica() {
+	delay := replicateInterval
+	for {
+		err := replicateChanges()
+		replicaMu.Lock()
+		if err != nil {
+			replica.State, replica.Error = "failing", err.Error()
+		} else {
+			replica.Error = ""
+		}
+		replicaMu.Unlock()
+		if err != nil {
+			log.Printf("replica: %v", err)
+			delay = min(2*delay, max(time.Minute, replicateInterval))
+		} else {
+			delay = replicateInterval
+		}
+		time.Sleep(delay)
+	}
+}
+
+// replicateChanges applies the changes of the primary since the last
+// one applied. The position is saved after every page of changes, so an
+// interrupted run repeats at most one page.
+func replicateChanges() error {
+	for {
+		reply, err := fetchChanges()
+		if err != nil {
+			return err
+		}
+		replicaMu.Lock()
+		replica.PrimarySeq = reply.Seq
+		replica.Behind = reply.Seq - replicaAt.Seq
+		if reply.Reset {
+			replica.State = "copying"
+		} else if replica.Behind > 0 {
+			replica.State = "catching up"
+		}
+		replicaMu.Unlock()
+
+		if reply.Reset {
+			log.Printf("replica: copying everything from %s", primaryURL.Redacted())
+			if err := replicaSync("/"); err != nil {
+				return err
+			}
+			replicaAt.Journal, replicaAt.Seq = reply.Journal, reply.Seq
+		} else {
+			seen := make(map[string]bool)
+			for _, ch := range reply.Changes {
+				for _, p := range ch.Paths {
+					if seen[p] {
+						continue
+					}
+					seen[p] = true
+					if err := replicaSync(p); err != nil {
+						return err
+					}
+				}
+				replicaAt.Seq = ch.Seq
+			}
+		}
+		if err := saveReplicaState(); err != nil {
+			return err
+		}
+		replicaMu.Lock()
+		replica.Seq = replicaAt.Seq
+		replica.Behind = reply.Seq - replicaAt.Seq
+		done := replica.Behind <= 0
+		if done {
+			replica.State, replica.UpToDate = "up to date", time.Now()
+		}
+		replicaMu.Unlock()
+		if done {
+			return nil
+		}
+	}
+}
+
+// fetchChanges asks the primary for the changes since replicaAt.
+func fetchChanges() (*changeReply, error) {
+	u := childURL(primaryURL, "/_api/changes", false)
+	u.RawQuery = url.Values{"journal": {replicaAt.Journal}, "since": {strconv.FormatInt(replicaAt.Seq, 10)}}.Encode()
+	resp, err := httpClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteError(resp)
+	}
+	var reply changeReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("change feed: %v", err)
+	}
+	return &reply, nil
+}
+
+// remoteEntry describes the path p on the primary, with the checksum of a
+// file if asked for. It returns nil if p doesn't exist there.
+func remoteEntry(p string, checksum bool) (*listEntry, error) {
+	u := childURL(primaryURL, p, false)
+	method := "HEAD"
+	if checksum {
+		u.RawQuery = "checksum"
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, remoteError(resp)
+	case strings.HasSuffix(resp.Request.URL.Path, "/"):
+		// Directories are redirected to their listing.
+		return &listEntry{Name: path.Base(p), IsDir: true}, nil
+	case !checksum:
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &listEntry{Name: path.Base(p), Size: resp.ContentLength, ModTime: modTime}, nil
+	}
+	var e listEntry
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, fmt.Errorf("%s: %v", u.Redacted(), err)
+	}
+	return &e, nil
+}
+
+// replicaSync makes the path p and everything below it the same as on
+// the primary.
+func replicaSync(p string) error {
+	p = path.Clean("/" + p)
+	if isStatePath(p) {
+		return nil
+	}
+	e, err := remoteEntry(p, false)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		if _, err := storage.Stat(p); err == nil {
+			return replicaRemove(p)
+		}
+		return nil
+	}
+	if !e.IsDir {
+		return replicaFile(p, *e)
+	}
+
+	// Digests are only asked for files that seem to differ, so that
+	// copying a whole tree doesn't make the primary read all of it.
+	remote, err := walkRemote(childURL(primaryURL, p, true), false)
+	if err != nil {
+		return err
+	}
+	if err := replicaMkdir(p); err != nil {
+		return err
+	}
+	// Remove what the primary doesn't have, then add what is missing.
+	var extra []string
+	err = walkStorage(p, func(name string, info os.FileInfo) error {
+		if name == p {
+			return nil
+		}
+		rel := strings.TrimPrefix(name, strings.TrimSuffix(p, "/")+"/")
+		if strings.HasPrefix(path.Base(name), ".") {
+			return filepath.SkipDir
+		}
+		if r, ok := remote[rel]; !ok || r.IsDir != info.IsDir() {
+			extra = append(extra, name)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range extra {
+		if err := replicaRemove(name); err != nil {
+			return err
+		}
+	}
+	for rel, r := range remote {
+		name := path.Join(p, rel)
+		if r.IsDir {
+			err = replicaMkdir(name)
+		} else {
+			err = replicaFile(name, r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicaFile fetches the file p from the primary unless the local copy
+// has the size and modification time of e, or the same checksum.
+func replicaFile(p string, e listEntry) error {
+	info, err := storage.Stat(p)
+	same := err == nil && !info.IsDir() && info.Size() == e.Size
+	if same && info.ModTime().Unix() == e.ModTime.Unix() {
+		return nil
+	}
+	remote, err2 := remoteEntry(p, true)
+	if err2 != nil {
+		return err2
+	}
+	if remote == nil || remote.IsDir {
+		// It changed again in the meantime, the change feed will say so.
+		return nil
+	}
+	e = *remote
+	if same && info.Size() == e.Size {
+		if sum, err := storageChecksum(p); err == nil && sum == e.SHA256 {
+			return nil
+		}
+	}
+	if err == nil && info.IsDir() {
+		if err := replicaRemove(p); err != nil {
+			return err
+		}
+	}
+	if err := replicaMkdir(path.Dir(p)); err != nil {
+		return err
+	}
+	// Partial downloads are named after the path, so they continue after
+	// an interruption.
+	dir := filepath.Join(stateDir(), "replica")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key := sha256.Sum256([]byte(p))
+	tmp := filepath.Join(dir, hex.EncodeToString(key[:16]))
+	if err := download(childURL(primaryURL, p, false), tmp, 4, e.SHA256); err != nil {
+		return err
+	}
+	err = storage.Put(p, tmp)
+	os.Remove(tmp)
+	if err != nil {
+		return err
+	}
+	replaced := info != nil && !info.IsDir()
+	var oldSize int64
+	if replaced {
+		oldSize = info.Size()
+	}
+	quotaReplaced(p, e.Size, "", replaced, oldSize)
+	sizesChanged(p)
+	replicaMu.Lock()
+	replica.Fetched++
+	replicaMu.Unlock()
+	audit(auditEvent{Action: "replica.update", Paths: []string{p}, Detail: formatSize(e.Size)})
+	return nil
+}
+
+// replicaMkdir creates the directory p and its parents.
+func replicaMkdir(p string) error {
+	info, err := storage.Stat(p)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+	if err == nil {
+		if err := replicaRemove(p); err != nil {
+			return err
+		}
+	}
+	if err := replicaMkdir(path.Dir(p)); err != nil {
+		return err
+	}
+	if err := storage.Mkdir(p); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// replicaRemove removes p, which the primary no longer has.
+func replicaRemove(p string) error {
+	u := quotaMeasure(p)
+	if err := storage.RemoveAll(p); err != nil {
+		return err
+	}
+	quotaDeleted(p, u)
+	dropVersions(versionsRoot(p))
+	sizesChanged(p)
+	replicaMu.Lock()
+	replica.Removed++
+	replicaMu.Unlock()
+	audit(auditEvent{Action: "replica.remove", Paths: []string{p}})
+	return nil
+}
+
+// storageChecksum returns the hex SHA-256 digest of a file in the backend.
+func storageChecksum(p string) (string, error) {
+	f, err := storage.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// replicaHandler serves the replication status as a page, or as JSON.
+type replicaHandler struct{}
+
+func (h *replicaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if primaryURL == nil {
+		errorPage(w, r, http.StatusNotFound, "this server is not a replica, start it with -replicate")
+		return
+	}
+	replicaMu.Lock()
+	status := replica
+	replicaMu.Unlock()
+	if status.Behind > 0 || status.State != "up to date" {
+		since := status.UpToDate
+		if since.IsZero() {
+			since = replicaStarted
+		}
+		lag := time.Since(since).Round(time.Second)
+		status.Lag, status.LagSeconds = lag.String(), lag.Seconds()
+	} else {
+		status.Lag = "0s"
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	page := newPage("Replication", r.URL.Path)
+	page.Replica = &status
+	renderPage(w, page, "replica")
+}
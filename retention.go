@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionRule expires the entries of a directory: files and
+// subdirectories beyond the newest Keep, and those older than MaxAge.
+// Zero disables either limit.
+type retentionRule struct {
+	Dir    string        `json:"dir"`
+	Keep   int           `json:"keep,omitempty"`
+	MaxAge time.Duration `json:"maxAge,omitempty"`
+}
+
+func (r retentionRule) String() string {
+	var limits []string
+	if r.Keep > 0 {
+		limits = append(limits, "keep:"+strconv.Itoa(r.Keep))
+	}
+	if r.MaxAge > 0 {
+		limits = append(limits, "age:"+formatAge(r.MaxAge))
+	}
+	return r.Dir + "=" + strings.Join(limits, ",")
+}
+
+// expiredEntry is an entry a retention rule removes.
+type expiredEntry struct {
+	Rule     string    `json:"rule"`
+	Path     string    `json:"path"`
+	IsDir    bool      `json:"isDir"`
+	Modified time.Time `json:"modified"`
+	Reason   string    `json:"reason"`
+}
+
+var retentionRules []retentionRule
+
+// parseRetention parses a -retention value: /dir=keep:N,age:DURATION,
+// where the duration may be given in days, e.g. 14d.
+func parseRetention(s string) (retentionRule, error) {
+	var r retentionRule
+	dir, limits, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(dir, "/") {
+		return r, errors.New("expected /dir=keep:N,age:DURATION")
+	}
+	r.Dir = path.Clean(dir)
+	for _, limit := range strings.Split(limits, ",") {
+		kind, value, _ := strings.Cut(strings.TrimSpace(limit), ":")
+		var err error
+		switch kind {
+		case "keep":
+			r.Keep, err = strconv.Atoi(value)
+			if err == nil && r.Keep < 1 {
+				err = errors.New("keep must be at least 1")
+			}
+		case "age":
+			r.MaxAge, err = parseAge(value)
+		default:
+			err = fmt.Errorf("unknown limit %q", kind)
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// parseAge parses a duration, which may also be a number of days.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n <= 0 {
+			return 0, errors.New("invalid age")
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid age")
+	}
+	return d, nil
+}
+
+// formatAge formats a duration the way parseAge reads it, in days if it
+// is a whole number of them.
+func formatAge(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	}
+	return d.String()
+}
+
+// setupRetention parses the -retention options.
+func setupRetention() error {
+	for _, s := range retentionFlags {
+		r, err := parseRetention(s)
+		if err != nil {
+			return fmt.Errorf("Invalid -retention `%s`: %v", s, err)
+		}
+		retentionRules = append(retentionRules, r)
+	}
+	return nil
+}
+
+// expired returns the entries of the rule's directory that are due for
+// removal. Hidden entries are never touched.
+func (r retentionRule) expired(now time.Time) ([]expiredEntry, error) {
+	entries, err := storage.List(r.Dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().After(entries[j].ModTime()) })
+	var list []expiredEntry
+	kept := 0
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		reason := ""
+		switch {
+		case r.MaxAge > 0 && now.Sub(e.ModTime()) > r.MaxAge:
+			reason = "older than " + formatAge(r.MaxAge)
+		case r.Keep > 0 && kept >= r.Keep:
+			reason = "beyond the newest " + strconv.Itoa(r.Keep)
+		default:
+			kept++
+			continue
+		}
+		list = append(list, expiredEntry{
+			Rule:     r.String(),
+			Path:     path.Join(r.Dir, e.Name()),
+			IsDir:    e.IsDir(),
+			Modified: e.ModTime(),
+			Reason:   reason,
+		})
+	}
+	return list, nil
+}
+
+// expiredEntries returns what all rules would remove now.
+func expiredEntries() ([]expiredEntry, error) {
+	now := time.Now()
+	list := []expiredEntry{}
+	for _, r := range retentionRules {
+		entries, err := r.expired(now)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, entries...)
+	}
+	return list, nil
+}
+
+// applyRetention removes the expired entries of every rule. They don't
+// go to the trash; every removal is written to the audit log.
+func applyRetention() {
+	now := time.Now()
+	for _, r := range retentionRules {
+		entries, err := r.expired(now)
+		if err != nil {
+			log.Printf("retention: %s: %v", r.Dir, err)
+			continue
+		}
+		for _, e := range entries {
+			u := quotaMeasure(e.Path)
+			if err := storage.RemoveAll(e.Path); err != nil {
+				log.Printf("retention: removing %s: %v", e.Path, err)
+				continue
+			}
+			quotaDeleted(e.Path, u)
+			dropVersions(versionsRoot(e.Path))
+			sizesChanged(e.Path)
+			audit(auditEvent{Action: "retention.remove", Paths: []string{e.Path}, Detail: e.Rule + ": " + e.Reason})
+		}
+	}
+}
+
+// runRetention applies the rules once at startup and then every
+// -retention-interval.
+func runRetention() {
+	for {
+		applyRetention()
+		time.Sleep(retentionInterval)
+	}
+}
+
+// retentionHandler implements
+//
+//	GET /_api/retention  what the rules would remove now, without removing it
+//
+// It needs the admin permission.
+type retentionHandler struct{}
+
+func (h *retentionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if requireUser(w, r, permAdmin) == nil {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	list, err := expiredEntries()
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
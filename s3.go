@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Files larger than this are uploaded to S3 in parts of this size.
+var s3PartSize int64 = 64 << 20
+
+// Objects larger than this, the most S3 copies in one request, are
+// copied in parts of s3PartSize.
+var s3MaxCopySize int64 = 5 << 30
+
+// s3Transport gives up on an endpoint that doesn't take the connection
+// or doesn't answer. Bodies have no deadline, as objects are streamed to
+// clients.
+var s3Transport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	ForceAttemptHTTP2:     true,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: time.Minute,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   16,
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// emptyPayload is the SHA-256 of an empty body.
+const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Backend stores files in an S3 compatible bucket. Directories are
+// key prefixes; empty ones are kept as zero length "dir/" objects.
+// Requests are signed with AWS signature version 4, using the
+// credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+type s3Backend struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string // Key prefix of the root, without slashes at the ends
+	region    string
+	pathStyle bool
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+// newS3Backend parses a root of the form s3://bucket/prefix.
+func newS3Backend(root string) (*s3Backend, error) {
+	u, err := url.Parse(root)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 root `%s`. Use s3://bucket/prefix.", root)
+	}
+	endpoint, err := url.Parse(s3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid -s3-endpoint `%s`.", s3Endpoint)
+	}
+	b := &s3Backend{
+		endpoint:  endpoint,
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		region:    s3Region,
+		pathStyle: s3PathStyle,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Transport: s3Transport},
+	}
+	if b.accessKey == "" || b.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for S3.")
+	}
+	if _, err := b.List("/"); err != nil {
+		return nil, fmt.Errorf("Can't list %s: %v", root, err)
+	}
+	return b, nil
+}
+
+// key returns the object key of a file.
+func (b *s3Backend) key(name string) string {
+	return strings.TrimPrefix(path.Join(b.prefix, path.Clean("/"+name)), "/")
+}
+
+// dirKey returns the key prefix of the entries of a directory.
+func (b *s3Backend) dirKey(name string) string {
+	if k := b.key(name); k != "" {
+		return k + "/"
+	}
+	return ""
+}
+
+// request sends a signed request for key. body may be nil; its SHA-256
+// is sent if it is small enough to have been buffered, otherwise the
+// payload is unsigned.
+func (b *s3Backend) request(method, key string, query url.Values, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	u := *b.endpoint
+	escaped := "/" + escapePath(key)
+	if b.pathStyle {
+		escaped = "/" + b.bucket + escaped
+	} else {
+		u.Host = b.bucket + "." + u.Host
+	}
+	u.Path, _ = url.PathUnescape(escaped)
+	u.RawPath = escaped
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payload := emptyPayload
+	if buf, ok := body.(*bytes.Reader); ok {
+		data := make([]byte, buf.Len())
+		buf.ReadAt(data, 0)
+		sum := sha256.Sum256(data)
+		payload = hex.EncodeToString(sum[:])
+	} else if body != nil {
+		payload = unsignedPayload
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	b.sign(req, escaped, payload, time.Now().UTC())
+	return b.client.Do(req)
+}
+
+// sign adds an AWS signature version 4 to req.
+func (b *s3Backend) sign(req *http.Request, escapedPath, payload string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if b.token != "" {
+		req.Header.Set("X-Amz-Security-Token", b.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		escapedPath,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + b.secretKey)
+	for _, part := range []string{date, b.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query the way signature version 4 expects:
+// sorted by key, with everything but unreserved characters escaped.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, urlEscape(k)+"="+urlEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error turns an unsuccessful response into an error that maps to the
+// right HTTP status for our own clients.
+func s3Error(op, name string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var e struct {
+		Code    string
+		Message string
+	}
+	xml.Unmarshal(body, &e)
+	var err error
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = os.ErrNotExist
+	case resp.StatusCode == http.StatusForbidden:
+		err = os.ErrPermission
+	case resp.StatusCode == http.StatusServiceUnavailable || e.Code == "SlowDown":
+		err = syscall.EAGAIN
+	case e.Code != "":
+		err = fmt.Errorf("%s: %s", e.Code, e.Message)
+	default:
+		err = errors.New(resp.Status)
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// do sends a request and fails for anything but 2xx.
+func (b *s3Backend) do(op, name, method, key string, query url.Values, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	resp, err := b.request(method, key, query, header, body, length)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, s3Error(op, name, resp)
+	}
+	return resp, nil
+}
+
+func (b *s3Backend) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	if name != "/" {
+		resp, err := b.request("HEAD", b.key(name), nil, nil, nil, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+			return &fileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			return nil, s3Error("stat", name, resp)
+		}
+	}
+	// A directory exists if any key starts with its prefix.
+	list, err := b.list(b.dirKey(name), "/", "", 1)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if name != "/" && len(list.Contents) == 0 && len(list.CommonPrefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &fileInfo{name: path.Base(name), isDir: true}, nil
+}
+
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type s3List struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []s3Object
+	CommonPrefixes        []struct{ Prefix string }
+}
+
+// list requests one page of ListObjectsV2.
+func (b *s3Backend) list(prefix, delimiter, token string, max int) (*s3List, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+	resp, err := b.do("list", "/"+prefix, "GET", "", query, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	list := new(s3List)
+	return list, xml.NewDecoder(resp.Body).Decode(list)
+}
+
+// listAll calls fn for every page of a listing.
+func (b *s3Backend) listAll(prefix, delimiter string, fn func(*s3List) error) error {
+	token := ""
+	for {
+		list, err := b.list(prefix, delimiter, token, 0)
+		if err != nil {
+			return err
+		}
+		if err := fn(list); err != nil {
+			return err
+		}
+		if !list.IsTruncated {
+			return nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+func (b *s3Backend) List(name string) ([]os.FileInfo, error) {
+	prefix := b.dirKey(name)
+	var entries []os.FileInfo
+	err := b.listAll(prefix, "/", func(list *s3List) error {
+		for _, p := range list.CommonPrefixes {
+			entries = append(entries, &fileInfo{name: path.Base(strings.TrimSuffix(p.Prefix, "/")), isDir: true})
+		}
+		for _, o := range list.Contents {
+			if o.Key == prefix {
+				continue // the marker of the directory itself
+			}
+			entries = append(entries, &fileInfo{name: path.Base(o.Key), size: o.Size, modTime: o.LastModified})
+		}
+		return nil
+	})
+	if err == nil && len(entries) == 0 {
+		if _, err := b.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	return entries, err
+}
+
+func (b *s3Backend) Open(name string) (io.ReadSeekCloser, error) {
+	info, err := b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	return &s3Reader{b: b, name: name, size: info.Size()}, nil
+}
+
+// s3Reader reads an object with ranged GET requests. A request is only
+// made when reading, starting at the current offset, so Seek is free.
+type s3Reader struct {
+	b      *s3Backend
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.offset)}}
+		resp, err := r.b.do("read", r.name, "GET", r.b.key(r.name), nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: r.name, Err: syscall.EINVAL}
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func (b *s3Backend) Put(name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > s3PartSize {
+		err = b.putMultipart(name, f, info.Size())
+	} else {
+		var resp *http.Response
+		resp, err = b.do("put", name, "PUT", b.key(name), nil, nil, f, info.Size())
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if err == nil {
+		os.Remove(src)
+	}
+	return err
+}
+
+// putMultipart uploads a large file in parts.
+func (b *s3Backend) putMultipart(name string, f *os.File, size int64) error {
+	key := b.key(name)
+	return b.multipart("put", name, key, size, func(query url.Values, offset, length int64) (string, error) {
+		resp, err := b.do("put", name, "PUT", key, query, nil, io.NewSectionReader(f, offset, length), length)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag"), nil
+	})
+}
+
+// copyMultipart copies a large object on the server side in parts.
+func (b *s3Backend) copyMultipart(name, fromKey, toKey string, size int64) error {
+	source := "/" + b.bucket + "/" + escapePath(fromKey)
+	return b.multipart("copy", name, toKey, size, func(query url.Values, offset, length int64) (string, error) {
+		header := http.Header{
+			"X-Amz-Copy-Source":       {source},
+			"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)},
+		}
+		resp, err := b.do("copy", name, "PUT", toKey, query, header, nil, 0)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		// Like a copy, this can fail even with status 200.
+		var result struct {
+			XMLName xml.Name
+			ETag    string
+			Code    string
+			Message string
+		}
+		if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+			return "", err
+		}
+		if result.XMLName.Local == "Error" {
+			return "", &os.PathError{Op: "copy", Path: name, Err: fmt.Errorf("%s: %s", result.Code, result.Message)}
+		}
+		return result.ETag, nil
+	})
+}
+
+// multipart creates the object key of size bytes from parts of
+// s3PartSize, each stored by part, which returns its ETag. S3 assembles
+// the object only when all parts are there, so it still appears in one
+// step. On failure, the parts are dropped.
+func (b *s3Backend) multipart(op, name, key string, size int64, part func(query url.Values, offset, length int64) (string, error)) error {
+	resp, err := b.do(op, name, "POST", key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var created struct{ UploadId string }
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	abort := func() {
+		b.request("DELETE", key, url.Values{"uploadId": {created.UploadId}}, nil, nil, 0)
+	}
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+s3PartSize, n+1 {
+		length := size - offset
+		if length > s3PartSize {
+			length = s3PartSize
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {created.UploadId}}
+		etag, err := part(query, offset, length)
+		if err != nil {
+			abort()
+			return err
+		}
+		complete.Parts = append(complete.Parts, completedPart{n, etag})
+	}
+	body, _ := xml.Marshal(complete)
+	resp, err = b.do(op, name, "POST", key, url.Values{"uploadId": {created.UploadId}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		abort()
+		return err
+	}
+	return checkCopyResult(name, resp)
+}
+
+// checkCopyResult reads the reply of a copy or of completing a multipart
+// upload. Both can fail even with status 200.
+func checkCopyResult(name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &e) == nil && e.XMLName.Local == "Error" {
+		return &os.PathError{Op: "put", Path: name, Err: fmt.Errorf("%s: %s", e.Code, e.Message)}
+	}
+	return nil
+}
+
+func (b *s3Backend) Mkdir(name string) error {
+	if _, err := b.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	resp, err := b.do("mkdir", name, "PUT", b.dirKey(name), nil, nil, bytes.NewReader(nil), 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copyObject copies one object of size bytes on the server side.
+func (b *s3Backend) copyObject(name, fromKey, toKey string, size int64) error {
+	if size > s3MaxCopySize {
+		return b.copyMultipart(name, fromKey, toKey, size)
+	}
+	header := http.Header{"X-Amz-Copy-Source": {"/" + b.bucket + "/" + escapePath(fromKey)}}
+	resp, err := b.do("copy", name, "PUT", toKey, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	return checkCopyResult(name, resp)
+}
+
+func (b *s3Backend) Copy(from, to string) error {
+	info, err := b.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return b.copyObject(from, b.key(from), b.key(to), info.Size())
+	}
+	fromPrefix, toPrefix := b.dirKey(from), b.dirKey(to)
+	copied := false
+	err = b.listAll(fromPrefix, "", func(list *s3List) error {
+		for _, o := range list.Contents {
+			if err := b.copyObject(from, o.Key, toPrefix+strings.TrimPrefix(o.Key, fromPrefix), o.Size); err != nil {
+				return err
+			}
+			copied = true
+		}
+		return nil
+	})
+	if err == nil && !copied {
+		err = b.Mkdir(to)
+	}
+	return err
+}
+
+func (b *s3Backend) Rename(from, to string) error {
+	if err := b.Copy(from, to); err != nil {
+		return err
+	}
+	return b.RemoveAll(from)
+}
+
+func (b *s3Backend) RemoveAll(name string) error {
+	if path.Clean("/"+name) == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EINVAL}
+	}
+	keys := []string{b.key(name)}
+	err := b.listAll(b.dirKey(name), "", func(list *s3List) error {
+		for _, o := range list.Contents {
+			keys = append(keys, o.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		resp, err := b.request("DELETE", key, nil, nil, nil, 0)
+		if err != nil {
+			return &os.PathError{Op: "remove", Path: name, Err: err}
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+			return s3Error("remove", name, resp)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchServer serves a temporary root with a large and a small file
+// through fileServerHandler. wrap, if set, wraps every response writer.
+func benchServer(b *testing.B, wrap func(http.ResponseWriter) http.ResponseWriter) (*httptest.Server, *http.Client) {
+	b.Helper()
+	dir := b.TempDir()
+	for name, size := range map[string]int{"large.bin": 64 << 20, "small.bin": 16 << 10} {
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	oldStorage, oldHot := storage, hotFiles
+	storage = &localBackend{root: dir}
+	b.Cleanup(func() { storage, hotFiles = oldStorage, oldHot })
+	handler := &fileServerHandler{fileSystem(storage)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wrap != nil {
+			w = wrap(w)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	b.Cleanup(ts.Close)
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true, MaxIdleConnsPerHost: 16}}
+	return ts, client
+}
+
+// fetchAll downloads name b.N times, from parallel clients.
+func fetchAll(b *testing.B, ts *httptest.Server, client *http.Client, name string, size int64) {
+	b.SetBytes(size)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(ts.URL + "/" + name)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if err != nil || n != size {
+				b.Errorf("got %d bytes, %v", n, err)
+				return
+			}
+		}
+	})
+}
+
+// copyWriter hides the ReaderFrom of the response writer, so bodies are
+// copied through user space as before sendfile was used.
+type copyWriter struct {
+	http.ResponseWriter
+}
+
+func (w copyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func withCopy(w http.ResponseWriter) http.ResponseWriter {
+	return copyWriter{w}
+}
+
+func BenchmarkServeLargeSendfile(b *testing.B) {
+	ts, client := benchServer(b, nil)
+	fetchAll(b, ts, client, "large.bin", 64<<20)
+}
+
+func BenchmarkServeLargeCopy(b *testing.B) {
+	ts, client := benchServer(b, withCopy)
+	fetchAll(b, ts, client, "large.bin", 64<<20)
+}
+
+func BenchmarkServeSmallSendfile(b *testing.B) {
+	ts, client := benchServer(b, nil)
+	fetchAll(b, ts, client, "small.bin", 16<<10)
+}
+
+func BenchmarkServeSmallCopy(b *testing.B) {
+	ts, client := benchServer(b, withCopy)
+	fetchAll(b, ts, client, "small.bin", 16<<10)
+}
+
+func BenchmarkServeSmallHotCache(b *testing.B) {
+	ts, client := benchServer(b, nil)
+	hotFiles = &hotCache{max: 64 << 20, maxFile: 1 << 20, files: make(map[string]*hotFile), lru: list.New()}
+	fetchAll(b, ts, client, "small.bin", 16<<10)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,6 +10,7 @@ import (
 	"log"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/textproto"
 	"os"
@@ -19,6 +20,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -26,13 +28,72 @@ import (
 )
 
 var (
-	dir               string             // Root directory for file server
-	port              string             // Port on which file server should run
-	version           bool               // Display version
-	help              bool               // Display help
-	htmlHeadTemplate  *template.Template // Template for html begin
-	tableItemTemplate *template.Template // Template for table item
-	fileTypes         = map[string]string{
+	dir                string             // Root directory for file server
+	port               string             // Port on which file server should run
+	listenAddrs        stringList         // Addresses to listen on instead of port, host:port or unix:/path
+	listenMode         string             // Mode and group of unix sockets, as MODE[:GROUP]
+	trustedProxyFlags  stringList         // Proxies whose forwarding headers are trusted, as addresses, CIDRs or unix
+	proxyProtocol      bool               // Expect a PROXY protocol header on every HTTP connection
+	basePath           string             // URL path the server is mounted under behind a proxy
+	version            bool               // Display version
+	rateLimit          string             // Bandwidth cap shared by all downloads
+	rateLimitIP        string             // Bandwidth cap per client IP
+	rateLimitPaths     stringList         // Bandwidth caps per path prefix, as prefix=rate
+	requestRate        float64            // Requests per second allowed per client IP
+	requestBurst       int                // Requests a client IP may make in a burst
+	maxConns           int                // Maximum number of simultaneous connections
+	readHeaderTimeout  time.Duration      // Time allowed to read request headers
+	readTimeout        time.Duration      // Time allowed to read a whole request
+	writeTimeout       time.Duration      // Time a response may stall before the connection is closed
+	idleTimeout        time.Duration      // Time an idle keep-alive connection is kept open
+	maxHeaderBytes     int                // Maximum size of request headers
+	minRate            string             // Minimum transfer rate a client must sustain
+	minTransferRate    int64              // minRate in bytes per second
+	errorTemplateFile  string             // User supplied template for error pages
+	templateDir        string             // Directory with user supplied page templates
+	theme              string             // Built-in colour theme
+	customCSS          string             // Stylesheet added to every page
+	logoFile           string             // Image shown above the listing
+	showTree           bool               // Show the directory tree sidebar
+	usersFile          string             // File with the users allowed to log in
+	hashPasswordFlag   bool               // Print a password hash for the users file
+	trashRetention     time.Duration      // How long deleted files are kept in the trash
+	maxUpload          string             // Largest file that may be uploaded
+	maxUploadSize      int64              // maxUpload in bytes, 0 for no limit
+	keepVersions       int                // Earlier versions kept of each file
+	versionRetention   time.Duration      // How long earlier versions are kept
+	stateDirFlag       string             // Local directory for partial uploads and temporary files
+	quotaFlags         stringList         // Quotas per user or directory, as target=size[:files]
+	showDirSizes       bool               // Show recursive directory sizes in the listing
+	retentionFlags     stringList         // Retention rules, as /dir=keep:N,age:DURATION
+	retentionInterval  time.Duration      // How often the retention rules run
+	auditLog           string             // File the audit log is appended to
+	auditKeyFile       string             // File with the key of the audit log's chain
+	sftpPort           string             // Port of the SFTP server, off if empty
+	sshHostKeyFile     string             // Private host key of the SFTP server
+	authorizedKeysFile string             // Public keys allowed to log in over SFTP
+	ftpPort            string             // Port of the FTP server, off if empty
+	ftpPassivePorts    string             // Port range for passive data connections, as low-high
+	ftpPublicIP        string             // Address announced for passive data connections
+	ftpHome            string             // Directory each FTP user sees as /, {user} is replaced
+	ftpCertFile        string             // Certificate for explicit FTPS
+	ftpKeyFile         string             // Private key of ftpCertFile
+	ftpRequireTLS      bool               // Refuse FTP logins and transfers without TLS
+	changeFeedFlag     bool               // Keep a feed of changes for replicas
+	replicateFrom      string             // URL of the primary this server is a replica of
+	replicateInterval  time.Duration      // How often a replica asks the primary for changes
+	upstream           string             // URL of the server proxied with a cache
+	cacheDir           string             // Directory of the cached copies of upstream
+	cacheSize          string             // Largest total size of the cache
+	cacheTTL           time.Duration      // How long a cached copy is used before it is revalidated
+	hotCacheSize       string             // Memory for small files served often, off if empty
+	hotFileSize        string             // Largest file kept in the hot cache
+	s3Endpoint         string             // Endpoint of the S3 compatible service
+	s3Region           string             // Region used to sign S3 requests
+	s3PathStyle        bool               // Address the bucket in the path instead of the host name
+	help               bool               // Display help
+	pageTemplates      *template.Template // Templates for listing and error pages
+	fileTypes          = map[string]string{
 		".jpg":  "image",
 		".jpeg": "image",
 		".png":  "image",
@@ -110,13 +171,80 @@ func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHead
 	}
 }
 
+// item is one row of a directory listing, passed to the row template.
 type item struct {
-	Icon         string
-	Name         string
-	Path         string
-	LastModified string
-	Size         string
-	Target       string
+	Icon         string // CSS classes of the icon, e.g. "image icon"
+	Name         string // File name
+	Path         string // Escaped link to the file, relative to the listing
+	LastModified string // Modification time formatted as DATEFORMAT
+	Size         string // Human readable size, "-" for directories
+	Target       string // Link target, "_self" for directories and "_blank" for files
+	IsDir        bool   // Whether the entry is a directory
+	Download     string // Link to download an archive, whose Path browses it
+}
+
+// newItem describes a file for the listing.
+func newItem(d os.FileInfo) item {
+	name := d.Name()
+	if d.IsDir() {
+		path := urlEscape(name) + "/"
+		return item{Icon: "directory icon", Name: name, Path: path, LastModified: d.ModTime().Format(DATEFORMAT), Size: "-", Target: "_self", IsDir: true}
+	}
+	var image string
+	if fileType, found := fileTypes[strings.ToLower(filepath.Ext(name))]; found {
+		image = fileType + " icon"
+	} else {
+		image = "file icon"
+	}
+	it := item{Icon: image, Name: name, Path: urlEscape(name), LastModified: d.ModTime().Format(DATEFORMAT), Size: formatSize(d.Size()), Target: "_blank"}
+	if archiveFormat(name) != "" {
+		// Archives open like directories.
+		it.Download, it.Path, it.Target = it.Path, it.Path+"/", "_self"
+	}
+	return it
+}
+
+// listEntry is a directory entry of a JSON listing.
+type listEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"isDir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"` // Hex digest of a file, with ?checksum only
+}
+
+// serveJSONListing lists the open directory f as JSON for clients that
+// asked for it with an Accept header, like the client commands.
+func serveJSONListing(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string, f http.File) {
+	checksum := r.URL.Query().Has("checksum")
+	entries := []listEntry{}
+	for {
+		dirs, err := f.Readdir(100)
+		if err != nil || len(dirs) == 0 {
+			break
+		}
+		for _, d := range dirs {
+			if strings.HasPrefix(d.Name(), ".") {
+				continue
+			}
+			e := listEntry{Name: d.Name(), IsDir: d.IsDir(), ModTime: d.ModTime()}
+			if !d.IsDir() {
+				e.Size = d.Size()
+			}
+			if checksum && !d.IsDir() {
+				sum, err := fileChecksum(fs, path.Join(name, d.Name()), d)
+				if err != nil {
+					serveError(w, r, err)
+					return
+				}
+				e.SHA256 = sum
+			}
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entries)
 }
 
 const DATEFORMAT = "2006-01-02 15:04:05"
@@ -125,23 +253,49 @@ const sniffLen = 512
 const HTMLDOCUMENTBEGIN = `
 <html>
 	<head>
-		<title> {{.}} </title>
+		<title> {{.Title}} </title>
 		<style>
-			body {margin: 0; padding-top: 10px; background-color: #edece4; font-family: Tahoma, Geneva, sans-serif; color: #4d4d4d}
+			{{.ThemeCSS}}
+			body {margin: 0; padding-top: 10px; background-color: var(--background); font-family: Tahoma, Geneva, sans-serif; color: var(--text)}
 			.contents{margin: 0 auto;}
-			a:link{color: #333333; text-decoration: none;}
-			a:visited{color: #333333; text-decoration: none;}
-			a:active{color: #333333; text-decoration: none;}
-			table {margin: 0 auto; background-color: #fff; padding: 40px; border: solid 1px #d9d8d4;}
-			tr:hover {background-color: rgba(243, 243, 243, 0.85);}
+			a:link{color: var(--link); text-decoration: none;}
+			a:visited{color: var(--link); text-decoration: none;}
+			a:active{color: var(--link); text-decoration: none;}
+			table {margin: 0 auto; background-color: var(--panel); padding: 40px; border: solid 1px var(--border);}
+			tr:hover {background-color: var(--hover);}
 			td {padding: 3px 20px 3px 0;}
-			th {text-align: left; border-bottom: 1px solid #4d4d4d;}
-			.footer {background-color: #fff; border-top: solid 1px #d9d8d4; border-bottom: solid 1px #d9d8d4; height: 35px; padding-top: 15px; margin-top: 10px; margin-bottom: 10px; text-align: center;}
-			.homeButton {position: fixed; border: solid 1px #d9d8d4; background-color: #fff;}
-			.backButton {top: 65px; position: fixed; border: solid 1px #d9d8d4; background-color: #fff;}
+			th {text-align: left; border-bottom: 1px solid var(--text);}
+			.footer {background-color: var(--panel); border-top: solid 1px var(--border); border-bottom: solid 1px var(--border); height: 35px; padding-top: 15px; margin-top: 10px; margin-bottom: 10px; text-align: center;}
+			.homeButton {position: fixed; border: solid 1px var(--border); background-color: var(--panel);}
+			.backButton {top: 65px; position: fixed; border: solid 1px var(--border); background-color: var(--panel);}
 			.icon {width: 16px; height: 16px; background-repeat: no-repeat;}
 			.icons {padding: 2px 2px 2px 0;}
-			.button {width: 32px; height: 32px; background-repeat: no-repeat;}
+			.button {width: 32px; height: 32px; background-repeat: no-repeat; filter: var(--button-filter);}
+			.logo {text-align: center; margin-bottom: 10px;}
+			.logo img {max-height: 64px;}
+			.breadcrumbs {text-align: center; margin-bottom: 10px; font-size: 15px;}
+			.sidebar {position: fixed; top: 120px; left: 0; width: 240px; bottom: 10px; overflow: auto; border: solid 1px var(--border); background-color: var(--panel); font-size: 13px;}
+			.sidebar.collapsed {width: 32px; bottom: auto; overflow: hidden;}
+			.sidebar.collapsed .tree {display: none;}
+			.sidebarToggle {display: block; padding: 4px 10px; cursor: pointer;}
+			.tree, .tree ul {list-style: none; margin: 0; padding-left: 14px;}
+			.tree li {white-space: nowrap;}
+			.tree .toggle {display: inline-block; width: 14px; cursor: pointer;}
+			.tree .current {font-weight: bold;}
+			.toolbar {text-align: center; margin-bottom: 10px; font-size: 13px;}
+			.toolbar a, .actions a {margin-right: 10px; cursor: pointer;}
+			.actions, .download {font-size: 12px;}
+			.usage {font-size: 12px; margin-bottom: 5px;}
+			.bar {width: 200px; height: 10px; background-color: var(--hover); border: solid 1px var(--border);}
+			.bar div {height: 100%; background-color: var(--link);}
+			body.dragging::after {content: "Drop files to upload"; position: fixed; top: 0; left: 0; right: 0; bottom: 0; display: flex; align-items: center; justify-content: center; background-color: rgba(0, 0, 0, 0.3); color: #fff; font-size: 30px; pointer-events: none;}
+			.uploads {position: fixed; right: 10px; bottom: 10px; width: 380px; max-height: 40%; overflow: auto; padding: 8px; background-color: var(--panel); border: solid 1px var(--border); font-size: 12px;}
+			.uploads div {display: flex; align-items: center;}
+			.uploads .name {flex: 1; overflow: hidden; text-overflow: ellipsis; white-space: nowrap;}
+			.uploads progress {width: 100px; margin: 0 6px;}
+			.uploads .status {width: 70px;}
+			.uploadDialog {position: fixed; top: 30%; left: 50%; transform: translateX(-50%); padding: 20px; background-color: var(--panel); border: solid 1px var(--border); z-index: 10;}
+			.uploadDialog button {margin-right: 6px;}
 			.image { background-image: url(data:image/png;base64,R0lGODlhEAAQAPcAAEKU50Kl91JCQmNCKWNjY2sxIWtjtWtzpXOEtXOl53O173uMxnuUxnul3oQAhIRzpYSczoStzoSt3oxaMYyEtYyUtZSEpZSUxpSlzpTG95yl1qWElKWUlKW956XO960xKa1rIa2Ura21/63W/7UxELVaMbVzQrWEa7WclLXW/72Me73O/8aclMbW/8bn/84xGM6Uc9ZCGNacc9alc9be59bv/95KId6UWt61hN7n7+dSIeeUUufOhOfn5++EOe/Ge+/v9+/3//e9Y/fGc/9rMf9zMf+EOf+EUv+MQv+UQv+UY/+tUv+1Wv/GY//We//enP/ne//nhP///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////yH+EkR1c3RpbiBGcmllc2VuaGFobgAh+QQBAAAOACwAAAAAEAAQAAAIwgAlCBw4kICDgwglSFnIUIoEBQYROlDYcGGAAAAiHqTYMEiLFiIQaFSohAgRJEuaBKlRY8VIKUdKFEnC5MmQJRhcJpTyoQCJFzF06LABQefGIDsmgPBhRIgRHxGMTgQyw8SAGzucOLkhQSqEHixUCDghg8cPGA2kMsgR4oGBDTyiQEHRwIPGBTkuULBggQOOHxYS2EWIgEaNESM8eMjAeEQHjYVruJicojLixwgPaNisAcOFzxcqUNDogIDp06hNIwwIADs=);}
 			.video { background-image: url(data:image/png;base64,R0lGODlhEAAQAMQfAN/f3zw8PEpKSkBAQBQUFMPDw+bm5hwcHNvb20tLS8bGxlhYWKSkpDMzM2traxgYGERERLKyslNTUz4+PkhISBkZGXZ2dkZGRikpKTs7Ozg4OMzMzP///wsLCwAAAAAAACH5BAEAAB8ALAAAAAAQABAAAAVi4CeOJMBxAFmenncWK9eyLgeLs1x7A6CQOV5ks1HhMAwiwmAceTrQqLTjGXUcFsEiEDgIIIJHxxqQTBKaTIMyuFTGImhrTodaqfQ6/CPPz+1xeH5Pex0EU1KHTohTVU2PIiEAOw==);}
 			.audio { background-image: url(data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAAGXRFWHRTb2Z0d2FyZQBBZG9iZSBJbWFnZVJlYWR5ccllPAAAAqFJREFUeNp0Us9PE1EQnre77W5Zty1SWlD5YY1RxJig0YSTHIheTQz1P/BC5OBFE6PEK4kJRogelQux4sEE46UXLhghGIWQaGJYEVqbbbW4LVu23d3nvN1CCwkv+bL75s18880PQimFRAoOHlr7JhEziPcI46BTchCAg0NOKrU0sbKi9mtaIek4Tg5NrxFDiKZGP+Ewgnj82B38jCwvr/XzPDcUiYRvxmLhRCQSAo7j5vBtYI/AMOi+YA51+XwCbW0NJePx9plCofSgUCjeZWT4fG1w8NLori9hPeh7Xj1AQKiqfn1MCEkEg3JPNNpsRKPh2UDAv9uPbRbLeuASXHhmQC7PNSqgjrNNTPMnu/YiEkg2pChyT0tLELq7293kb6/XmtgcsqGri4cqCmEwTYBKRQZCZPa8ihjFROd0vXReVTP3slkbNM2ul3B1qgg+KQA7Ozz8zlJAEyqghDno/77sK0+SToIoypQQIGv3xf1TCAQIdHYQMMoAjuPZgsEzsLnxvaamFdU1oTqWhNbHSKkz4NjWGDbvoiBwvKIQe2+V4AiIGEj5MGh5bwVYLCqsE+h/temOeFvb0YgPy6iClrVUTOk6lEu6p05yoPOEBYYp1QgaFimfTctKswL6loHQQRDEp7zgQycbzLIBflFynX2CA2HJws4JUKvAm8LWH+3R8sf54urSYjqX2RyxbXsiPfsEfr0bc52QaMCyKgu2VbWoXaGEVm2eWHUFjm2PVz6/GTd5Hky/COn5qfpOxM6C1NU3fbr3VFvsuAxGyYSN9Zy6/WMB4NYNb4zEq5dnKhH+Gti/+xC8PfOt9/IVhV20TAZ21pYebr4afoGx+cYxMgLJbbuHwG6JpdXU5GJJHxYEoUjWP70sz01+QHMLa99/AQYAohQjWPbGXSYAAAAASUVORK5CYII=);}
@@ -153,29 +307,43 @@ const HTMLDOCUMENTBEGIN = `
 			.file { background-image: url(data:image/png;base64,R0lGODlhEAAQANUvAH5+fuXl6NHR1f39/f///+Hh5PPy9O7u8Orp7NjX3N3c4Pb2987N083N0tXU2Onp7Nzc4PLy9NXU2djY3OHh4/r6+/f29+/u8Pb3+NHQ1c7N0vr5+/r6+vb2+NnX3Pn5++np7fn6+u7t8fPz9OHg5Orq7NXT2NnX3dTU2e7u8eTk5NTU2N3d4N3c39TT2dbr9QAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAACH5BAEAAC8ALAAAAAAQABAAAAaLwNcLQCwahcghYclcEpPDgXQqBagASUDoU+F0N5ujEGDBLMyLdMfSwY4jEYPcMIrL3cND6nC48A8ifngACCUgCAgPiogIgwGPkJEBgyQFFAWYl5gFgwoKLRAsnhAQnoMJCScJE6isHhODDg4SDisSLg4oJhKDGQK/wMAZgwwMDcUaDQ0axoNGz0UvQQA7);}
 			.back { background-image: url(data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAACAAAAAgCAQAAADZc7J/AAAAAmJLR0QA/4ePzL8AAAAJcEhZcwAAAEgAAABIAEbJaz4AAAAJdnBBZwAAACAAAAAgAIf6nJ0AAAGdSURBVEjHpdXfThNBFIDx3+wuSMUKKrGmYKISfAffP/EZBBMuGhoCIRCl/O/ueNG1F3RmoeFcTSZzvvPt2TO7vDDCM04U81WjWRYQ/PBeg+DBT5PHB4rOZHYMFCqlNSOTxYJVR3q0Yq/VLp07TPl2GfDFhlpA8Ns94vMBUc+uujU5NU6l5wEBe3rz9v0S0w0vMunRps9t/crIuZCqnwNE7FnVoHDtIK2fAwQMDE0FUenAbX5eqszu91a5cmaU008bBNHQlqkgaOyrdcQi4P/4zNp35LSr/iIg4Ju3alHp1r4noniUHvV9baWDQ1fd9fNvYRaNJ6NcSL6z4mM7gRuO3Xdf+TKx99fQKhqvVI6XBQS1xlAtaGy4cNWFSBkEE1vW2+/Aa+OuNqYBjTvb7arvxkXeoczsT2y2H5No09h0OUDAtW0B0ZrCSc4hZxDc6Pkwb+WZmzQiB4BLOyqz29FzlG5lHhA8KA3UglrftT8phy4Alz5Za6fyjbFmEdH1CEGtti0qROumzpYDzPrwTk8tqvWduE+JdscTP9cXxz8u5YF32IlaaQAAACV0RVh0ZGF0ZTpjcmVhdGUAMjAxMS0wNy0wMVQxMzoxMDoyNS0wNzowMDPfgNMAAAAldEVYdGRhdGU6bW9kaWZ5ADIwMTEtMDctMDFUMTM6MTA6MjUtMDc6MDBCgjhvAAAAGXRFWHRTb2Z0d2FyZQBBZG9iZSBJbWFnZVJlYWR5ccllPAAAAABJRU5ErkJggg==);}
 		</style>
+		{{if .CustomCSS}}<link rel="stylesheet" href="{{.CustomCSS}}">{{end}}
 	</head>
-	<body><div class = 'contents'>`
-
-const HTMLDOCUMENTEND = `
-	</body>
-</html>`
-
-const TABLEBEGIN = `
+	<body><div class = 'contents'>
+	<a class = "homeButton" href="{{base}}/" style = 'padding: 8.5px; margin-right: 10px;'><div class="home button"></div></a><a class = "backButton" href="../" style = 'padding: 8.5px; margin-right: 10px;'><div class="back button"></div></a>
+	{{if .Logo}}<div class = "logo"><img src="{{.Logo}}" alt="{{.Name}}"></div>{{end}}
+	<div class = "breadcrumbs">{{range $i, $c := .Breadcrumbs}}{{if $i}} / {{end}}<a href="{{$c.Path}}">{{$c.Name}}</a>{{end}}</div>
+	{{if .Tree}}
+	<div class = "sidebar" id = "sidebar"><a class = "sidebarToggle" id = "sidebarToggle" title = "Directory tree">&#9776;</a><ul class = "tree" id = "tree"></ul></div>
+	<script>{{template "treeScript"}}</script>
+	{{end}}
+	{{if .Manage}}<script>{{template "manageScript"}}</script><script>{{template "uploadScript"}}</script>{{end}}`
+
+const TABLE = `
 <table>
 	<thead>
 		<th></th>
 		<th>Name</th>
 		<th>Size</th>
 		<th>Last Modified</th>
-	</thead>`
-
-const TABLEEND = `
+	</thead>
+	{{- range .Items}}{{template "row" .}}{{end}}
 </table>`
 
+const FOOTER = `
+</div><div class='footer'>
+{{- range .Usage}}
+<div class="usage">{{.Name}}: {{.Text}}</div>
+{{- end}}
+<span style='font-family: "Times New Roman"; color: var(--text); font-style:italic; font-size:14;'>Powered by Helix FileServer v{{.Version}}</span>
+</div>
+	</body>
+</html>`
+
 const ITEM = `
-	<tr>
+	<tr data-name="{{.Name}}">
 		<td class = "icons"><div class="{{.Icon}}"></div></td>
-		<td><a href="{{.Path}}" target="{{.Target}}">{{.Name}}</a></td>
+		<td><a href="{{.Path}}" target="{{.Target}}">{{.Name}}</a>{{if .Download}} <a class="download" href="{{.Download}}">(download)</a>{{end}}</td>
 		<td>{{.Size}}</td>
 		<td>{{.LastModified}}</td>
 	</tr>`
@@ -186,49 +354,175 @@ const (
 	COMMAND = "fileserver"
 )
 
-const NOTFOUND = `
+const ERRORPAGE = `
 <html>
 	<head>
-		<title>404 | Not Found</title>
+		<title>{{.Code}} | {{.Status}}</title>
 		<style>
-		body {margin: 0; padding-top: 10px; background-color: #edece4; font-family: Tahoma, Geneva, sans-serif; color: #4d4d4d}
-		.contents {margin: 0 auto; padding: 40px 80px; text-align: center; background-color: #fff; border: solid 1px #d9d8d4; width: 400px;}
+		{{.ThemeCSS}}
+		body {margin: 0; padding-top: 10px; background-color: var(--background); font-family: Tahoma, Geneva, sans-serif; color: var(--text)}
+		.contents {margin: 0 auto; padding: 40px 80px; text-align: center; background-color: var(--panel); border: solid 1px var(--border); width: 400px;}
+		a:link, a:visited, a:active {color: var(--link);}
 		</style>
+		{{if .CustomCSS}}<link rel="stylesheet" href="{{.CustomCSS}}">{{end}}
 	</head>
 	<body>
         <div class = "contents">
-        	<h1>404</h1>
-        	<h2>Not Found</h2>
+        	<h1>{{.Code}}</h1>
+        	<h2>{{.Status}}</h2>
+        	{{if .Message}}<p>{{.Message}}</p>{{end}}
+        	<p><a href="{{base}}/">Home</a></p>
         </div>
 	</body>
 </html>
 `
 
 func init() {
-	flag.StringVar(&dir, "d", "./", "The root directory for the file server.")
-	flag.StringVar(&dir, "directory", "./", "The root directory for the file server.")
+	flag.StringVar(&dir, "d", "./", "The root directory, s3://bucket/prefix, archive or embed: for the file server.")
+	flag.StringVar(&dir, "directory", "./", "The root directory, s3://bucket/prefix, archive or embed: for the file server.")
 	flag.StringVar(&port, "p", "4545", "The port on which the file server should run.")
 	flag.StringVar(&port, "port", "4545", "The port on which the file server should run.")
+	flag.Var(&listenAddrs, "listen", "Address to listen on instead of -port, as host:port, [::]:port or unix:/path. May be repeated.")
+	flag.StringVar(&listenMode, "listen-mode", "", "Mode of the -listen unix: sockets, with an optional group, e.g. 0660:www-data.")
+	flag.Var(&trustedProxyFlags, "trusted-proxy", "Address, CIDR or unix of a reverse proxy whose X-Forwarded-* and Forwarded headers are used. May be repeated.")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header on every HTTP connection. Needs -trusted-proxy.")
+	flag.StringVar(&basePath, "base-path", "", "URL path the server is mounted under, e.g. /files.")
 	flag.BoolVar(&version, "v", false, "Prints the version number.")
 	flag.BoolVar(&version, "version", false, "Prints the version number.")
+	flag.StringVar(&rateLimit, "rate", "", "Bandwidth cap shared by all downloads, e.g. 10M.")
+	flag.StringVar(&rateLimitIP, "rate-ip", "", "Bandwidth cap per client IP, e.g. 1M.")
+	flag.Var(&rateLimitPaths, "rate-path", "Bandwidth cap below a path prefix, e.g. /iso=5M. May be repeated.")
+	flag.Float64Var(&requestRate, "req-rate", 0, "Requests per second allowed per client IP.")
+	flag.IntVar(&requestBurst, "req-burst", 0, "Requests a client IP may make in a burst.")
+	flag.IntVar(&maxConns, "max-conns", 0, "Maximum number of simultaneous connections.")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "Time allowed to read request headers.")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Minute, "Time allowed to read a whole request.")
+	flag.DurationVar(&writeTimeout, "write-timeout", time.Minute, "Time a response may stall before the connection is closed.")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "Time an idle keep-alive connection is kept open.")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers.")
+	flag.StringVar(&minRate, "min-rate", "", "Minimum transfer rate a client must sustain, e.g. 1K.")
+	flag.StringVar(&errorTemplateFile, "error-template", "", "File with an html/template used for error pages.")
+	flag.StringVar(&templateDir, "template-dir", "", "Directory with head.html, table.html, row.html, footer.html or error.html templates.")
+	flag.StringVar(&theme, "theme", "light", "Built-in colour theme: light or dark.")
+	flag.StringVar(&customCSS, "css", "", "Stylesheet added to every page.")
+	flag.StringVar(&logoFile, "logo", "", "Image shown above the listing.")
+	flag.BoolVar(&showTree, "tree", false, "Show a directory tree sidebar next to the listing.")
+	flag.StringVar(&usersFile, "users", "", "File with users allowed to manage files, as name:hash[:permissions] lines.")
+	flag.BoolVar(&hashPasswordFlag, "hash-password", false, "Read a password from stdin and print its hash for the users file.")
+	flag.DurationVar(&trashRetention, "trash-retention", 30*24*time.Hour, "How long deleted files are kept in the trash, 0 to keep them forever.")
+	flag.StringVar(&maxUpload, "max-upload", "", "Largest file that may be uploaded, e.g. 10G.")
+	flag.IntVar(&keepVersions, "keep-versions", 10, "Earlier versions kept of each replaced file, 0 to keep none.")
+	flag.DurationVar(&versionRetention, "version-retention", 0, "How long earlier versions are kept, 0 for no limit.")
+	flag.Var(&quotaFlags, "quota", "Quota as user:NAME=SIZE[:FILES] or /dir=SIZE[:FILES]. May be repeated.")
+	flag.BoolVar(&showDirSizes, "dir-sizes", false, "Show the recursive size of directories in the listing.")
+	flag.Var(&retentionFlags, "retention", "Retention rule as /dir=keep:N,age:DURATION, e.g. /builds=keep:30,age:14d. May be repeated.")
+	flag.DurationVar(&retentionInterval, "retention-interval", time.Hour, "How often the retention rules run.")
+	flag.StringVar(&auditLog, "audit-log", "", "Hash-chained log of changes and failed logins, appended to. Without -audit-key, whoever can write it can rewrite the whole chain.")
+	flag.StringVar(&auditKeyFile, "audit-key", "", "File with a secret key for the chain of -audit-log, kept where the log's writers can't read it.")
+	flag.StringVar(&sftpPort, "sftp-port", "", "Port of an SFTP server for the users of -users, off if empty.")
+	flag.StringVar(&sshHostKeyFile, "ssh-host-key", "", "Ed25519 host key of the SFTP server, created if missing. Default: ssh_host_ed25519_key in the state directory.")
+	flag.StringVar(&authorizedKeysFile, "authorized-keys", "", "Public keys allowed to log in over SFTP, as name key-type key lines.")
+	flag.StringVar(&ftpPort, "ftp-port", "", "Port of an FTP server for the users of -users, off if empty.")
+	flag.StringVar(&ftpPassivePorts, "ftp-passive-ports", "", "Port range for passive FTP data connections, e.g. 50000-50100.")
+	flag.StringVar(&ftpPublicIP, "ftp-public-ip", "", "IPv4 address announced for passive FTP connections, e.g. behind NAT.")
+	flag.StringVar(&ftpHome, "ftp-home", "/", "Directory each FTP user sees as /, {user} is replaced by the user name.")
+	flag.StringVar(&ftpCertFile, "ftp-cert", "", "Certificate for explicit FTPS (AUTH TLS), PEM encoded.")
+	flag.StringVar(&ftpKeyFile, "ftp-key", "", "Private key of the -ftp-cert certificate.")
+	flag.BoolVar(&ftpRequireTLS, "ftp-require-tls", false, "Refuse FTP logins and transfers without TLS.")
+	flag.BoolVar(&changeFeedFlag, "change-feed", false, "Keep a feed of changes at /_api/changes for replicas.")
+	flag.StringVar(&replicateFrom, "replicate", "", "Follow the primary fileserver at this URL, which must run with -change-feed.")
+	flag.DurationVar(&replicateInterval, "replicate-interval", 5*time.Second, "How often a replica asks the primary for changes.")
+	flag.StringVar(&upstream, "upstream", "", "Serve the files of this URL from a cache instead of the root.")
+	flag.StringVar(&cacheDir, "cache-dir", "", "Directory of the -upstream cache, cache in the state directory by default.")
+	flag.StringVar(&cacheSize, "cache-size", "10G", "Largest total size of the -upstream cache.")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 5*time.Minute, "How long a cached copy is used before it is revalidated.")
+	flag.StringVar(&hotCacheSize, "hot-cache", "", "Memory for keeping small files that are served often, e.g. 64M.")
+	flag.StringVar(&hotFileSize, "hot-file-size", "1M", "Largest file kept in the -hot-cache.")
+	flag.StringVar(&stateDirFlag, "state-dir", "", "Local directory for partial uploads and temporary files.")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "Endpoint of the S3 compatible service for s3:// roots.")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "Region used to sign S3 requests.")
+	flag.BoolVar(&s3PathStyle, "s3-path-style", false, "Address the bucket in the URL path instead of the host name.")
 	flag.BoolVar(&help, "h", false, "Prints the version number.")
 	flag.BoolVar(&help, "help", false, "Prints the version number.")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", COMMAND)
 		fmt.Fprintf(os.Stderr, "Options:\n")
-		fmt.Fprintf(os.Stderr, "\t-d, -directory  Directory   The root directory for the file server.\n")
-		fmt.Fprintf(os.Stderr, "\t-p, -port       Port        The port on which the file server should run.\n")
-		fmt.Fprintf(os.Stderr, "\t-v, -version    Version     Prints the version number.\n")
-		fmt.Fprintf(os.Stderr, "\t-h, -help       Help        Show this help.\n")
+		fmt.Fprintf(os.Stderr, "\t-d, -directory         Directory   The root directory, s3://bucket/prefix, archive or embed: to serve.\n")
+		fmt.Fprintf(os.Stderr, "\t-p, -port              Port        The port on which the file server should run.\n")
+		fmt.Fprintf(os.Stderr, "\t-listen                Address     Address instead of -port, as host:port, [::]:port or unix:/path. May be repeated.\n")
+		fmt.Fprintf(os.Stderr, "\t-listen-mode           Mode[:Grp]  Mode of the -listen unix: sockets, with an optional group, e.g. 0660:www-data.\n")
+		fmt.Fprintf(os.Stderr, "\t-trusted-proxy         Address     Address, CIDR or unix of a reverse proxy whose forwarding headers are used. May be repeated.\n")
+		fmt.Fprintf(os.Stderr, "\t-proxy-protocol                    Expect a PROXY protocol v1 or v2 header on every HTTP connection. Needs -trusted-proxy.\n")
+		fmt.Fprintf(os.Stderr, "\t-base-path             Path        URL path the server is mounted under, e.g. /files.\n")
+		fmt.Fprintf(os.Stderr, "\t-rate                  Rate        Bandwidth cap shared by all downloads, e.g. 10M.\n")
+		fmt.Fprintf(os.Stderr, "\t-rate-ip               Rate        Bandwidth cap per client IP, e.g. 1M.\n")
+		fmt.Fprintf(os.Stderr, "\t-rate-path             Prefix=Rate Bandwidth cap below a path prefix. May be repeated.\n")
+		fmt.Fprintf(os.Stderr, "\t-req-rate              Number      Requests per second allowed per client IP.\n")
+		fmt.Fprintf(os.Stderr, "\t-req-burst             Number      Requests a client IP may make in a burst.\n")
+		fmt.Fprintf(os.Stderr, "\t-max-conns             Number      Maximum number of simultaneous connections.\n")
+		fmt.Fprintf(os.Stderr, "\t-read-header-timeout   Duration    Time allowed to read request headers.\n")
+		fmt.Fprintf(os.Stderr, "\t-read-timeout          Duration    Time allowed to read a whole request.\n")
+		fmt.Fprintf(os.Stderr, "\t-write-timeout         Duration    Time a response may stall before the connection is closed.\n")
+		fmt.Fprintf(os.Stderr, "\t-idle-timeout          Duration    Time an idle keep-alive connection is kept open.\n")
+		fmt.Fprintf(os.Stderr, "\t-max-header-bytes      Number      Maximum size of request headers.\n")
+		fmt.Fprintf(os.Stderr, "\t-min-rate              Rate        Minimum transfer rate a client must sustain, e.g. 1K.\n")
+		fmt.Fprintf(os.Stderr, "\t-error-template        File        File with an html/template used for error pages.\n")
+		fmt.Fprintf(os.Stderr, "\t-template-dir          Directory   Directory with head, table, row, footer or error templates.\n")
+		fmt.Fprintf(os.Stderr, "\t-theme                 Theme       Built-in colour theme: light or dark.\n")
+		fmt.Fprintf(os.Stderr, "\t-css                   File        Stylesheet added to every page.\n")
+		fmt.Fprintf(os.Stderr, "\t-logo                  File        Image shown above the listing.\n")
+		fmt.Fprintf(os.Stderr, "\t-tree                              Show a directory tree sidebar next to the listing.\n")
+		fmt.Fprintf(os.Stderr, "\t-users                 File        File with users allowed to manage files.\n")
+		fmt.Fprintf(os.Stderr, "\t-hash-password                     Read a password from stdin and print its hash.\n")
+		fmt.Fprintf(os.Stderr, "\t-trash-retention       Duration    How long deleted files are kept in the trash, 0 to keep them.\n")
+		fmt.Fprintf(os.Stderr, "\t-max-upload            Size        Largest file that may be uploaded, e.g. 10G.\n")
+		fmt.Fprintf(os.Stderr, "\t-keep-versions         Number      Earlier versions kept of each replaced file, 0 to keep none.\n")
+		fmt.Fprintf(os.Stderr, "\t-version-retention     Duration    How long earlier versions are kept, 0 for no limit.\n")
+		fmt.Fprintf(os.Stderr, "\t-quota                 Target=Size Quota as user:NAME=SIZE[:FILES] or /dir=SIZE[:FILES]. May be repeated.\n")
+		fmt.Fprintf(os.Stderr, "\t-dir-sizes                         Show the recursive size of directories in the listing.\n")
+		fmt.Fprintf(os.Stderr, "\t-retention             Dir=Rules   Retention rule as /dir=keep:N,age:DURATION. May be repeated.\n")
+		fmt.Fprintf(os.Stderr, "\t-retention-interval    Duration    How often the retention rules run.\n")
+		fmt.Fprintf(os.Stderr, "\t-audit-log             File        Hash-chained log of changes and failed logins, appended to. Without -audit-key, whoever can write it can rewrite the whole chain.\n")
+		fmt.Fprintf(os.Stderr, "\t-audit-key             File        File with a secret key for the chain of -audit-log, kept where the log's writers can't read it.\n")
+		fmt.Fprintf(os.Stderr, "\t-sftp-port             Port        Port of an SFTP server for the users of -users, off if empty.\n")
+		fmt.Fprintf(os.Stderr, "\t-ssh-host-key          File        Ed25519 host key of the SFTP server, created if missing.\n")
+		fmt.Fprintf(os.Stderr, "\t-authorized-keys       File        Public keys allowed to log in over SFTP, as name key-type key lines.\n")
+		fmt.Fprintf(os.Stderr, "\t-ftp-port              Port        Port of an FTP server for the users of -users, off if empty.\n")
+		fmt.Fprintf(os.Stderr, "\t-ftp-passive-ports     Low-High    Port range for passive FTP data connections.\n")
+		fmt.Fprintf(os.Stderr, "\t-ftp-public-ip         Address     IPv4 address announced for passive FTP connections.\n")
+		fmt.Fprintf(os.Stderr, "\t-ftp-home              Directory   Directory each FTP user sees as /, e.g. /users/{user}.\n")
+		fmt.Fprintf(os.Stderr, "\t-ftp-cert              File        Certificate for explicit FTPS (AUTH TLS).\n")
+		fmt.Fprintf(os.Stderr, "\t-ftp-key               File        Private key of the -ftp-cert certificate.\n")
+		fmt.Fprintf(os.Stderr, "\t-ftp-require-tls                   Refuse FTP logins and transfers without TLS.\n")
+		fmt.Fprintf(os.Stderr, "\t-change-feed                       Keep a feed of changes at /_api/changes for replicas.\n")
+		fmt.Fprintf(os.Stderr, "\t-replicate             URL         Follow the primary fileserver at URL, which must run with -change-feed.\n")
+		fmt.Fprintf(os.Stderr, "\t-replicate-interval    Duration    How often a replica asks the primary for changes.\n")
+		fmt.Fprintf(os.Stderr, "\t-upstream              URL         Serve the files of URL from a cache instead of the root.\n")
+		fmt.Fprintf(os.Stderr, "\t-cache-dir             Directory   Directory of the -upstream cache, cache in the state directory by default.\n")
+		fmt.Fprintf(os.Stderr, "\t-cache-size            Size        Largest total size of the -upstream cache, e.g. 10G.\n")
+		fmt.Fprintf(os.Stderr, "\t-cache-ttl             Duration    How long a cached copy is used before it is revalidated.\n")
+		fmt.Fprintf(os.Stderr, "\t-hot-cache             Size        Memory for keeping small files that are served often, e.g. 64M.\n")
+		fmt.Fprintf(os.Stderr, "\t-hot-file-size         Size        Largest file kept in the -hot-cache.\n")
+		fmt.Fprintf(os.Stderr, "\t-state-dir             Directory   Local directory for partial uploads and temporary files.\n")
+		fmt.Fprintf(os.Stderr, "\t-s3-endpoint           URL         Endpoint of the S3 compatible service for s3:// roots.\n")
+		fmt.Fprintf(os.Stderr, "\t-s3-region             Region      Region used to sign S3 requests.\n")
+		fmt.Fprintf(os.Stderr, "\t-s3-path-style                     Address the bucket in the URL path instead of the host name.\n")
+		fmt.Fprintf(os.Stderr, "\t-v, -version           Version     Prints the version number.\n")
+		fmt.Fprintf(os.Stderr, "\t-h, -help              Help        Show this help.\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "\t%s ls [-r] URL                List a remote directory.\n", COMMAND)
+		fmt.Fprintf(os.Stderr, "\t%s get URL [FILE]             Download a remote file, resuming a partial download.\n", COMMAND)
+		fmt.Fprintf(os.Stderr, "\t%s put FILE... URL            Upload files to a remote server.\n", COMMAND)
+		fmt.Fprintf(os.Stderr, "\t%s sync SOURCE TARGET         Copy changed files between a local directory and a URL.\n", COMMAND)
+		fmt.Fprintf(os.Stderr, "\t%s verify-audit [-key K] FILE Check the hash chain of an -audit-log.\n", COMMAND)
 	}
-	htmlHeadTemplate = template.Must(template.New("htmlStart").Parse(HTMLDOCUMENTBEGIN))
-	tableItemTemplate = template.Must(template.New("tableItem").Parse(ITEM))
+	pageTemplates = builtinTemplates()
 }
 
 func showVersion() {
 	fmt.Println("\n", NAME, VERSION)
-	fmt.Println("This is a free software and comes with NO warranty.\n")
+	fmt.Print("This is a free software and comes with NO warranty.\n\n")
 }
 
 /*
@@ -260,13 +554,25 @@ func HTTPLog(handler http.Handler) http.Handler {
 		handler.ServeHTTP(w, r)
 		status_code := GetStatusCode(w)
 		if r.Method != "HEAD" && r.ContentLength > 0 {
-			log.Printf("%s %s %d %s %s %d", r.RemoteAddr, r.Proto, status_code, r.Method, r.URL, r.ContentLength)
+			log.Printf("%s %s %d %s %s %d", r.RemoteAddr, r.Proto, status_code, r.Method, r.URL.RequestURI(), r.ContentLength)
 		} else {
-			log.Printf("%s %s %d %s %s", r.RemoteAddr, r.Proto, status_code, r.Method, r.URL)
+			log.Printf("%s %s %d %s %s", r.RemoteAddr, r.Proto, status_code, r.Method, r.URL.RequestURI())
 		}
 	})
 }
 
+// stringList collects the values of a flag that may be given several times.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 type fileServerHandler struct {
 	root http.FileSystem
 }
@@ -281,28 +587,68 @@ func formatSize(size int64) string {
 	return strconv.FormatFloat(sizef, 'f', 2, 64) + sizes[i]
 }
 
+// parseSize parses a byte count with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := 1.0
+	for i := len(sizes) - 1; i > 0; i-- {
+		if suffix := strings.TrimSpace(sizes[i])[:1]; strings.HasSuffix(s, suffix) {
+			mult = float64(int64(1) << uint(10*i))
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return int64(n * mult), nil
+}
+
 func (f *fileServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	upath := r.URL.Path
 	if !strings.HasPrefix(upath, "/") {
 		upath = "/" + upath
 		r.URL.Path = upath
 	}
+	if isStatePath(path.Clean(upath)) {
+		errorPage(w, r, http.StatusNotFound, "")
+		return
+	}
+	if r.Method == "PUT" {
+		putFile(w, r, path.Clean(upath))
+		return
+	}
+	if q := r.URL.Query(); q.Has("versions") || q.Has("version") {
+		serveVersions(w, r, f.root, path.Clean(upath))
+		return
+	}
+	if r.URL.Query().Has("du") {
+		serveDU(w, r, path.Clean(upath))
+		return
+	}
+	if archive, ok := findArchive(upath); ok {
+		serveArchive(w, r, archive, path.Clean(upath))
+		return
+	}
+	if hotFiles != nil && hotFiles.serve(w, r, path.Clean(upath)) {
+		return
+	}
 	serveFile(w, r, f.root, path.Clean(upath), true)
 }
 
 func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string, redirect bool) {
 	f, err := fs.Open(name)
 	if err != nil {
-		// TODO expose actual error?
-		http.NotFound(w, r)
+		serveError(w, r, err)
 		return
 	}
 	defer f.Close()
 
 	d, err1 := f.Stat()
 	if err1 != nil {
-		// TODO expose actual error?
-		http.NotFound(w, r)
+		serveError(w, r, err1)
 		return
 	}
 
@@ -331,11 +677,14 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 			}
 		*/
 
-		htmlHeadTemplate.Execute(w, d.Name())
-		fmt.Fprintf(w, "<a class = \"homeButton\" href=\"/\" style = 'padding: 8.5px; margin-right: 10px;'><div class=\"home button\"></div></a><a class = \"backButton\" href=\"../\" style = 'padding: 8.5px; margin-right: 10px;'><div class=\"back button\"></div></a>")
-		var folders bytes.Buffer
-		var files bytes.Buffer
-		fmt.Fprintf(w, TABLEBEGIN)
+		if wantsJSON(r) {
+			serveJSONListing(w, r, fs, name, f)
+			return
+		}
+
+		// Sizes aren't computed inside archives.
+		_, inArchive := fs.(archiveFileSystem)
+		var folders, files []item
 		for {
 			dirs, err := f.Readdir(100)
 			if err != nil || len(dirs) == 0 {
@@ -347,27 +696,35 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 					continue
 				}
 				if d.IsDir() {
-					path := urlEscape(name) + "/"
-					tableItemTemplate.Execute(&folders, item{Icon: "directory icon", Name: name, Path: path, LastModified: d.ModTime().Format(DATEFORMAT), Size: "-", Target: "_self"})
-				} else {
-					var image string
-					if fileType, found := fileTypes[strings.ToLower(filepath.Ext(d.Name()))]; found {
-						image = fileType + " icon"
-					} else {
-						image = "file icon"
+					it := newItem(d)
+					if showDirSizes && inArchive {
+						it.Size = "—"
+					} else if showDirSizes {
+						it.Size = dirSizeText(path.Join(r.URL.Path, name))
 					}
-					tableItemTemplate.Execute(&files, item{Icon: image, Name: name, Path: urlEscape(name), LastModified: d.ModTime().Format(DATEFORMAT), Size: formatSize(d.Size()), Target: "_blank"})
+					folders = append(folders, it)
+				} else {
+					files = append(files, newItem(d))
 				}
 			}
 		}
-		fmt.Fprint(w, folders.String())
-		fmt.Fprint(w, files.String())
-		fmt.Fprint(w, TABLEEND)
-		fmt.Fprintf(w, "</div><div class='footer'>\n")
-		fmt.Fprintf(w, "<span style='font-family: \"Times New Roman\"; color: #2c2c2c; font-style:italic; font-size:14;'>Powered by Helix FileServer v%s</span>\n", VERSION)
-		fmt.Fprintf(w, "</div>")
-		fmt.Fprintf(w, HTMLDOCUMENTEND)
+		page := newPage(name, r.URL.Path)
+		page.Items = append(folders, files...)
+		page.Usage = usageFor(r, name)
+		renderListing(w, page)
+
+		return
+	}
 
+	if wantsJSON(r) && r.URL.Query().Has("checksum") {
+		// The entry of the file, as in the JSON listing.
+		sum, err := fileChecksum(fs, name, d)
+		if err != nil {
+			serveError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(listEntry{Name: d.Name(), Size: d.Size(), ModTime: d.ModTime(), SHA256: sum})
 		return
 	}
 
@@ -400,7 +757,7 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			ctype = http.DetectContentType(buf[:n])
 			_, err := content.Seek(0, os.SEEK_SET) // rewind to output whole file
 			if err != nil {
-				http.Error(w, "seeker can't seek", http.StatusInternalServerError)
+				errorPage(w, r, http.StatusInternalServerError, "seeker can't seek")
 				return
 			}
 		}
@@ -411,17 +768,18 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 
 	size, err := sizeFunc()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// handle Content-Range header.
 	sendSize := size
-	var sendContent io.Reader = content
+	var multi []httpRange // Ranges sent as multipart/byteranges
+	var boundary string
 	if size >= 0 {
 		ranges, err := parseRange(rangeReq, size)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			errorPage(w, r, http.StatusRequestedRangeNotSatisfiable, err.Error())
 			return
 		}
 		if sumRangesSize(ranges) > size {
@@ -446,7 +804,7 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			// be sent using the multipart/byteranges media type."
 			ra := ranges[0]
 			if _, err := content.Seek(ra.start, os.SEEK_SET); err != nil {
-				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				errorPage(w, r, http.StatusRequestedRangeNotSatisfiable, err.Error())
 				return
 			}
 			sendSize = ra.length
@@ -455,31 +813,9 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 		case len(ranges) > 1:
 			sendSize = rangesMIMESize(ranges, ctype, size)
 			code = http.StatusPartialContent
-
-			pr, pw := io.Pipe()
-			mw := multipart.NewWriter(pw)
-			w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
-			sendContent = pr
-			defer pr.Close() // cause writing goroutine to fail and exit if CopyN doesn't finish.
-			go func() {
-				for _, ra := range ranges {
-					part, err := mw.CreatePart(ra.mimeHeader(ctype, size))
-					if err != nil {
-						pw.CloseWithError(err)
-						return
-					}
-					if _, err := content.Seek(ra.start, os.SEEK_SET); err != nil {
-						pw.CloseWithError(err)
-						return
-					}
-					if _, err := io.CopyN(part, content, ra.length); err != nil {
-						pw.CloseWithError(err)
-						return
-					}
-				}
-				mw.Close()
-				pw.Close()
-			}()
+			multi = ranges
+			boundary = multipart.NewWriter(io.Discard).Boundary()
+			w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
 		}
 
 		w.Header().Set("Accept-Ranges", "bytes")
@@ -490,9 +826,32 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 
 	w.WriteHeader(code)
 
-	if r.Method != "HEAD" {
-		io.CopyN(w, sendContent, sendSize)
+	if r.Method == "HEAD" {
+		return
+	}
+	// Copying an *os.File straight to the response lets the kernel send
+	// it (sendfile), unless the response is throttled.
+	dst := throttle(newTransferWriter(w), r)
+	if multi == nil {
+		io.CopyN(dst, content, sendSize)
+		return
 	}
+	mw := multipart.NewWriter(dst)
+	mw.SetBoundary(boundary)
+	for _, ra := range multi {
+		// A part only adds its header, so the content can go to dst
+		// directly.
+		if _, err := mw.CreatePart(ra.mimeHeader(ctype, size)); err != nil {
+			return
+		}
+		if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+			return
+		}
+		if _, err := io.CopyN(dst, content, ra.length); err != nil {
+			return
+		}
+	}
+	mw.Close()
 }
 
 func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
@@ -661,10 +1020,25 @@ func rangesMIMESize(ranges []httpRange, contentType string, contentSize int64) (
 	return
 }
 
+// commands run instead of the server when named as the first argument.
+var commands = map[string]func(args []string) int{
+	"verify-audit": verifyAuditCommand,
+	"ls":           lsCommand,
+	"get":          getCommand,
+	"put":          putCommand,
+	"sync":         syncCommand,
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	go handleExit() // goroutine to handle ctrl + c
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
+	go handleExit() // goroutine to handle ctrl + c and SIGHUP
 	flag.Parse()    // parse command line arguments
 
 	if version {
@@ -677,23 +1051,210 @@ func main() {
 		os.Exit(0)
 	}
 
-	_, fileErr := os.Stat(dir)
-	if fileErr != nil { // Check if path exists
-		fmt.Println("Invalid Path `", dir, "`. Please specify a valid path.")
+	if hashPasswordFlag {
+		printPasswordHash()
+		os.Exit(0)
+	}
+
+	if err := setupStorage(); err != nil { // Check if the root exists
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := setupRetention(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := setupAudit(); err != nil {
+		fmt.Println("Can't open the audit log:", err)
+		os.Exit(1)
+	}
+	if err := setupChangeFeed(); err != nil {
+		fmt.Println("Can't open the change feed:", err)
+		os.Exit(1)
+	}
+	if err := setupReplica(); err != nil {
+		fmt.Println("Invalid -replicate:", err)
 		os.Exit(1)
 	}
+	if err := setupProxy(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := setupForwarding(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := setupHotCache(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if upstream != "" && (usersFile != "" || len(quotaFlags) > 0 || len(retentionFlags) > 0 || changeFeedFlag || replicateFrom != "") {
+		fmt.Println("-upstream serves a read-only cache and can't be used with -users, -quota, -retention, -change-feed or -replicate.")
+		os.Exit(1)
+	}
+	if err := setupQuotas(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := setupThrottling(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if replicateFrom != "" && (usersFile != "" || readOnlyStorage()) {
+		fmt.Println("A replica only changes with its primary, -replicate needs a writable root and can't be used with -users.")
+		os.Exit(1)
+	}
+	if usersFile != "" {
+		if readOnlyStorage() {
+			fmt.Println("The root `", dir, "` is read-only, -users can't be used with it.")
+			os.Exit(1)
+		}
+		users, err := loadUsers(usersFile)
+		if err != nil {
+			fmt.Println("Invalid users file:", err)
+			os.Exit(1)
+		}
+		accounts = users
+	}
+	if sftpPort != "" {
+		if accounts == nil {
+			fmt.Println("-sftp-port needs -users.")
+			os.Exit(1)
+		}
+		if err := setupSSH(); err != nil {
+			fmt.Println("Can't load the SSH host key:", err)
+			os.Exit(1)
+		}
+	}
+	if ftpPort != "" {
+		if accounts == nil {
+			fmt.Println("-ftp-port needs -users.")
+			os.Exit(1)
+		}
+		if err := setupFTP(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if err := setupTemplates(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if maxUpload != "" {
+		size, err := parseSize(maxUpload)
+		if err != nil {
+			fmt.Println("Invalid -max-upload `", maxUpload, "`.")
+			os.Exit(1)
+		}
+		maxUploadSize = size
+	}
+	if minRate != "" {
+		rate, err := parseSize(minRate)
+		if err != nil {
+			fmt.Println("Invalid -min-rate `", minRate, "`.")
+			os.Exit(1)
+		}
+		minTransferRate = rate
+	}
 	startServer() // start the file server
 }
 
 func startServer() {
-	fmt.Printf("Starting %s with root %s on port %s.\nPress ctrl + c to exit.\n", strings.Title(NAME), dir, port)
-	handler := HTTPLog(&fileServerHandler{http.Dir(dir)})
-	http.Handle("/", handler)
-	conErr := http.ListenAndServe("0.0.0.0:"+port, nil)
-	if conErr != nil {
-		fmt.Println(conErr)
+	ls, err := listeners()
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+	var names []string
+	for _, l := range ls {
+		names = append(names, listenerName(l))
+	}
+	fmt.Printf("Starting %s with root %s on %s.\nPress ctrl + c to exit.\n", strings.Title(NAME), dir, strings.Join(names, ", "))
+	root := fileSystem(storage)
+	mux := http.NewServeMux()
+	mux.HandleFunc(THEMEPREFIX, serveThemeAsset)
+	if cache != nil {
+		// Nothing of the root is served.
+		fmt.Printf("Proxying %s with a cache in %s.\n", upstreamURL.Redacted(), cache.dir)
+		mux.Handle("/", &proxyHandler{})
+		serve(ls, mux)
+		return
+	}
+	mux.Handle("/", &fileServerHandler{root})
+	mux.Handle(APIPREFIX+"tree", &treeHandler{root})
+	mux.Handle(APIPREFIX+"fs/", &manageHandler{})
+	mux.Handle(TRASHPREFIX, &trashHandler{})
+	mux.Handle(APIPREFIX+"trash", &trashHandler{})
+	mux.Handle(APIPREFIX+"trash/", &trashHandler{})
+	mux.Handle(TUSPREFIX, &tusHandler{})
+	mux.Handle(APIPREFIX+"row", &rowHandler{root})
+	mux.Handle(APIPREFIX+"versions/restore", &versionsHandler{})
+	mux.Handle(APIPREFIX+"quota", &quotaHandler{})
+	mux.Handle(APIPREFIX+"quota/", &quotaHandler{})
+	mux.Handle(APIPREFIX+"retention", &retentionHandler{})
+	mux.Handle(APIPREFIX+"changes", &changesHandler{})
+	mux.Handle(REPLICAPREFIX, &replicaHandler{})
+	mux.Handle(APIPREFIX+"replica", &replicaHandler{})
+	// Directory sizes, for -dir-sizes and ?du.
+	go dirSizes.run()
+	if len(retentionRules) > 0 {
+		go runRetention()
+	}
+	if primaryURL != nil {
+		go runReplica()
+	}
+	if accounts != nil {
+		if trashRetention > 0 {
+			go purgeExpiredTrash()
+		}
+		go purgeStaleUploads()
+		if keepVersions > 0 {
+			go pruneAllVersions()
+		}
+	}
+	if sftpPort != "" {
+		l, err := net.Listen("tcp", "0.0.0.0:"+sftpPort)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("SFTP on port %s, host key %s.\n", sftpPort, keyFingerprint(hostKeyBlob()))
+		go serveSSH(l)
+	}
+	if ftpPort != "" {
+		l, err := net.Listen("tcp", "0.0.0.0:"+ftpPort)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("FTP on port %s.\n", ftpPort)
+		go serveFTP(l)
+	}
+	serve(ls, mux)
+}
+
+// serve serves mux on the listeners until one fails, and exits.
+func serve(ls []net.Listener, mux http.Handler) {
+	handler := forwarded(HTTPLog(writeDeadlines(RateLimit(stripBasePath(mux)))))
+	server := newServer(handler)
+	var conns chan struct{} // Shared by all listeners
+	if maxConns > 0 {
+		conns = make(chan struct{}, maxConns)
+	}
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		if proxyProtocol {
+			l = &proxyListener{l}
+		}
+		if conns != nil {
+			l = newLimitListener(l, conns)
+		}
+		go func() { errs <- server.Serve(l) }()
+	}
+	conErr := <-errs
+	removeSockets()
+	fmt.Println(conErr)
+	os.Exit(1)
 }
 
 func getHomeDir() string {
@@ -707,11 +1268,16 @@ func getHomeDir() string {
 
 func handleExit() {
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, os.Interrupt)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	for sig := range signalChannel {
-		if sig == syscall.SIGINT {
+		switch sig {
+		case syscall.SIGINT, syscall.SIGTERM:
 			fmt.Printf("\n %s stopped.\n", NAME)
+			flushQuotas()
+			removeSockets()
 			os.Exit(0)
+		case syscall.SIGHUP:
+			reloadUsers()
 		}
 	}
 }
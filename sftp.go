@@ -0,0 +1,607 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02) over the SSH server.
+// Paths are those of URLs, with / the root, and changes go through the
+// same code as the file management API: STATEDIR can't be reached,
+// changing anything needs the write permission, removed files go to the
+// trash, replaced ones are kept as versions and quotas apply.
+
+// SFTP packet types.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+// SFTP status codes.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// Flags of SSH_FXP_OPEN and of file attributes.
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+
+	sftpAttrSize        = 0x01
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+)
+
+const (
+	sftpMaxRead    = 64 * 1024 // Most data sent for one read
+	sftpDirEntries = 100       // Entries sent for one directory read
+)
+
+// sftpServer serves one SFTP session.
+type sftpServer struct {
+	rw      io.ReadWriter
+	user    *account
+	ip      string
+	handles map[string]*sftpFile
+	next    int
+}
+
+// sftpFile is an open file or directory. Files opened for writing are
+// written to a temporary file that replaces the target when closed.
+type sftpFile struct {
+	path    string
+	r       io.ReadSeekCloser // File open for reading
+	tmp     *os.File          // Content being written
+	hold    *uploadQuota      // Space held for the content
+	append  bool
+	isDir   bool
+	entries []os.FileInfo // Directory entries not read yet
+}
+
+func newSFTPServer(rw io.ReadWriter, user *account, ip string) *sftpServer {
+	return &sftpServer{rw: rw, user: user, ip: ip, handles: make(map[string]*sftpFile)}
+}
+
+func (s *sftpServer) serve() {
+	defer func() {
+		// Uploads that weren't closed are dropped.
+		for _, f := range s.handles {
+			f.discard()
+		}
+	}()
+	for {
+		p, err := s.readPacket()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("sftp %s: %v", s.ip, err)
+			}
+			return
+		}
+		if err := s.writePacket(s.handle(p)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *sftpServer) readPacket() ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(s.rw, head[:]); err != nil {
+		return nil, err
+	}
+	r := &sshReader{b: head[:]}
+	n := r.getUint32()
+	if n == 0 || n > sshMaxPacket {
+		return nil, errSSHProtocol
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(s.rw, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *sftpServer) writePacket(p sshWriter) error {
+	var w sshWriter
+	w.putBytes(p)
+	_, err := s.rw.Write(w)
+	return err
+}
+
+// handle answers a request.
+func (s *sftpServer) handle(p []byte) sshWriter {
+	r := &sshReader{b: p[1:]}
+	if p[0] == sftpInit {
+		var w sshWriter
+		w.putByte(sftpVersion)
+		w.putUint32(3)
+		return w
+	}
+	id := r.getUint32()
+	switch p[0] {
+	case sftpOpen:
+		name, flags := r.getString(), r.getUint32()
+		if r.short {
+			break
+		}
+		f, err := s.open(s.path(name), flags)
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.handleReply(id, f)
+	case sftpOpendir:
+		name := s.path(r.getString())
+		if r.short {
+			break
+		}
+		f, err := s.openDir(name)
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.handleReply(id, f)
+	case sftpClose:
+		handle := r.getString()
+		f := s.handles[handle]
+		if f == nil {
+			break
+		}
+		delete(s.handles, handle)
+		return s.status(id, s.close(f))
+	case sftpRead:
+		f, offset, n := s.handles[r.getString()], r.getUint64(), r.getUint32()
+		if f == nil || f.isDir || r.short {
+			break
+		}
+		data, err := f.read(int64(offset), int(min(n, sftpMaxRead)))
+		if err != nil {
+			return s.status(id, err)
+		}
+		w := s.reply(sftpData, id)
+		w.putBytes(data)
+		return w
+	case sftpWrite:
+		f, offset, data := s.handles[r.getString()], r.getUint64(), r.getBytes()
+		if f == nil || f.tmp == nil || r.short {
+			break
+		}
+		return s.status(id, f.write(int64(offset), data))
+	case sftpReaddir:
+		f := s.handles[r.getString()]
+		if f == nil || !f.isDir {
+			break
+		}
+		if len(f.entries) == 0 {
+			return s.status(id, io.EOF)
+		}
+		entries := f.entries[:min(len(f.entries), sftpDirEntries)]
+		f.entries = f.entries[len(entries):]
+		w := s.reply(sftpName, id)
+		w.putUint32(uint32(len(entries)))
+		for _, e := range entries {
+			w.putString(e.Name())
+			w.putString(longName(e))
+			putAttrs(&w, e)
+		}
+		return w
+	case sftpStat, sftpLstat:
+		name := s.path(r.getString())
+		if r.short {
+			break
+		}
+		info, err := s.stat(name)
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.attrsReply(id, info)
+	case sftpFstat:
+		f := s.handles[r.getString()]
+		if f == nil {
+			break
+		}
+		var info os.FileInfo
+		var err error
+		if f.tmp != nil {
+			info, err = f.tmp.Stat()
+		} else {
+			info, err = storage.Stat(f.path)
+		}
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.attrsReply(id, info)
+	case sftpSetstat, sftpFsetstat:
+		// Permissions, owners and times are the server's business and
+		// ignored, changing the size is not supported.
+		r.getString()
+		if r.getUint32()&sftpAttrSize != 0 {
+			return s.statusCode(id, sftpOpUnsupported, "changing the size is not supported")
+		}
+		return s.status(id, nil)
+	case sftpRemove:
+		name := s.path(r.getString())
+		if r.short {
+			break
+		}
+		return s.status(id, s.remove(name, false))
+	case sftpRmdir:
+		name := s.path(r.getString())
+		if r.short {
+			break
+		}
+		return s.status(id, s.remove(name, true))
+	case sftpMkdir:
+		name := s.path(r.getString())
+		if r.short {
+			break
+		}
+		err := s.mayWrite()
+		if err == nil {
+			err = fsMkdir(name)
+		}
+		if err == nil {
+			s.audit("fs.mkdir", "sftp", name)
+		}
+		return s.status(id, err)
+	case sftpRename:
+		from, to := s.path(r.getString()), s.path(r.getString())
+		if r.short {
+			break
+		}
+		return s.status(id, s.rename(from, to))
+	case sftpRealpath:
+		name := s.path(r.getString())
+		if r.short {
+			break
+		}
+		w := s.reply(sftpName, id)
+		w.putUint32(1)
+		w.putString(name)
+		w.putString(name)
+		w.putUint32(0)
+		return w
+	default:
+		return s.statusCode(id, sftpOpUnsupported, "not supported")
+	}
+	return s.statusCode(id, sftpBadMessage, "invalid request or handle")
+}
+
+// path resolves a path of a request. The working directory is the root.
+func (s *sftpServer) path(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (s *sftpServer) mayWrite() error {
+	if !s.user.can(permWrite) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (s *sftpServer) audit(action, detail string, paths ...string) {
+	audit(auditEvent{Action: action, User: s.user.Name, IP: s.ip, Paths: paths, Detail: detail})
+}
+
+func (s *sftpServer) stat(name string) (os.FileInfo, error) {
+	if isStatePath(name) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return storage.Stat(name)
+}
+
+func (s *sftpServer) reply(kind byte, id uint32) sshWriter {
+	var w sshWriter
+	w.putByte(kind)
+	w.putUint32(id)
+	return w
+}
+
+func (s *sftpServer) handleReply(id uint32, f *sftpFile) sshWriter {
+	s.next++
+	handle := fmt.Sprint(s.next)
+	s.handles[handle] = f
+	w := s.reply(sftpHandle, id)
+	w.putString(handle)
+	return w
+}
+
+func (s *sftpServer) attrsReply(id uint32, info os.FileInfo) sshWriter {
+	w := s.reply(sftpAttrs, id)
+	putAttrs(&w, info)
+	return w
+}
+
+// status replies with the outcome of an operation, mapping errors the
+// way statusForError does for HTTP.
+func (s *sftpServer) status(id uint32, err error) sshWriter {
+	if err == nil {
+		return s.statusCode(id, sftpOK, "")
+	}
+	if err == io.EOF {
+		return s.statusCode(id, sftpEOF, "")
+	}
+	switch code := statusForError(err); code {
+	case http.StatusNotFound:
+		return s.statusCode(id, sftpNoSuchFile, errorReason(err))
+	case http.StatusForbidden, http.StatusBadRequest:
+		return s.statusCode(id, sftpPermissionDenied, errorReason(err))
+	case http.StatusInternalServerError:
+		log.Printf("sftp %s: %v", s.ip, err)
+	}
+	return s.statusCode(id, sftpFailure, errorReason(err))
+}
+
+func (s *sftpServer) statusCode(id uint32, code uint32, message string) sshWriter {
+	w := s.reply(sftpStatus, id)
+	w.putUint32(code)
+	w.putString(message)
+	w.putString("")
+	return w
+}
+
+// open opens a file. Files opened for writing start out with the current
+// content unless they are truncated.
+func (s *sftpServer) open(name string, flags uint32) (*sftpFile, error) {
+	if flags&(sftpFlagWrite|sftpFlagAppend|sftpFlagCreat|sftpFlagTrunc) == 0 {
+		info, err := s.stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		r, err := storage.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return &sftpFile{path: name, r: r}, nil
+	}
+	if err := s.mayWrite(); err != nil {
+		return nil, err
+	}
+	name, err := checkPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkDir(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	info, statErr := storage.Stat(name)
+	switch {
+	case statErr == nil && info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case statErr == nil && flags&sftpFlagExcl != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case statErr != nil && (flags&sftpFlagCreat == 0 || !errors.Is(statErr, fs.ErrNotExist)):
+		return nil, statErr
+	}
+	// The size isn't known in advance, so the space held grows with
+	// the file.
+	var size int64
+	if statErr == nil && flags&sftpFlagTrunc == 0 {
+		size = info.Size()
+	}
+	hold, err := holdUpload(name, size, s.user.Name)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := tempFile("sftp-")
+	if err != nil {
+		hold.release()
+		return nil, err
+	}
+	f := &sftpFile{path: name, tmp: tmp, hold: hold, append: flags&sftpFlagAppend != 0}
+	if statErr == nil && flags&sftpFlagTrunc == 0 {
+		r, err := storage.Open(name)
+		if err == nil {
+			_, err = io.Copy(tmp, r)
+			r.Close()
+		}
+		if err != nil {
+			f.discard()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (s *sftpServer) openDir(name string) (*sftpFile, error) {
+	info, err := s.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "opendir", Path: name, Err: syscall.ENOTDIR}
+	}
+	entries, err := storage.List(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &sftpFile{path: name, isDir: true}
+	for _, e := range entries {
+		if !isStatePath(path.Join(name, e.Name())) {
+			f.entries = append(f.entries, e)
+		}
+	}
+	return f, nil
+}
+
+// close closes a file, storing what was written to it.
+func (s *sftpServer) close(f *sftpFile) error {
+	if f.r != nil {
+		return f.r.Close()
+	}
+	if f.tmp == nil {
+		return nil
+	}
+	defer f.hold.release()
+	info, err := f.tmp.Stat()
+	if err == nil {
+		err = f.tmp.Close()
+	}
+	if err == nil {
+		err = os.Chmod(f.tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = replaceFile(f.tmp.Name(), f.path, s.user.Name, f.hold)
+	}
+	if err != nil {
+		os.Remove(f.tmp.Name())
+		return err
+	}
+	s.audit("upload", "sftp, "+formatSize(info.Size()), f.path)
+	return nil
+}
+
+// remove moves a file or an empty directory to the trash.
+func (s *sftpServer) remove(name string, dir bool) error {
+	if err := s.mayWrite(); err != nil {
+		return err
+	}
+	name, err := fsRemoveEntry(name, dir, s.user)
+	if err != nil {
+		return err
+	}
+	s.audit("fs.delete", "sftp", name)
+	return nil
+}
+
+// rename moves a file. SFTP version 3 doesn't replace existing files.
+func (s *sftpServer) rename(from, to string) error {
+	if err := s.mayWrite(); err != nil {
+		return err
+	}
+	src, dst, err := fsMoveTo(from, to)
+	if err != nil {
+		return err
+	}
+	s.audit("fs.move", "sftp", src, dst)
+	return nil
+}
+
+// read reads up to n bytes at offset. At the end of the file it returns
+// io.EOF.
+func (f *sftpFile) read(offset int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	var got int
+	var err error
+	switch ra, ok := f.r.(io.ReaderAt); {
+	case f.tmp != nil:
+		got, err = f.tmp.ReadAt(buf, offset)
+	case ok:
+		got, err = ra.ReadAt(buf, offset)
+	default:
+		if _, err = f.r.Seek(offset, io.SeekStart); err == nil {
+			got, err = io.ReadFull(f.r, buf)
+		}
+	}
+	if got > 0 {
+		return buf[:got], nil
+	}
+	if err == nil || err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return nil, err
+}
+
+func (f *sftpFile) write(offset int64, data []byte) error {
+	if f.append {
+		end, err := f.tmp.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		offset = end
+	}
+	if maxUploadSize > 0 && offset+int64(len(data)) > maxUploadSize {
+		return errors.New("file too large")
+	}
+	if err := f.hold.grow(offset + int64(len(data))); err != nil {
+		return err
+	}
+	_, err := f.tmp.WriteAt(data, offset)
+	return err
+}
+
+// discard drops a file without storing it.
+func (f *sftpFile) discard() {
+	if f.r != nil {
+		f.r.Close()
+	}
+	if f.tmp != nil {
+		f.tmp.Close()
+		os.Remove(f.tmp.Name())
+	}
+	f.hold.release()
+}
+
+// putAttrs writes the attributes of a file: size, permissions and
+// modification time.
+func putAttrs(w *sshWriter, info os.FileInfo) {
+	w.putUint32(sftpAttrSize | sftpAttrPermissions | sftpAttrTimes)
+	w.putUint64(uint64(info.Size()))
+	w.putUint32(sftpMode(info))
+	mtime := uint32(info.ModTime().Unix())
+	w.putUint32(mtime)
+	w.putUint32(mtime)
+}
+
+// sftpMode returns the POSIX mode shown for a file. Backends have no
+// permissions of their own, so it only tells files from directories.
+func sftpMode(info os.FileInfo) uint32 {
+	if info.IsDir() {
+		return syscall.S_IFDIR | 0755
+	}
+	return syscall.S_IFREG | 0644
+}
+
+// longName formats a directory entry like ls -l, which clients show.
+func longName(info os.FileInfo) string {
+	mode := os.FileMode(0644)
+	if info.IsDir() {
+		mode = os.ModeDir | 0755
+	}
+	date := info.ModTime().Format("Jan _2 15:04")
+	if time.Since(info.ModTime()) > 180*24*time.Hour || info.ModTime().After(time.Now()) {
+		date = info.ModTime().Format("Jan _2  2006")
+	}
+	owner := strings.ToLower(NAME)
+	return fmt.Sprintf("%s    1 %-8s %-8s %8d %s %s", mode, owner, owner, info.Size(), date, info.Name())
+}
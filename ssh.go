@@ -0,0 +1,1291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small SSH server (RFC 4253, 4252 and 4254), just enough to run the
+// SFTP subsystem: curve25519 key exchange, an ed25519 host key, AES-GCM
+// or AES-CTR with HMAC-SHA256, and password or public key logins
+// checked against the -users and -authorized-keys files.
+
+// SSH message numbers.
+const (
+	msgDisconnect          = 1
+	msgIgnore              = 2
+	msgUnimplemented       = 3
+	msgDebug               = 4
+	msgServiceRequest      = 5
+	msgServiceAccept       = 6
+	msgExtInfo             = 7
+	msgKexInit             = 20
+	msgNewKeys             = 21
+	msgKexECDHInit         = 30
+	msgKexECDHReply        = 31
+	msgUserAuthRequest     = 50
+	msgUserAuthFailure     = 51
+	msgUserAuthSuccess     = 52
+	msgUserAuthPKOK        = 60
+	msgGlobalRequest       = 80
+	msgRequestFailure      = 82
+	msgChannelOpen         = 90
+	msgChannelOpenConfirm  = 91
+	msgChannelOpenFailure  = 92
+	msgChannelWindowAdjust = 93
+	msgChannelData         = 94
+	msgChannelExtendedData = 95
+	msgChannelEOF          = 96
+	msgChannelClose        = 97
+	msgChannelRequest      = 98
+	msgChannelSuccess      = 99
+	msgChannelFailure      = 100
+)
+
+const (
+	sshMaxPacket     = 256 * 1024 // Largest packet accepted
+	sshWindow        = 2 << 20    // Bytes a client may send before it must wait
+	sshChannelPacket = 32 * 1024  // Largest data packet a client may send
+	sshMinPacket     = 1024       // Smallest data packet a client may ask for
+	sshAuthTimeout   = 2 * time.Minute
+	sshMaxAuthTries  = 10
+)
+
+// Algorithms offered, in order of preference.
+var (
+	sshKexAlgos    = []string{"curve25519-sha256", "curve25519-sha256@libssh.org"}
+	sshCipherAlgos = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr"}
+	sshMACAlgos    = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"}
+	sshSigAlgos    = []string{"ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521", "rsa-sha2-512", "rsa-sha2-256"}
+)
+
+var (
+	errSSHProtocol = errors.New("ssh: protocol error")
+	errSSHMAC      = errors.New("ssh: message authentication failed")
+)
+
+// sshWriter builds a message in the SSH wire format.
+type sshWriter []byte
+
+func (w *sshWriter) putByte(b byte)     { *w = append(*w, b) }
+func (w *sshWriter) putUint32(v uint32) { *w = binary.BigEndian.AppendUint32(*w, v) }
+func (w *sshWriter) putUint64(v uint64) { *w = binary.BigEndian.AppendUint64(*w, v) }
+func (w *sshWriter) putString(s string) { w.putBytes([]byte(s)) }
+func (w *sshWriter) putList(l []string) { w.putString(strings.Join(l, ",")) }
+func (w *sshWriter) putBytes(b []byte)  { w.putUint32(uint32(len(b))); *w = append(*w, b...) }
+func (w *sshWriter) putMpint(n []byte)  { w.putBytes(mpint(n)) }
+
+func (w *sshWriter) putBool(b bool) {
+	if b {
+		w.putByte(1)
+	} else {
+		w.putByte(0)
+	}
+}
+
+// mpint encodes an unsigned big-endian number as the content of an
+// SSH mpint.
+func mpint(n []byte) []byte {
+	for len(n) > 0 && n[0] == 0 {
+		n = n[1:]
+	}
+	if len(n) > 0 && n[0]&0x80 != 0 {
+		return append([]byte{0}, n...)
+	}
+	return n
+}
+
+// sshReader reads a message in the SSH wire format. Reading past its end
+// sets short and returns zero values.
+type sshReader struct {
+	b     []byte
+	short bool
+}
+
+func (r *sshReader) next(n int) []byte {
+	if r.short || n > len(r.b) {
+		r.short = true
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *sshReader) getByte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *sshReader) getUint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *sshReader) getUint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *sshReader) getBytes() []byte {
+	n := r.getUint32()
+	if uint64(n) > uint64(len(r.b)) {
+		r.short = true
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *sshReader) getString() string { return string(r.getBytes()) }
+func (r *sshReader) getBool() bool     { return r.getByte() != 0 }
+func (r *sshReader) getList() []string { return strings.Split(r.getString(), ",") }
+
+// getBigInt reads an mpint, which must not be negative.
+func (r *sshReader) getBigInt() *big.Int {
+	b := r.getBytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		r.short = true
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+// sshHostKey is the key the server proves its identity with.
+var sshHostKey ed25519.PrivateKey
+
+// setupSSH loads the host key of the SFTP server, creating one if the
+// file doesn't exist.
+func setupSSH() error {
+	name := sshHostKeyFile
+	if name == "" {
+		name = filepath.Join(stateDir(), "ssh_host_ed25519_key")
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(name, data, 0600); err != nil {
+			return err
+		}
+		log.Printf("Created SSH host key %s.", name)
+	} else if err != nil {
+		return err
+	}
+	key, err := parseHostKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	sshHostKey = key
+	return nil
+}
+
+// parseHostKey reads an ed25519 private key, PEM encoded PKCS #8 or an
+// unencrypted OpenSSH key as made by ssh-keygen.
+func parseHostKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := key.(ed25519.PrivateKey); ok {
+			return k, nil
+		}
+	case "OPENSSH PRIVATE KEY":
+		const magic = "openssh-key-v1\x00"
+		if !bytes.HasPrefix(block.Bytes, []byte(magic)) {
+			return nil, errors.New("invalid OpenSSH key")
+		}
+		r := &sshReader{b: block.Bytes[len(magic):]}
+		cipherName, kdf := r.getString(), r.getString()
+		r.getBytes()
+		if cipherName != "none" || kdf != "none" {
+			return nil, errors.New("the key must not be encrypted")
+		}
+		if r.getUint32() != 1 {
+			return nil, errors.New("expected a single key")
+		}
+		r.getBytes()
+		priv := &sshReader{b: r.getBytes()}
+		if priv.getUint32() != priv.getUint32() {
+			return nil, errors.New("invalid OpenSSH key")
+		}
+		if priv.getString() == "ssh-ed25519" {
+			priv.getBytes()
+			k := priv.getBytes()
+			if !priv.short && len(k) == ed25519.PrivateKeySize {
+				return ed25519.PrivateKey(k), nil
+			}
+		}
+	}
+	return nil, errors.New("not an ed25519 key")
+}
+
+func hostKeyBlob() []byte {
+	var w sshWriter
+	w.putString("ssh-ed25519")
+	w.putBytes(sshHostKey.Public().(ed25519.PublicKey))
+	return w
+}
+
+// keyFingerprint formats a public key the way ssh-keygen -l does.
+func keyFingerprint(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// authorizedKey reports whether the public key blob may log in as user.
+// The -authorized-keys file has a line for every key,
+//
+//	name ssh-ed25519 AAAA... [comment]
+//
+// that is a line of an OpenSSH authorized_keys file without options,
+// preceded by the name of the user from the -users file. The file is
+// read at every login, so it can be changed without a restart.
+func authorizedKey(user string, blob []byte) bool {
+	if authorizedKeysFile == "" {
+		return false
+	}
+	data, err := os.ReadFile(authorizedKeysFile)
+	if err != nil {
+		log.Printf("sftp: %v", err)
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != user {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[2])
+		if err == nil && subtle.ConstantTimeCompare(key, blob) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature checks a signature made with the private key of a
+// public key blob. algo is the signature algorithm the client named.
+func verifySignature(algo string, blob, sig, data []byte) bool {
+	kr := &sshReader{b: blob}
+	keyType := kr.getString()
+	sr := &sshReader{b: sig}
+	if sr.getString() != algo {
+		return false
+	}
+	sigBlob := sr.getBytes()
+	if sr.short {
+		return false
+	}
+	switch {
+	case keyType == "ssh-ed25519" && algo == keyType:
+		pub := kr.getBytes()
+		return !kr.short && len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, data, sigBlob)
+	case keyType == "ssh-rsa" && (algo == "rsa-sha2-256" || algo == "rsa-sha2-512"):
+		e, n := kr.getBigInt(), kr.getBigInt()
+		if kr.short || !e.IsInt64() || e.Int64() > 1<<31 || n.BitLen() < 2048 {
+			return false
+		}
+		pub := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if algo == "rsa-sha2-256" {
+			sum := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sigBlob) == nil
+		}
+		sum := sha512.Sum512(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA512, sum[:], sigBlob) == nil
+	case strings.HasPrefix(keyType, "ecdsa-sha2-") && algo == keyType:
+		var curve elliptic.Curve
+		var digest []byte
+		switch kr.getString() {
+		case "nistp256":
+			curve, digest = elliptic.P256(), sha256Sum(data)
+		case "nistp384":
+			sum := sha512.Sum384(data)
+			curve, digest = elliptic.P384(), sum[:]
+		case "nistp521":
+			sum := sha512.Sum512(data)
+			curve, digest = elliptic.P521(), sum[:]
+		default:
+			return false
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, kr.getBytes())
+		if err != nil || kr.short {
+			return false
+		}
+		rs := &sshReader{b: sigBlob}
+		r, s := rs.getBigInt(), rs.getBigInt()
+		return !rs.short && ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// packetCipher reads and writes the binary packets of one direction of
+// a connection.
+type packetCipher interface {
+	writePacket(w io.Writer, seq uint32, payload []byte) error
+	readPacket(r io.Reader, seq uint32) ([]byte, error)
+}
+
+// padPacket returns padding_length || payload || padding, padded so that
+// its length plus extra is a multiple of block.
+func padPacket(payload []byte, block, extra int) []byte {
+	padding := block - (extra+1+len(payload))%block
+	if padding < 4 {
+		padding += block
+	}
+	b := make([]byte, 1+len(payload)+padding)
+	b[0] = byte(padding)
+	copy(b[1:], payload)
+	rand.Read(b[1+len(payload):])
+	return b
+}
+
+// unpadPacket returns the payload of padding_length || payload || padding.
+func unpadPacket(b []byte) ([]byte, error) {
+	if len(b) < 5 || int(b[0]) < 4 || int(b[0]) > len(b)-2 {
+		return nil, errSSHProtocol
+	}
+	return b[1 : len(b)-int(b[0])], nil
+}
+
+func readLength(r io.Reader, block int) ([]byte, uint32, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(head)
+	if n > sshMaxPacket || n%uint32(block) != 0 || n < 8 {
+		return nil, 0, errSSHProtocol
+	}
+	return head, n, nil
+}
+
+// noneCipher is used until the first key exchange is done.
+type noneCipher struct{}
+
+func (noneCipher) writePacket(w io.Writer, seq uint32, payload []byte) error {
+	b := padPacket(payload, 8, 4)
+	_, err := w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...))
+	return err
+}
+
+func (noneCipher) readPacket(r io.Reader, seq uint32) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head)
+	if n > sshMaxPacket || n < 5 {
+		return nil, errSSHProtocol
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return unpadPacket(b)
+}
+
+// gcmCipher implements aes*-gcm@openssh.com (RFC 5647): the length is
+// authenticated but not encrypted, and the nonce counts packets.
+type gcmCipher struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func (c *gcmCipher) incNonce() {
+	for i := len(c.nonce) - 1; i >= 4; i-- {
+		if c.nonce[i]++; c.nonce[i] != 0 {
+			break
+		}
+	}
+}
+
+func (c *gcmCipher) writePacket(w io.Writer, seq uint32, payload []byte) error {
+	b := padPacket(payload, aes.BlockSize, 0)
+	head := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	out := c.aead.Seal(head, c.nonce, b, head)
+	c.incNonce()
+	_, err := w.Write(out)
+	return err
+}
+
+func (c *gcmCipher) readPacket(r io.Reader, seq uint32) ([]byte, error) {
+	head, n, err := readLength(r, aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, int(n)+c.aead.Overhead())
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	b, err = c.aead.Open(b[:0], c.nonce, b, head)
+	if err != nil {
+		return nil, errSSHMAC
+	}
+	c.incNonce()
+	return unpadPacket(b)
+}
+
+// ctrCipher implements aes*-ctr with hmac-sha2-256, which is computed
+// over the plain packet, or with hmac-sha2-256-etm@openssh.com over the
+// encrypted one, whose length is then sent in the clear.
+type ctrCipher struct {
+	stream cipher.Stream
+	mac    hash.Hash
+	etm    bool
+}
+
+func (c *ctrCipher) sum(seq uint32, parts ...[]byte) []byte {
+	c.mac.Reset()
+	c.mac.Write(binary.BigEndian.AppendUint32(nil, seq))
+	for _, p := range parts {
+		c.mac.Write(p)
+	}
+	return c.mac.Sum(nil)
+}
+
+func (c *ctrCipher) writePacket(w io.Writer, seq uint32, payload []byte) error {
+	var out []byte
+	if c.etm {
+		b := padPacket(payload, aes.BlockSize, 0)
+		head := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+		c.stream.XORKeyStream(b, b)
+		out = append(append(head, b...), c.sum(seq, head, b)...)
+	} else {
+		b := padPacket(payload, aes.BlockSize, 4)
+		b = append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+		mac := c.sum(seq, b)
+		c.stream.XORKeyStream(b, b)
+		out = append(b, mac...)
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+func (c *ctrCipher) readPacket(r io.Reader, seq uint32) ([]byte, error) {
+	var b, mac []byte
+	if c.etm {
+		head, n, err := readLength(r, aes.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+		b = make([]byte, int(n)+c.mac.Size())
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		b, mac = b[:n], b[n:]
+		if !hmac.Equal(mac, c.sum(seq, head, b)) {
+			return nil, errSSHMAC
+		}
+		c.stream.XORKeyStream(b, b)
+		return unpadPacket(b)
+	}
+	first := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, err
+	}
+	c.stream.XORKeyStream(first, first)
+	n := binary.BigEndian.Uint32(first)
+	if n > sshMaxPacket || (n+4)%aes.BlockSize != 0 || n < 12 {
+		return nil, errSSHProtocol
+	}
+	b = make([]byte, 4+int(n)+c.mac.Size())
+	copy(b, first)
+	if _, err := io.ReadFull(r, b[aes.BlockSize:]); err != nil {
+		return nil, err
+	}
+	b, mac = b[:4+n], b[4+n:]
+	c.stream.XORKeyStream(b[aes.BlockSize:], b[aes.BlockSize:])
+	if !hmac.Equal(mac, c.sum(seq, b)) {
+		return nil, errSSHMAC
+	}
+	return unpadPacket(b[4:])
+}
+
+// newPacketCipher sets up a negotiated cipher. keys derives the key
+// material for the letters of RFC 4253 section 7.2: iv, key and mac.
+func newPacketCipher(algo, mac string, keys func(letter byte, n int) []byte, iv, key, macKey byte) (packetCipher, error) {
+	size := map[string]int{
+		"aes128-gcm@openssh.com": 16, "aes256-gcm@openssh.com": 32,
+		"aes128-ctr": 16, "aes192-ctr": 24, "aes256-ctr": 32,
+	}[algo]
+	block, err := aes.NewCipher(keys(key, size))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(algo, "-gcm@openssh.com") {
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return &gcmCipher{aead: aead, nonce: keys(iv, 12)}, nil
+	}
+	return &ctrCipher{
+		stream: cipher.NewCTR(block, keys(iv, aes.BlockSize)),
+		mac:    hmac.New(sha256.New, keys(macKey, sha256.Size)),
+		etm:    mac == "hmac-sha2-256-etm@openssh.com",
+	}, nil
+}
+
+// sshConn is a connection of an SSH client.
+type sshConn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	ip            string
+	clientVersion []byte
+	serverVersion []byte
+	sessionID     []byte
+	strict        bool // Strict key exchange, which resets sequence numbers
+
+	in    packetCipher
+	inSeq uint32
+
+	wmu    sync.Mutex // Guards the fields below and writes
+	out    packetCipher
+	outSeq uint32
+	kexing bool       // A key exchange is running, other messages must wait
+	kexed  *sync.Cond // Signalled when the key exchange ends
+
+	user         *account
+	authFailures int
+
+	chmu     sync.Mutex
+	channels map[uint32]*sshChannel
+	nextID   uint32
+}
+
+// serveSSH accepts SSH connections on l.
+func serveSSH(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Printf("sftp: %v", err)
+			return
+		}
+		c := &sshConn{
+			conn:     conn,
+			r:        bufio.NewReader(conn),
+			in:       noneCipher{},
+			out:      noneCipher{},
+			channels: make(map[uint32]*sshChannel),
+		}
+		c.kexed = sync.NewCond(&c.wmu)
+		c.ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+		go c.serve()
+	}
+}
+
+func (c *sshConn) serve() {
+	defer c.conn.Close()
+	defer c.closeChannels()
+	c.conn.SetDeadline(time.Now().Add(sshAuthTimeout))
+	err := c.handshake()
+	for err == nil {
+		var p []byte
+		if p, err = c.readPacket(); err == nil {
+			err = c.handle(p)
+		}
+	}
+	if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		if err == errSSHProtocol {
+			c.disconnect(2, "protocol error")
+		}
+		log.Printf("sftp %s: %v", c.ip, err)
+	}
+}
+
+// handshake exchanges versions and keys.
+func (c *sshConn) handshake() error {
+	c.serverVersion = []byte("SSH-2.0-" + NAME + "_" + VERSION)
+	if _, err := c.conn.Write(append(c.serverVersion, '\r', '\n')); err != nil {
+		return err
+	}
+	// Lines before the version are allowed, RFC 4253 section 4.2.
+	for lines := 0; ; lines++ {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil || lines > 20 {
+			return errors.New("ssh: no version received")
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			if !bytes.HasPrefix(line, []byte("SSH-2.0-")) && !bytes.HasPrefix(line, []byte("SSH-1.99-")) {
+				return fmt.Errorf("ssh: unsupported version %q", line)
+			}
+			c.clientVersion = append([]byte(nil), line...)
+			break
+		}
+	}
+	return c.keyExchange(nil)
+}
+
+// readPacket reads the next packet. Messages that may come at any time
+// and carry nothing are skipped.
+func (c *sshConn) readPacket() ([]byte, error) {
+	for {
+		p, err := c.in.readPacket(c.r, c.inSeq)
+		if err != nil {
+			return nil, err
+		}
+		c.inSeq++
+		if len(p) == 0 {
+			return nil, errSSHProtocol
+		}
+		switch p[0] {
+		case msgIgnore, msgDebug, msgUnimplemented:
+			if c.sessionID == nil && c.strict {
+				return nil, errSSHProtocol
+			}
+			continue
+		case msgDisconnect:
+			return nil, io.EOF
+		}
+		return p, nil
+	}
+}
+
+// writePacket sends a message, waiting while keys are exchanged.
+func (c *sshConn) writePacket(p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for c.kexing {
+		c.kexed.Wait()
+	}
+	return c.writeLocked(p)
+}
+
+func (c *sshConn) writeLocked(p []byte) error {
+	err := c.out.writePacket(c.conn, c.outSeq, p)
+	c.outSeq++
+	return err
+}
+
+func (c *sshConn) disconnect(reason uint32, message string) {
+	var w sshWriter
+	w.putByte(msgDisconnect)
+	w.putUint32(reason)
+	w.putString(message)
+	w.putString("")
+	c.wmu.Lock()
+	c.writeLocked(w)
+	c.wmu.Unlock()
+}
+
+// kexAlgorithms are the algorithms a key exchange agreed on.
+type kexAlgorithms struct {
+	kex, cipherIn, cipherOut, macIn, macOut string
+}
+
+// choose returns the first algorithm of the client that the server
+// supports, RFC 4253 section 7.1.
+func choose(client, server []string) (string, error) {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("ssh: no common algorithm in %s", strings.Join(client, ","))
+}
+
+// keyExchange runs a curve25519-sha256 key exchange (RFC 8731).
+// clientInit is the client's KEXINIT if it started a new exchange, nil
+// at the start of the connection.
+func (c *sshConn) keyExchange(clientInit []byte) error {
+	first := c.sessionID == nil
+	var w sshWriter
+	w.putByte(msgKexInit)
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	w = append(w, cookie...)
+	kexAlgos := sshKexAlgos
+	if first {
+		kexAlgos = append(kexAlgos[:len(kexAlgos):len(kexAlgos)], "kex-strict-s-v00@openssh.com")
+	}
+	w.putList(kexAlgos)
+	w.putString("ssh-ed25519")
+	w.putList(sshCipherAlgos)
+	w.putList(sshCipherAlgos)
+	w.putList(sshMACAlgos)
+	w.putList(sshMACAlgos)
+	w.putString("none")
+	w.putString("none")
+	w.putString("")
+	w.putString("")
+	w.putBool(false)
+	w.putUint32(0)
+	serverInit := []byte(w)
+
+	c.wmu.Lock()
+	c.kexing = true
+	err := c.writeLocked(serverInit)
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	if clientInit == nil {
+		if clientInit, err = c.readPacket(); err != nil {
+			return err
+		}
+		if clientInit[0] != msgKexInit {
+			return errSSHProtocol
+		}
+	}
+
+	if len(clientInit) < 17 {
+		return errSSHProtocol
+	}
+	r := &sshReader{b: clientInit[17:]}
+	var lists [10][]string
+	for i := range lists {
+		lists[i] = r.getList()
+	}
+	guessFollows := r.getBool()
+	if r.short {
+		return errSSHProtocol
+	}
+	var algos kexAlgorithms
+	if algos.kex, err = choose(lists[0], sshKexAlgos); err != nil {
+		return err
+	}
+	if _, err = choose(lists[1], []string{"ssh-ed25519"}); err != nil {
+		return err
+	}
+	if algos.cipherIn, err = choose(lists[2], sshCipherAlgos); err != nil {
+		return err
+	}
+	if algos.cipherOut, err = choose(lists[3], sshCipherAlgos); err != nil {
+		return err
+	}
+	if algos.macIn, err = choose(lists[4], sshMACAlgos); err != nil {
+		return err
+	}
+	if algos.macOut, err = choose(lists[5], sshMACAlgos); err != nil {
+		return err
+	}
+	if _, err = choose(lists[6], []string{"none"}); err != nil {
+		return err
+	}
+	if _, err = choose(lists[7], []string{"none"}); err != nil {
+		return err
+	}
+	extInfo := false
+	if first {
+		for _, a := range lists[0] {
+			c.strict = c.strict || a == "kex-strict-c-v00@openssh.com"
+			extInfo = extInfo || a == "ext-info-c"
+		}
+	}
+	if guessFollows && (lists[0][0] != algos.kex || lists[1][0] != "ssh-ed25519") {
+		// The client guessed wrong, drop its first key exchange message.
+		if _, err := c.readPacket(); err != nil {
+			return err
+		}
+	}
+
+	p, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	r = &sshReader{b: p[1:]}
+	clientPublic := r.getBytes()
+	if p[0] != msgKexECDHInit || r.short {
+		return errSSHProtocol
+	}
+	peer, err := ecdh.X25519().NewPublicKey(clientPublic)
+	if err != nil {
+		return err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return err
+	}
+	serverPublic := private.PublicKey().Bytes()
+	hostKey := hostKeyBlob()
+
+	var h sshWriter
+	h.putBytes(c.clientVersion)
+	h.putBytes(c.serverVersion)
+	h.putBytes(clientInit)
+	h.putBytes(serverInit)
+	h.putBytes(hostKey)
+	h.putBytes(clientPublic)
+	h.putBytes(serverPublic)
+	h.putMpint(secret)
+	exchangeHash := sha256Sum(h)
+	if first {
+		c.sessionID = exchangeHash
+	}
+	keys := deriveKeys(secret, exchangeHash, c.sessionID)
+	in, err := newPacketCipher(algos.cipherIn, algos.macIn, keys, 'A', 'C', 'E')
+	if err != nil {
+		return err
+	}
+	out, err := newPacketCipher(algos.cipherOut, algos.macOut, keys, 'B', 'D', 'F')
+	if err != nil {
+		return err
+	}
+
+	var sig sshWriter
+	sig.putString("ssh-ed25519")
+	sig.putBytes(ed25519.Sign(sshHostKey, exchangeHash))
+	var reply sshWriter
+	reply.putByte(msgKexECDHReply)
+	reply.putBytes(hostKey)
+	reply.putBytes(serverPublic)
+	reply.putBytes(sig)
+	c.wmu.Lock()
+	err = c.writeLocked(reply)
+	if err == nil {
+		err = c.writeLocked([]byte{msgNewKeys})
+	}
+	c.out = out
+	if c.strict {
+		c.outSeq = 0
+	}
+	if err == nil && extInfo {
+		var ext sshWriter
+		ext.putByte(msgExtInfo)
+		ext.putUint32(1)
+		ext.putString("server-sig-algs")
+		ext.putList(sshSigAlgos)
+		err = c.writeLocked(ext)
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if p, err = c.readPacket(); err != nil {
+		return err
+	}
+	if p[0] != msgNewKeys {
+		return errSSHProtocol
+	}
+	c.in = in
+	if c.strict {
+		c.inSeq = 0
+	}
+	c.wmu.Lock()
+	c.kexing = false
+	c.kexed.Broadcast()
+	c.wmu.Unlock()
+	return nil
+}
+
+// deriveKeys returns the key derivation of RFC 4253 section 7.2 for a
+// shared secret and exchange hash, for newPacketCipher.
+func deriveKeys(secret, exchangeHash, sessionID []byte) func(letter byte, n int) []byte {
+	var K sshWriter
+	K.putMpint(secret)
+	return func(letter byte, n int) []byte {
+		var out []byte
+		sum := sha256Sum(bytes.Join([][]byte{K, exchangeHash, {letter}, sessionID}, nil))
+		for {
+			out = append(out, sum...)
+			if len(out) >= n {
+				return out[:n]
+			}
+			sum = sha256Sum(bytes.Join([][]byte{K, exchangeHash, out}, nil))
+		}
+	}
+}
+
+// handle handles a message after the first key exchange.
+func (c *sshConn) handle(p []byte) error {
+	r := &sshReader{b: p[1:]}
+	switch {
+	case p[0] == msgKexInit:
+		return c.keyExchange(p)
+	case p[0] == msgServiceRequest:
+		if service := r.getString(); service != "ssh-userauth" || c.user != nil {
+			c.disconnect(7, "service not available")
+			return fmt.Errorf("ssh: service %q requested", service)
+		}
+		var w sshWriter
+		w.putByte(msgServiceAccept)
+		w.putString("ssh-userauth")
+		return c.writePacket(w)
+	case p[0] == msgUserAuthRequest:
+		if c.user != nil {
+			return nil // Later requests are ignored, RFC 4252 section 5.1.
+		}
+		return c.userAuth(r)
+	case c.user == nil:
+		return errSSHProtocol
+	case p[0] == msgGlobalRequest:
+		r.getString()
+		if r.getBool() {
+			return c.writePacket([]byte{msgRequestFailure})
+		}
+		return nil
+	case p[0] == msgChannelOpen:
+		return c.openChannel(r)
+	case p[0] >= msgChannelWindowAdjust && p[0] <= msgChannelFailure:
+		c.chmu.Lock()
+		ch := c.channels[r.getUint32()]
+		c.chmu.Unlock()
+		if ch == nil {
+			return errSSHProtocol
+		}
+		return ch.handle(p[0], r)
+	}
+	var w sshWriter
+	w.putByte(msgUnimplemented)
+	w.putUint32(c.inSeq - 1)
+	return c.writePacket(w)
+}
+
+// userAuth handles a login attempt, RFC 4252.
+func (c *sshConn) userAuth(r *sshReader) error {
+	name, service, method := r.getString(), r.getString(), r.getString()
+	if r.short {
+		return errSSHProtocol
+	}
+	var user *account
+	var err error
+	switch method {
+	case "password":
+		r.getBool()
+		password := r.getString()
+		if user, err = login(name, password); err != nil {
+			audit(auditEvent{Action: "auth.failure", User: name, IP: c.ip, Detail: "sftp password: " + err.Error()})
+		}
+	case "publickey":
+		hasSig, algo, blob := r.getBool(), r.getString(), r.getBytes()
+		sig := r.getBytes()
+		if r.short && hasSig {
+			return errSSHProtocol
+		}
+		if !authorizedKey(name, blob) || userByName(name) == nil {
+			if hasSig {
+				audit(auditEvent{Action: "auth.failure", User: name, IP: c.ip, Detail: "sftp public key not authorized"})
+			}
+			break
+		}
+		if !hasSig {
+			var w sshWriter
+			w.putByte(msgUserAuthPKOK)
+			w.putString(algo)
+			w.putBytes(blob)
+			return c.writePacket(w)
+		}
+		var data sshWriter
+		data.putBytes(c.sessionID)
+		data.putByte(msgUserAuthRequest)
+		data.putString(name)
+		data.putString(service)
+		data.putString("publickey")
+		data.putBool(true)
+		data.putString(algo)
+		data.putBytes(blob)
+		if verifySignature(algo, blob, sig, data) {
+			user = userByName(name)
+		} else {
+			audit(auditEvent{Action: "auth.failure", User: name, IP: c.ip, Detail: "sftp public key: invalid signature"})
+		}
+	}
+	if user != nil && service == "ssh-connection" {
+		c.user = user
+		c.conn.SetDeadline(time.Time{})
+		return c.writePacket([]byte{msgUserAuthSuccess})
+	}
+	if method != "none" {
+		if c.authFailures++; c.authFailures > sshMaxAuthTries {
+			c.disconnect(14, "too many authentication failures")
+			return errors.New("ssh: too many authentication failures")
+		}
+	}
+	var w sshWriter
+	w.putByte(msgUserAuthFailure)
+	methods := []string{"password"}
+	if authorizedKeysFile != "" {
+		methods = []string{"publickey", "password"}
+	}
+	w.putList(methods)
+	w.putBool(false)
+	return c.writePacket(w)
+}
+
+// openChannel handles a CHANNEL_OPEN. Only sessions are accepted.
+func (c *sshConn) openChannel(r *sshReader) error {
+	kind, peer, window, maxPacket := r.getString(), r.getUint32(), r.getUint32(), r.getUint32()
+	if r.short {
+		return errSSHProtocol
+	}
+	var w sshWriter
+	if kind != "session" {
+		w.putByte(msgChannelOpenFailure)
+		w.putUint32(peer)
+		w.putUint32(3) // SSH_OPEN_UNKNOWN_CHANNEL_TYPE
+		w.putString("only sessions are supported")
+		w.putString("")
+		return c.writePacket(w)
+	}
+	if maxPacket < sshMinPacket {
+		// Data would have to go out in tiny packets, or, below one
+		// byte, not at all.
+		w.putByte(msgChannelOpenFailure)
+		w.putUint32(peer)
+		w.putUint32(1) // SSH_OPEN_ADMINISTRATIVELY_PROHIBITED
+		w.putString("maximum packet size too small")
+		w.putString("")
+		return c.writePacket(w)
+	}
+	ch := &sshChannel{c: c, peer: peer, window: sshWindow, peerWindow: window, peerMaxPacket: maxPacket}
+	ch.cond = sync.NewCond(&ch.mu)
+	if ch.peerMaxPacket > sshMaxPacket-1024 {
+		ch.peerMaxPacket = sshMaxPacket - 1024
+	}
+	c.chmu.Lock()
+	ch.id = c.nextID
+	c.nextID++
+	c.channels[ch.id] = ch
+	c.chmu.Unlock()
+	w.putByte(msgChannelOpenConfirm)
+	w.putUint32(peer)
+	w.putUint32(ch.id)
+	w.putUint32(sshWindow)
+	w.putUint32(sshChannelPacket)
+	return c.writePacket(w)
+}
+
+// closeChannels wakes up everything waiting on a channel when the
+// connection ends.
+func (c *sshConn) closeChannels() {
+	c.chmu.Lock()
+	defer c.chmu.Unlock()
+	for id, ch := range c.channels {
+		ch.mu.Lock()
+		ch.closed, ch.sentClose = true, true
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+		delete(c.channels, id)
+	}
+	c.wmu.Lock()
+	c.kexing = false
+	c.kexed.Broadcast()
+	c.wmu.Unlock()
+}
+
+// sshChannel is a session channel, read and written by its subsystem.
+type sshChannel struct {
+	c    *sshConn
+	id   uint32
+	peer uint32
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	in            []byte // Data received but not read yet
+	eof           bool   // The client sent EOF
+	closed        bool   // The client closed the channel
+	window        uint32 // Bytes the client may still send
+	consumed      uint32 // Bytes read since the last window adjustment
+	peerWindow    uint32 // Bytes we may still send
+	peerMaxPacket uint32
+	started       bool
+	sentClose     bool
+}
+
+func (ch *sshChannel) handle(msg byte, r *sshReader) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	switch msg {
+	case msgChannelWindowAdjust:
+		n := r.getUint32()
+		if ch.peerWindow+n < ch.peerWindow {
+			// The window may not grow beyond 2^32-1 bytes, RFC 4254
+			// section 5.2.
+			log.Printf("sftp %s: channel window overflow", ch.c.ip)
+			return ch.closeLocked()
+		}
+		ch.peerWindow += n
+		ch.cond.Broadcast()
+	case msgChannelData, msgChannelExtendedData:
+		if msg == msgChannelExtendedData {
+			r.getUint32()
+		}
+		data := r.getBytes()
+		if r.short || uint32(len(data)) > ch.window {
+			return errSSHProtocol
+		}
+		ch.window -= uint32(len(data))
+		if msg == msgChannelData {
+			ch.in = append(ch.in, data...)
+		} else {
+			ch.consumed += uint32(len(data))
+		}
+		ch.cond.Broadcast()
+	case msgChannelEOF:
+		ch.eof = true
+		ch.cond.Broadcast()
+	case msgChannelClose:
+		return ch.closeLocked()
+	case msgChannelRequest:
+		kind, wantReply := r.getString(), r.getBool()
+		ok := false
+		if kind == "subsystem" && r.getString() == "sftp" && !ch.started {
+			ch.started, ok = true, true
+			go func() {
+				newSFTPServer(ch, ch.c.user, ch.c.ip).serve()
+				ch.Close()
+			}()
+		}
+		if wantReply {
+			reply := msgChannelFailure
+			if ok {
+				reply = msgChannelSuccess
+			}
+			return ch.c.writePacket(ch.message(byte(reply)))
+		}
+	case msgChannelSuccess, msgChannelFailure:
+		// We never send requests.
+	}
+	return nil
+}
+
+// closeLocked closes the channel for good, when the client closed it or
+// broke its rules. ch.mu is held.
+func (ch *sshChannel) closeLocked() error {
+	ch.closed = true
+	ch.cond.Broadcast()
+	ch.c.chmu.Lock()
+	delete(ch.c.channels, ch.id)
+	ch.c.chmu.Unlock()
+	if !ch.sentClose {
+		ch.sentClose = true
+		return ch.c.writePacket(ch.message(msgChannelClose))
+	}
+	return nil
+}
+
+// message starts a message to the client about this channel.
+func (ch *sshChannel) message(msg byte) sshWriter {
+	var w sshWriter
+	w.putByte(msg)
+	w.putUint32(ch.peer)
+	return w
+}
+
+func (ch *sshChannel) Read(p []byte) (int, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for len(ch.in) == 0 && !ch.eof && !ch.closed {
+		ch.cond.Wait()
+	}
+	if len(ch.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, ch.in)
+	ch.in = ch.in[n:]
+	ch.consumed += uint32(n)
+	if ch.consumed >= sshWindow/2 && !ch.closed {
+		w := ch.message(msgChannelWindowAdjust)
+		w.putUint32(ch.consumed)
+		ch.window += ch.consumed
+		ch.consumed = 0
+		if err := ch.c.writePacket(w); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (ch *sshChannel) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		ch.mu.Lock()
+		for ch.peerWindow == 0 && !ch.closed {
+			ch.cond.Wait()
+		}
+		if ch.closed {
+			ch.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := min(uint32(len(p)), ch.peerWindow, ch.peerMaxPacket)
+		ch.peerWindow -= n
+		ch.mu.Unlock()
+		w := ch.message(msgChannelData)
+		w.putBytes(p[:n])
+		if err := ch.c.writePacket(w); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close sends EOF and closes the channel.
+func (ch *sshChannel) Close() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.sentClose {
+		return nil
+	}
+	ch.sentClose = true
+	ch.c.writePacket(ch.message(msgChannelEOF))
+	return ch.c.writePacket(ch.message(msgChannelClose))
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testKeys derives made up but distinct keys for every letter.
+func testKeys(letter byte, n int) []byte {
+	return bytes.Repeat([]byte{letter}, n)
+}
+
+func TestPacketCiphers(t *testing.T) {
+	for _, tc := range []struct{ algo, mac string }{
+		{"aes128-gcm@openssh.com", ""},
+		{"aes256-gcm@openssh.com", ""},
+		{"aes128-ctr", "hmac-sha2-256"},
+		{"aes256-ctr", "hmac-sha2-256"},
+		{"aes128-ctr", "hmac-sha2-256-etm@openssh.com"},
+		{"aes192-ctr", "hmac-sha2-256-etm@openssh.com"},
+	} {
+		t.Run(tc.algo+" "+tc.mac, func(t *testing.T) {
+			// Both ends of one direction, starting from the same keys.
+			pair := func() (w, r packetCipher) {
+				w, err := newPacketCipher(tc.algo, tc.mac, testKeys, 'A', 'C', 'E')
+				if err != nil {
+					t.Fatal(err)
+				}
+				r, err = newPacketCipher(tc.algo, tc.mac, testKeys, 'A', 'C', 'E')
+				if err != nil {
+					t.Fatal(err)
+				}
+				return w, r
+			}
+
+			w, r := pair()
+			var buf bytes.Buffer
+			payloads := [][]byte{{msgIgnore}, bytes.Repeat([]byte("x"), 1000), make([]byte, 31), make([]byte, 32)}
+			for i, p := range payloads {
+				if err := w.writePacket(&buf, uint32(i), p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, p := range payloads {
+				got, err := r.readPacket(&buf, uint32(i))
+				if err != nil {
+					t.Fatalf("packet %d: %v", i, err)
+				}
+				if !bytes.Equal(got, p) {
+					t.Fatalf("packet %d: got %x, want %x", i, got, p)
+				}
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes left over", buf.Len())
+			}
+
+			// Changing any byte after the length is caught by the MAC.
+			payload := bytes.Repeat([]byte("payload"), 20)
+			buf.Reset()
+			w.writePacket(&buf, 0, payload)
+			for _, i := range []int{4, 20, buf.Len() / 2, buf.Len() - 1} {
+				w, r := pair()
+				var buf bytes.Buffer
+				w.writePacket(&buf, 7, payload)
+				packet := buf.Bytes()
+				packet[i] ^= 1
+				if _, err := r.readPacket(&buf, 7); err == nil {
+					t.Errorf("packet changed at %d accepted", i)
+				} else if i >= 16 && !errors.Is(err, errSSHMAC) {
+					t.Errorf("packet changed at %d: %v, want %v", i, err, errSSHMAC)
+				}
+			}
+
+			// A replayed packet doesn't pass for the next one.
+			w, r = pair()
+			buf.Reset()
+			w.writePacket(&buf, 0, payload)
+			packet := bytes.Clone(buf.Bytes())
+			if _, err := r.readPacket(&buf, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.readPacket(bytes.NewReader(packet), 1); err == nil {
+				t.Error("replayed packet accepted")
+			}
+
+			// Neither does a packet out of sequence, with the MAC over
+			// the sequence number.
+			if tc.mac != "" {
+				w, r := pair()
+				buf.Reset()
+				w.writePacket(&buf, 3, payload)
+				if _, err := r.readPacket(&buf, 4); !errors.Is(err, errSSHMAC) {
+					t.Errorf("packet out of sequence: %v, want %v", err, errSSHMAC)
+				}
+			}
+		})
+	}
+}
+
+func TestPacketFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range [][]byte{{msgNewKeys}, bytes.Repeat([]byte{1}, 300)} {
+		buf.Reset()
+		if err := (noneCipher{}).writePacket(&buf, 0, p); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len()%8 != 0 {
+			t.Errorf("packet of %d bytes not padded to 8", buf.Len())
+		}
+		got, err := (noneCipher{}).readPacket(&buf, 0)
+		if err != nil || !bytes.Equal(got, p) {
+			t.Errorf("got %x, %v, want %x", got, err, p)
+		}
+	}
+	for name, packet := range map[string][]byte{
+		"too long":        {0x00, 0x10, 0x00, 0x00},
+		"too short":       {0, 0, 0, 4, 4, 1, 2, 3},
+		"padding too big": {0, 0, 0, 8, 7, 1, 2, 3, 4, 5, 6, 7},
+		"little padding":  {0, 0, 0, 8, 3, 1, 2, 3, 4, 5, 6, 7},
+	} {
+		if _, err := (noneCipher{}).readPacket(bytes.NewReader(packet), 0); err != errSSHProtocol {
+			t.Errorf("%s: got %v, want %v", name, err, errSSHProtocol)
+		}
+	}
+	gcm, _ := newPacketCipher("aes128-gcm@openssh.com", "", testKeys, 'A', 'C', 'E')
+	if _, err := gcm.readPacket(bytes.NewReader([]byte{0, 0x10, 0, 0x10}), 0); err != errSSHProtocol {
+		t.Errorf("oversized packet: got %v, want %v", err, errSSHProtocol)
+	}
+	if _, err := gcm.readPacket(bytes.NewReader([]byte{0, 0, 0, 17}), 0); err != errSSHProtocol {
+		t.Errorf("unaligned packet: got %v, want %v", err, errSSHProtocol)
+	}
+}
+
+var testHostKeyOnce sync.Once
+
+// testSSHServer runs the SSH server on a local port. Logins are checked
+// against a user alice whose key it returns.
+func testSSHServer(t *testing.T) (addr string, alice ed25519.PrivateKey) {
+	t.Helper()
+	testHostKeyOnce.Do(func() {
+		_, sshHostKey, _ = ed25519.GenerateKey(rand.Reader)
+	})
+	_, alice, _ = ed25519.GenerateKey(rand.Reader)
+	keys := filepath.Join(t.TempDir(), "authorized_keys")
+	line := "alice ssh-ed25519 " + base64.StdEncoding.EncodeToString(publicKeyBlob(alice)) + " alice@test\n"
+	if err := os.WriteFile(keys, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldAccounts, oldKeys := accounts, authorizedKeysFile
+	accounts = map[string]*account{"alice": {Name: "alice", perms: map[string]bool{permWrite: true}}}
+	authorizedKeysFile = keys
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveSSH(l)
+	t.Cleanup(func() {
+		l.Close()
+		accounts, authorizedKeysFile = oldAccounts, oldKeys
+	})
+	return l.Addr().String(), alice
+}
+
+func publicKeyBlob(key ed25519.PrivateKey) []byte {
+	var w sshWriter
+	w.putString("ssh-ed25519")
+	w.putBytes(key.Public().(ed25519.PublicKey))
+	return w
+}
+
+// sshTestClient is the client end of a connection, made from the same
+// parts as the server, for what real clients can't be made to do.
+type sshTestClient struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	in, out       packetCipher
+	inSeq, outSeq uint32
+	sessionID     []byte
+}
+
+// sshTestOptions change how the test client does the key exchange.
+type sshTestOptions struct {
+	strict  bool // Offer strict key exchange
+	noReset bool // Keep counting packets after NEWKEYS regardless
+	ignore  bool // Send an IGNORE message during the key exchange
+}
+
+func (c *sshTestClient) write(p []byte) error {
+	err := c.out.writePacket(c.conn, c.outSeq, p)
+	c.outSeq++
+	return err
+}
+
+func (c *sshTestClient) read() ([]byte, error) {
+	p, err := c.in.readPacket(c.r, c.inSeq)
+	c.inSeq++
+	if err == nil && len(p) == 0 {
+		err = errSSHProtocol
+	}
+	return p, err
+}
+
+// expect reads a message, which must be of the type msg.
+func (c *sshTestClient) expect(msg byte) (*sshReader, error) {
+	p, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if p[0] != msg {
+		return nil, fmt.Errorf("got message %d, want %d", p[0], msg)
+	}
+	return &sshReader{b: p[1:]}, nil
+}
+
+// dialSSH connects to addr and exchanges keys, agreeing on AES-CTR with
+// HMAC-SHA256, whose MAC covers the sequence numbers.
+func dialSSH(t *testing.T, addr string, opts sshTestOptions) (*sshTestClient, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &sshTestClient{conn: conn, r: bufio.NewReader(conn), in: noneCipher{}, out: noneCipher{}}
+	serverVersion, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	clientVersion := "SSH-2.0-test"
+	if _, err := fmt.Fprintf(conn, "%s\r\n", clientVersion); err != nil {
+		return nil, err
+	}
+	serverInit, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var w sshWriter
+	w.putByte(msgKexInit)
+	w = append(w, make([]byte, 16)...)
+	kex := []string{"curve25519-sha256"}
+	if opts.strict {
+		kex = append(kex, "kex-strict-c-v00@openssh.com")
+	}
+	w.putList(kex)
+	w.putString("ssh-ed25519")
+	w.putString("aes128-ctr")
+	w.putString("aes128-ctr")
+	w.putString("hmac-sha2-256")
+	w.putString("hmac-sha2-256")
+	w.putString("none")
+	w.putString("none")
+	w.putString("")
+	w.putString("")
+	w.putBool(false)
+	w.putUint32(0)
+	clientInit := []byte(w)
+	if err := c.write(clientInit); err != nil {
+		return nil, err
+	}
+	if opts.ignore {
+		if err := c.write([]byte{msgIgnore}); err != nil {
+			return nil, err
+		}
+	}
+	private, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	w = nil
+	w.putByte(msgKexECDHInit)
+	w.putBytes(private.PublicKey().Bytes())
+	if err := c.write(w); err != nil {
+		return nil, err
+	}
+
+	r, err := c.expect(msgKexECDHReply)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, serverPublic, sig := r.getBytes(), r.getBytes(), r.getBytes()
+	peer, err := ecdh.X25519().NewPublicKey(serverPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	var h sshWriter
+	h.putString(clientVersion)
+	h.putString(strings.TrimRight(serverVersion, "\r\n"))
+	h.putBytes(clientInit)
+	h.putBytes(serverInit)
+	h.putBytes(hostKey)
+	h.putBytes(private.PublicKey().Bytes())
+	h.putBytes(serverPublic)
+	h.putMpint(secret)
+	exchangeHash := sha256Sum(h)
+	if !verifySignature("ssh-ed25519", hostKey, sig, exchangeHash) {
+		return nil, errors.New("invalid host key signature")
+	}
+	c.sessionID = exchangeHash
+	keys := deriveKeys(secret, exchangeHash, c.sessionID)
+
+	if _, err := c.expect(msgNewKeys); err != nil {
+		return nil, err
+	}
+	if c.in, err = newPacketCipher("aes128-ctr", "hmac-sha2-256", keys, 'B', 'D', 'F'); err != nil {
+		return nil, err
+	}
+	if opts.strict && !opts.noReset {
+		c.inSeq = 0
+	}
+	if err := c.write([]byte{msgNewKeys}); err != nil {
+		return nil, err
+	}
+	if c.out, err = newPacketCipher("aes128-ctr", "hmac-sha2-256", keys, 'A', 'C', 'E'); err != nil {
+		return nil, err
+	}
+	if opts.strict && !opts.noReset {
+		c.outSeq = 0
+	}
+	return c, nil
+}
+
+// startAuth asks for the user authentication service.
+func (c *sshTestClient) startAuth() error {
+	var w sshWriter
+	w.putByte(msgServiceRequest)
+	w.putString("ssh-userauth")
+	if err := c.write(w); err != nil {
+		return err
+	}
+	_, err := c.expect(msgServiceAccept)
+	return err
+}
+
+// publicKeyAuth logs in as user with a signature made by key over the
+// data of RFC 4252 section 7 for signed's user and session ID. It
+// returns the server's reply.
+func (c *sshTestClient) publicKeyAuth(user string, key ed25519.PrivateKey, blob []byte, signedUser string, sessionID []byte) (byte, error) {
+	var data sshWriter
+	data.putBytes(sessionID)
+	data.putByte(msgUserAuthRequest)
+	data.putString(signedUser)
+	data.putString("ssh-connection")
+	data.putString("publickey")
+	data.putBool(true)
+	data.putString("ssh-ed25519")
+	data.putBytes(blob)
+	var sig sshWriter
+	sig.putString("ssh-ed25519")
+	sig.putBytes(ed25519.Sign(key, data))
+
+	var w sshWriter
+	w.putByte(msgUserAuthRequest)
+	w.putString(user)
+	w.putString("ssh-connection")
+	w.putString("publickey")
+	w.putBool(true)
+	w.putString("ssh-ed25519")
+	w.putBytes(blob)
+	w.putBytes(sig)
+	if err := c.write(w); err != nil {
+		return 0, err
+	}
+	p, err := c.read()
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func TestSSHStrictKex(t *testing.T) {
+	addr, _ := testSSHServer(t)
+	for _, tc := range []struct {
+		name string
+		opts sshTestOptions
+		ok   bool
+	}{
+		{"strict", sshTestOptions{strict: true}, true},
+		{"strict without reset", sshTestOptions{strict: true, noReset: true}, false},
+		{"strict with ignore", sshTestOptions{strict: true, ignore: true}, false},
+		{"classic", sshTestOptions{}, true},
+		{"classic with ignore", sshTestOptions{ignore: true}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := dialSSH(t, addr, tc.opts)
+			if err == nil {
+				err = c.startAuth()
+			}
+			if ok := err == nil; ok != tc.ok {
+				t.Errorf("got %v, want success %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestSSHPublicKeyBinding(t *testing.T) {
+	addr, alice := testSSHServer(t)
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	for _, tc := range []struct {
+		name       string
+		key        ed25519.PrivateKey
+		signedUser string
+		session    func(c *sshTestClient) []byte
+		want       byte
+	}{
+		{"valid", alice, "alice", func(c *sshTestClient) []byte { return c.sessionID }, msgUserAuthSuccess},
+		{"other session", alice, "alice", func(c *sshTestClient) []byte { return make([]byte, len(c.sessionID)) }, msgUserAuthFailure},
+		{"other user", alice, "bob", func(c *sshTestClient) []byte { return c.sessionID }, msgUserAuthFailure},
+		{"other key", mallory, "alice", func(c *sshTestClient) []byte { return c.sessionID }, msgUserAuthFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := dialSSH(t, addr, sshTestOptions{strict: true})
+			if err == nil {
+				err = c.startAuth()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.publicKeyAuth("alice", tc.key, publicKeyBlob(alice), tc.signedUser, tc.session(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got message %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	// A signature from another connection doesn't log in either.
+	first, err := dialSSH(t, addr, sshTestOptions{strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := dialSSH(t, addr, sshTestOptions{strict: true})
+	if err == nil {
+		err = c.startAuth()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.publicKeyAuth("alice", alice, publicKeyBlob(alice), "alice", first.sessionID); err != nil || got != msgUserAuthFailure {
+		t.Errorf("signature of another session: got message %d, %v", got, err)
+	}
+}
+
+func TestSSHWindowOverflow(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &sshConn{conn: server, in: noneCipher{}, out: noneCipher{}, channels: make(map[uint32]*sshChannel)}
+	c.kexed = sync.NewCond(&c.wmu)
+	ch := &sshChannel{c: c, id: 0, peerWindow: 1000, peerMaxPacket: sshChannelPacket}
+	ch.cond = sync.NewCond(&ch.mu)
+	c.channels[0] = ch
+
+	adjust := func(n uint32) error {
+		var w sshWriter
+		w.putUint32(n)
+		return ch.handle(msgChannelWindowAdjust, &sshReader{b: w})
+	}
+	if err := adjust(1000); err != nil || ch.peerWindow != 2000 {
+		t.Fatalf("window %d, %v, want 2000", ch.peerWindow, err)
+	}
+
+	sent := make(chan []byte, 1)
+	go func() {
+		p, _ := noneCipher{}.readPacket(client, 0)
+		sent <- p
+	}()
+	if err := adjust(1<<32 - 1000); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-sent; len(p) == 0 || p[0] != msgChannelClose {
+		t.Errorf("sent %x, want CHANNEL_CLOSE", p)
+	}
+	if !ch.closed || c.channels[0] != nil {
+		t.Error("channel still open")
+	}
+	if _, err := ch.Write([]byte("data")); err != io.ErrClosedPipe {
+		t.Errorf("write to closed channel: %v", err)
+	}
+}
+
+// Channels whose data would go out in packets of less than
+// sshMinPacket bytes are refused.
+func TestSSHChannelMinPacket(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &sshConn{conn: server, in: noneCipher{}, out: noneCipher{}, channels: make(map[uint32]*sshChannel)}
+	c.kexed = sync.NewCond(&c.wmu)
+
+	for _, test := range []struct {
+		maxPacket uint32
+		reply     byte
+	}{
+		{0, msgChannelOpenFailure},
+		{sshMinPacket - 1, msgChannelOpenFailure},
+		{sshMinPacket, msgChannelOpenConfirm},
+	} {
+		sent := make(chan []byte, 1)
+		go func() {
+			p, _ := noneCipher{}.readPacket(client, 0)
+			sent <- p
+		}()
+		var w sshWriter
+		w.putString("session")
+		w.putUint32(7)
+		w.putUint32(sshWindow)
+		w.putUint32(test.maxPacket)
+		if err := c.openChannel(&sshReader{b: w}); err != nil {
+			t.Fatal(err)
+		}
+		if p := <-sent; len(p) == 0 || p[0] != test.reply {
+			t.Errorf("maximum packet %d: sent %x, want message %d", test.maxPacket, p, test.reply)
+		}
+	}
+	if len(c.channels) != 1 {
+		t.Errorf("%d channels open, want 1", len(c.channels))
+	}
+}
+
+// sftpRequest sends one request to s and returns the reply.
+func sftpRequest(s *sftpServer, kind byte, args ...interface{}) *sshReader {
+	var w sshWriter
+	w.putByte(kind)
+	w.putUint32(1)
+	for _, a := range args {
+		switch a := a.(type) {
+		case string:
+			w.putString(a)
+		case uint32:
+			w.putUint32(a)
+		case uint64:
+			w.putUint64(a)
+		case []byte:
+			w.putBytes(a)
+		}
+	}
+	reply := s.handle(w)
+	return &sshReader{b: reply}
+}
+
+// sftpStatusOf returns the status code of a reply, or -1 if it is
+// something else.
+func sftpStatusOf(r *sshReader) int {
+	if r.getByte() != sftpStatus {
+		return -1
+	}
+	r.getUint32()
+	return int(r.getUint32())
+}
+
+func TestSFTPConfinement(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	for name, content := range map[string]string{
+		"secret.txt":                "outside",
+		"root/inside.txt":           "inside",
+		"root/" + STATEDIR + "/key": "state",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldStorage := storage
+	storage = &localBackend{root: root}
+	t.Cleanup(func() { storage = oldStorage })
+	s := newSFTPServer(nil, &account{Name: "alice", perms: map[string]bool{permWrite: true}}, "test")
+
+	for _, p := range []string{"..", "../..", "/../secret.txt", "../secret.txt", "../../" + filepath.Base(dir) + "/secret.txt"} {
+		r := sftpRequest(s, sftpRealpath, p)
+		r.getByte()
+		r.getUint32()
+		r.getUint32()
+		if got := r.getString(); strings.Contains(got, "..") || !strings.HasPrefix(got, "/") {
+			t.Errorf("realpath %q = %q", p, got)
+		}
+		if code := sftpStatusOf(sftpRequest(s, sftpStat, p)); p != ".." && p != "../.." && code != sftpNoSuchFile {
+			t.Errorf("stat %q: status %d", p, code)
+		}
+		if code := sftpStatusOf(sftpRequest(s, sftpOpen, p, uint32(sftpFlagRead), uint32(0))); code == -1 {
+			t.Errorf("%q opened", p)
+		}
+	}
+	if code := sftpStatusOf(sftpRequest(s, sftpOpen, "../inside.txt", uint32(sftpFlagRead), uint32(0))); code != -1 {
+		t.Errorf("../inside.txt not opened: status %d", code)
+	}
+
+	for _, p := range []string{"/" + STATEDIR, "/" + STATEDIR + "/key", "../" + STATEDIR + "/key"} {
+		if code := sftpStatusOf(sftpRequest(s, sftpStat, p)); code != sftpNoSuchFile {
+			t.Errorf("stat %q: status %d", p, code)
+		}
+		if code := sftpStatusOf(sftpRequest(s, sftpOpen, p, uint32(sftpFlagRead), uint32(0))); code == -1 {
+			t.Errorf("%q opened", p)
+		}
+		if code := sftpStatusOf(sftpRequest(s, sftpOpen, p, uint32(sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc), uint32(0))); code == -1 {
+			t.Errorf("%q opened for writing", p)
+		}
+		if code := sftpStatusOf(sftpRequest(s, sftpRemove, p)); code == sftpOK {
+			t.Errorf("%q removed", p)
+		}
+	}
+	if code := sftpStatusOf(sftpRequest(s, sftpRename, "/inside.txt", "/"+STATEDIR+"/inside.txt")); code == sftpOK {
+		t.Error("moved into the state directory")
+	}
+
+	// Listings leave out the state directory.
+	r := sftpRequest(s, sftpOpendir, "/")
+	r.getByte()
+	r.getUint32()
+	handle := r.getString()
+	r = sftpRequest(s, sftpReaddir, handle)
+	if r.getByte() != sftpName {
+		t.Fatal("no listing")
+	}
+	r.getUint32()
+	for n := r.getUint32(); n > 0; n-- {
+		if name := r.getString(); name == STATEDIR {
+			t.Errorf("%s listed", name)
+		}
+		r.getString()
+		r.getUint32()
+		r.getUint64()
+		r.getUint32()
+		r.getUint32()
+		r.getUint32()
+	}
+
+	// Writing above the root writes to the root.
+	r = sftpRequest(s, sftpOpen, "../escaped.txt", uint32(sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc), uint32(0))
+	if r.getByte() != sftpHandle {
+		t.Fatal("../escaped.txt not opened for writing")
+	}
+	r.getUint32()
+	handle = r.getString()
+	if code := sftpStatusOf(sftpRequest(s, sftpWrite, handle, uint64(0), []byte("data"))); code != sftpOK {
+		t.Fatalf("write: status %d", code)
+	}
+	if code := sftpStatusOf(sftpRequest(s, sftpClose, handle)); code != sftpOK {
+		t.Fatalf("close: status %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); err == nil {
+		t.Error("file written outside the root")
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "escaped.txt")); string(data) != "data" {
+		t.Errorf("escaped.txt in the root: %q, %v", data, err)
+	}
+}
+
+// TestSFTPInterop runs the OpenSSH sftp client against the server, with
+// every cipher and a key exchange every few kilobytes.
+func TestSFTPInterop(t *testing.T) {
+	sftp, err := exec.LookPath("sftp")
+	if err != nil {
+		t.Skip("no sftp client")
+	}
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("no ssh-keygen")
+	}
+	addr, _ := testSSHServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	dir := t.TempDir()
+	key := filepath.Join(dir, "id_ed25519")
+	if out, err := exec.Command(keygen, "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, out)
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(authorizedKeysFile, append([]byte("alice "), pub...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0755)
+	oldStorage := storage
+	storage = &localBackend{root: root}
+	t.Cleanup(func() { storage = oldStorage })
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	local := filepath.Join(dir, "local.bin")
+	if err := os.WriteFile(local, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ name, cipher, mac, rekey string }{
+		{"gcm", "aes128-gcm@openssh.com", "hmac-sha2-256", "default"},
+		{"ctr", "aes256-ctr", "hmac-sha2-256", "default"},
+		{"ctr etm", "aes128-ctr", "hmac-sha2-256-etm@openssh.com", "default"},
+		{"rekey", "aes256-gcm@openssh.com", "hmac-sha2-256", "64K"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			down := filepath.Join(dir, "down-"+tc.cipher)
+			batch := filepath.Join(dir, "batch")
+			commands := fmt.Sprintf("put %s up.bin\nmkdir sub\nrename up.bin sub/up.bin\nls sub\nget sub/up.bin %s\nrm sub/up.bin\nrmdir sub\n", local, down)
+			if err := os.WriteFile(batch, []byte(commands), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(sftp, "-F", "/dev/null", "-b", batch, "-i", key, "-P", port,
+				"-o", "BatchMode=yes", "-o", "IdentitiesOnly=yes",
+				"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR",
+				"-o", "Ciphers="+tc.cipher, "-o", "MACs="+tc.mac, "-o", "RekeyLimit="+tc.rekey,
+				"alice@"+host)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("sftp: %v\n%s", err, out)
+			}
+			if !strings.Contains(string(out), "up.bin") {
+				t.Errorf("sub/up.bin not listed:\n%s", out)
+			}
+			got, err := os.ReadFile(down)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("downloaded %d bytes, %v, want the %d uploaded", len(got), err, len(data))
+			}
+			if _, err := os.Stat(filepath.Join(root, "sub")); !os.IsNotExist(err) {
+				t.Errorf("sub not removed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Backend stores the files being served. Names are cleaned, slash
+// separated paths starting at "/", the root of the backend.
+type Backend interface {
+	// Stat describes a file or directory.
+	Stat(name string) (os.FileInfo, error)
+	// List returns the entries of a directory.
+	List(name string) ([]os.FileInfo, error)
+	// Open opens a file for reading. Seeking is cheap, so ranges can be
+	// read without reading the whole file.
+	Open(name string) (io.ReadSeekCloser, error)
+	// Put stores the local file src at name, replacing any file there
+	// in one step and creating missing parent directories. src is
+	// consumed.
+	Put(name, src string) error
+	// Mkdir creates a directory. It fails if name exists.
+	Mkdir(name string) error
+	// Rename moves a file or directory tree, creating missing parent
+	// directories of the target.
+	Rename(from, to string) error
+	// Copy copies a file or directory tree, creating missing parent
+	// directories of the target.
+	Copy(from, to string) error
+	// RemoveAll deletes a file or directory tree.
+	RemoveAll(name string) error
+}
+
+// linker is implemented by backends that can give a file a second name
+// without copying it.
+type linker interface {
+	Link(from, to string) error
+}
+
+var storage Backend // Backend of the served root, set up by setupStorage
+
+// setupStorage picks the backend for the -d option: an s3:// URL, the
+// bundled docs with embed:, a ZIP or tar file served read-only, or a
+// local directory.
+func setupStorage() error {
+	if strings.HasPrefix(dir, "s3://") {
+		b, err := newS3Backend(dir)
+		if err != nil {
+			return err
+		}
+		storage = b
+		return nil
+	}
+	if dir == "embed:" {
+		docs, _ := fs.Sub(docsFS, "docs")
+		storage = &fsBackend{docs}
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return errors.New("Invalid Path `" + dir + "`. Please specify a valid path.")
+	}
+	if format := archiveFormat(dir); format != "" && !info.IsDir() {
+		f, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		open := func() (io.ReadCloser, error) { return os.Open(dir) }
+		fsys, err := openArchive(format, f, info.Size(), open)
+		if err != nil {
+			return errors.New("Invalid archive `" + dir + "`: " + err.Error())
+		}
+		storage = &fsBackend{fsys}
+		return nil
+	}
+	storage = &localBackend{root: dir}
+	return nil
+}
+
+// readOnlyStorage reports whether files can't be changed.
+func readOnlyStorage() bool {
+	_, ok := storage.(*fsBackend)
+	return ok
+}
+
+// stateDir is the local directory for partial uploads and other
+// temporary files. Unless set with -state-dir, it lies in STATEDIR of
+// a local root, and in the working directory for other backends.
+func stateDir() string {
+	if stateDirFlag != "" {
+		return stateDirFlag
+	}
+	if l, ok := storage.(*localBackend); ok {
+		return filepath.Join(l.root, STATEDIR)
+	}
+	return STATEDIR
+}
+
+// fileSystem returns the backend as an http.FileSystem for serving.
+func fileSystem(b Backend) http.FileSystem {
+	if l, ok := b.(*localBackend); ok {
+		// Serve *os.File directly.
+		return http.Dir(l.root)
+	}
+	return backendFS{b}
+}
+
+// backendFS adapts a Backend to http.FileSystem.
+type backendFS struct {
+	b Backend
+}
+
+func (f backendFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	info, err := f.b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &backendDir{b: f.b, name: name, info: info}, nil
+	}
+	r, err := f.b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &backendFile{r, info}, nil
+}
+
+type backendFile struct {
+	io.ReadSeekCloser
+	info os.FileInfo
+}
+
+func (f *backendFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.info.Name(), Err: syscall.ENOTDIR}
+}
+
+func (f *backendFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// backendDir is an open directory. Its entries are listed on the first
+// call of Readdir.
+type backendDir struct {
+	b       Backend
+	name    string
+	info    os.FileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *backendDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.b.List(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+func (d *backendDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *backendDir) Read([]byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *backendDir) Seek(int64, int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *backendDir) Close() error {
+	return nil
+}
+
+// walkStorage calls fn for name and everything below it, like
+// filepath.Walk. fn may return fs.SkipDir to skip a directory.
+func walkStorage(name string, fn func(name string, info os.FileInfo) error) error {
+	info, err := storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	return walkInfo(name, info, fn)
+}
+
+func walkInfo(name string, info os.FileInfo, fn func(string, os.FileInfo) error) error {
+	err := fn(name, info)
+	if !info.IsDir() || err != nil {
+		if err == fs.SkipDir {
+			err = nil
+		}
+		return err
+	}
+	entries, err := storage.List(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := walkInfo(path.Join(name, e.Name()), e, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tempFile creates a file in the state directory, for data on its way
+// into the backend.
+func tempFile(prefix string) (*os.File, error) {
+	tmp := filepath.Join(stateDir(), "tmp")
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(tmp, prefix)
+}
+
+// putJSON stores v as JSON at name in the backend.
+func putJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := tempFile("json-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = storage.Put(name, f.Name())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// getJSON reads the JSON file at name in the backend into v.
+func getJSON(name string, v interface{}) error {
+	f, err := storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// localBackend stores files in a directory on local disk.
+type localBackend struct {
+	root string
+}
+
+func (l *localBackend) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (l *localBackend) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(l.path(name))
+}
+
+func (l *localBackend) List(name string) ([]os.FileInfo, error) {
+	f, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+func (l *localBackend) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *localBackend) Put(name, src string) error {
+	dst := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		// Copy next to the target first, so that it still appears at
+		// once.
+		tmp := dst + ".tmp-" + newID()
+		if err = copyFile(src, tmp, 0644); err == nil {
+			if err = os.Rename(tmp, dst); err == nil {
+				os.Remove(src)
+			}
+		}
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (l *localBackend) Mkdir(name string) error {
+	return os.Mkdir(l.path(name), 0755)
+}
+
+func (l *localBackend) Rename(from, to string) error {
+	src, dst := l.path(from), l.path(to)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		if err = copyTree(src, dst); err == nil {
+			err = os.RemoveAll(src)
+		}
+	}
+	return err
+}
+
+func (l *localBackend) Copy(from, to string) error {
+	dst := l.path(to)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return copyTree(l.path(from), dst)
+}
+
+func (l *localBackend) Link(from, to string) error {
+	dst := l.path(to)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Link(l.path(from), dst)
+}
+
+func (l *localBackend) RemoveAll(name string) error {
+	return os.RemoveAll(l.path(name))
+}
+
+// fileInfo is an os.FileInfo for backends without one of their own.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.isDir }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+func (f *fileInfo) Mode() os.FileMode {
+	if f.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
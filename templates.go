@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// URL prefix of the custom stylesheet and logo.
+const THEMEPREFIX = "/_theme/"
+
+// Built-in colour themes. The page templates only refer to these CSS
+// variables, so a theme is just a different set of values.
+var themes = map[string]string{
+	"light": `:root {--background: #edece4; --panel: #fff; --border: #d9d8d4; --text: #4d4d4d; --link: #333333; --hover: rgba(243, 243, 243, 0.85); --button-filter: none;}`,
+	"dark":  `:root {--background: #1e1f22; --panel: #2b2d31; --border: #3f4147; --text: #c4c6ca; --link: #e3e5e8; --hover: rgba(255, 255, 255, 0.05); --button-filter: invert(0.85);}`,
+}
+
+// Files in -template-dir and the templates they replace.
+var templateFiles = map[string]string{
+	"head.html":   "head",
+	"table.html":  "table",
+	"row.html":    "row",
+	"footer.html": "footer",
+	"error.html":  "error",
+}
+
+// page is passed to the head, table and footer templates. A listing is
+// rendered by executing "head", "table" and "footer" in turn; "table"
+// executes "row" for each of the Items.
+type page struct {
+	Title       string         // Page title, the name of the directory
+	Path        string         // URL path of the page
+	Items       []item         // Directories first, then files
+	Breadcrumbs []crumb        // Links to the root and each parent directory
+	Tree        bool           // Whether the directory tree sidebar is enabled
+	Manage      bool           // Whether file management is enabled
+	Trash       []trashEntry   // Content of the trash, on the trash page only
+	Versions    []fileVersion  // Versions of a file, on the ?versions page only
+	Usage       []quotaUsage   // Quotas of the directory and the user, on listings only
+	DU          *duReport      // Disk usage of a directory, on the ?du page only
+	Replica     *replicaStatus // Replication status, on the replica page only
+	Theme       string         // Name of the colour theme
+	ThemeCSS    template.CSS   // CSS variables of the colour theme
+	CustomCSS   string         // URL of the -css stylesheet, empty if none
+	Logo        string         // URL of the -logo image, empty if none
+	Name        string         // Name of the server
+	Version     string         // Version of the server
+}
+
+func newPage(title, urlPath string) *page {
+	p := &page{
+		Title:       title,
+		Path:        urlPath,
+		Breadcrumbs: breadcrumbs(urlPath),
+		Tree:        showTree,
+		Manage:      accounts != nil,
+		Theme:       theme,
+		ThemeCSS:    template.CSS(themes[theme]),
+		Name:        NAME,
+		Version:     VERSION,
+	}
+	if customCSS != "" {
+		p.CustomCSS = basePath + THEMEPREFIX + "custom.css"
+	}
+	if logoFile != "" {
+		p.Logo = basePath + THEMEPREFIX + "logo" + filepath.Ext(logoFile)
+	}
+	return p
+}
+
+// Functions available to all templates. base returns the -base-path, to
+// be put in front of absolute links like {{base}}/_api/tree.
+var templateFuncs = template.FuncMap{
+	"base": func() string { return basePath },
+}
+
+func builtinTemplates() *template.Template {
+	t := template.Must(template.New("head").Funcs(templateFuncs).Parse(HTMLDOCUMENTBEGIN))
+	template.Must(t.New("table").Parse(TABLE))
+	template.Must(t.New("row").Parse(ITEM))
+	template.Must(t.New("footer").Parse(FOOTER))
+	template.Must(t.New("error").Parse(ERRORPAGE))
+	template.Must(t.New("treeScript").Parse(TREESCRIPT))
+	template.Must(t.New("manageScript").Parse(MANAGESCRIPT))
+	template.Must(t.New("trash").Parse(TRASHTABLE))
+	template.Must(t.New("uploadScript").Parse(UPLOADSCRIPT))
+	template.Must(t.New("versions").Parse(VERSIONSTABLE))
+	template.Must(t.New("du").Parse(DUTABLE))
+	template.Must(t.New("replica").Parse(REPLICATABLE))
+	return t
+}
+
+// setupTemplates checks the theme options and replaces built-in
+// templates with the ones found in -template-dir and -error-template.
+func setupTemplates() error {
+	if _, ok := themes[theme]; !ok {
+		return fmt.Errorf("unknown theme `%s`, use light or dark", theme)
+	}
+	for _, name := range []string{customCSS, logoFile} {
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(name); err != nil {
+			return err
+		}
+	}
+	if templateDir != "" {
+		for file, name := range templateFiles {
+			text, err := os.ReadFile(filepath.Join(templateDir, file))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := pageTemplates.New(name).Parse(string(text)); err != nil {
+				return fmt.Errorf("invalid template %s: %v", file, err)
+			}
+		}
+	}
+	if errorTemplateFile != "" {
+		text, err := os.ReadFile(errorTemplateFile)
+		if err != nil {
+			return err
+		}
+		if _, err := pageTemplates.New("error").Parse(string(text)); err != nil {
+			return fmt.Errorf("invalid error template: %v", err)
+		}
+	}
+	return nil
+}
+
+// renderListing writes a directory listing page.
+func renderListing(w http.ResponseWriter, p *page) {
+	renderPage(w, p, "table")
+}
+
+// renderPage writes a page with the given body template between the
+// head and the footer.
+func renderPage(w http.ResponseWriter, p *page, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	for _, name := range []string{"head", body, "footer"} {
+		if err := pageTemplates.ExecuteTemplate(w, name, p); err != nil {
+			log.Printf("%s template: %v", name, err)
+			return
+		}
+	}
+}
+
+// serveThemeAsset serves the -css stylesheet and the -logo image.
+func serveThemeAsset(w http.ResponseWriter, r *http.Request) {
+	var name string
+	switch r.URL.Path[len(THEMEPREFIX):] {
+	case "custom.css":
+		name = customCSS
+	case "logo" + filepath.Ext(logoFile):
+		name = logoFile
+	}
+	if name == "" {
+		errorPage(w, r, http.StatusNotFound, "")
+		return
+	}
+	http.ServeFile(w, r, name)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long an idle per-client bucket is kept before it is dropped.
+const bucketIdleTimeout = 10 * time.Minute
+
+// Largest chunk handed to the underlying writer in one go when throttling.
+const throttleChunk = 32 * 1024
+
+// tokenBucket is a classic token bucket. Tokens may go negative, in which
+// case the caller has to wait until the debt has been paid back; this
+// keeps concurrent users of one bucket fair without a queue.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // bucket capacity
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long the caller must wait
+// before using them.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes one token if available. Otherwise it returns false and the
+// time until a token will be available.
+func (b *tokenBucket) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) idleSince(t time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last.Before(t)
+}
+
+// bucketSet hands out one bucket per key (client IP), creating them on
+// demand and forgetting them once they have been idle for a while.
+type bucketSet struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newBucketSet(rate, burst float64) *bucketSet {
+	s := &bucketSet{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+	go s.cleanup()
+	return s
+}
+
+func (s *bucketSet) get(key string) *tokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = newTokenBucket(s.rate, s.burst)
+		s.buckets[key] = b
+	}
+	return b
+}
+
+func (s *bucketSet) cleanup() {
+	for range time.Tick(bucketIdleTimeout) {
+		cutoff := time.Now().Add(-bucketIdleTimeout)
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if b.idleSince(cutoff) {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// pathRate is a bandwidth cap for every request below prefix.
+type pathRate struct {
+	prefix string
+	bucket *tokenBucket
+}
+
+var (
+	globalBandwidth *tokenBucket // shared by every download
+	ipBandwidth     *bucketSet   // one bucket per client IP
+	pathBandwidth   []pathRate   // one bucket per configured path prefix
+	ipRequests      *bucketSet   // request rate per client IP
+)
+
+// setupThrottling builds the buckets from the command line options.
+func setupThrottling() error {
+	if rateLimit != "" {
+		rate, err := parseSize(rateLimit)
+		if err != nil {
+			return fmt.Errorf("invalid -rate %q: %v", rateLimit, err)
+		}
+		globalBandwidth = newTokenBucket(float64(rate), burstFor(rate))
+	}
+	if rateLimitIP != "" {
+		rate, err := parseSize(rateLimitIP)
+		if err != nil {
+			return fmt.Errorf("invalid -rate-ip %q: %v", rateLimitIP, err)
+		}
+		ipBandwidth = newBucketSet(float64(rate), burstFor(rate))
+	}
+	for _, spec := range rateLimitPaths {
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid -rate-path %q: expected prefix=rate", spec)
+		}
+		rate, err := parseSize(spec[i+1:])
+		if err != nil {
+			return fmt.Errorf("invalid -rate-path %q: %v", spec, err)
+		}
+		prefix := path.Clean("/" + spec[:i])
+		pathBandwidth = append(pathBandwidth, pathRate{prefix, newTokenBucket(float64(rate), burstFor(rate))})
+	}
+	if requestRate > 0 {
+		burst := float64(requestBurst)
+		if burst < 1 {
+			burst = math.Max(1, requestRate)
+		}
+		ipRequests = newBucketSet(requestRate, burst)
+	}
+	return nil
+}
+
+// burstFor allows a quarter of a second worth of data to go out at once,
+// but never less than one chunk, so that the writer can make progress.
+func burstFor(rate int64) float64 {
+	return math.Max(float64(rate)/4, throttleChunk)
+}
+
+// hasPathPrefix reports whether p is prefix or lies below it.
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "/" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, prefix+"/")
+}
+
+// clientIP returns the address of the client without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttledWriter delays writes so that none of its buckets is exceeded.
+type throttledWriter struct {
+	w       http.ResponseWriter
+	buckets []*tokenBucket
+}
+
+// throttle wraps w with the bandwidth caps that apply to r. If there are
+// none, w is returned unchanged.
+func throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var buckets []*tokenBucket
+	if globalBandwidth != nil {
+		buckets = append(buckets, globalBandwidth)
+	}
+	if ipBandwidth != nil {
+		buckets = append(buckets, ipBandwidth.get(clientIP(r)))
+	}
+	for _, pr := range pathBandwidth {
+		if hasPathPrefix(path.Clean(r.URL.Path), pr.prefix) {
+			buckets = append(buckets, pr.bucket)
+		}
+	}
+	if len(buckets) == 0 {
+		return w
+	}
+	return &throttledWriter{w, buckets}
+}
+
+func (t *throttledWriter) Header() http.Header {
+	return t.w.Header()
+}
+
+func (t *throttledWriter) WriteHeader(code int) {
+	t.w.WriteHeader(code)
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.w
+}
+
+func (t *throttledWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		var wait time.Duration
+		for _, b := range t.buckets {
+			if d := b.reserve(float64(len(chunk))); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		m, err := t.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// 按客户端IP限制请求频率, 超出时返回429
+func RateLimit(handler http.Handler) http.Handler {
+	if ipRequests == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := ipRequests.get(clientIP(r)).allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			errorPage(w, r, http.StatusTooManyRequests, "")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// limitListener allows at most a fixed number of simultaneous
+// connections; further connections wait in Accept until one is closed.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+// newLimitListener limits the connections accepted by l to the capacity
+// of sem, which listeners may share.
+func newLimitListener(l net.Listener, sem chan struct{}) net.Listener {
+	return &limitListener{l, sem}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Time a transfer must have spent blocked on the client before its
+// transfer rate is checked against -min-rate.
+const minRateWindow = 10 * time.Second
+
+var errTransferTooSlow = errors.New("transfer rate below minimum")
+
+// Bytes handed to the kernel at once when a file is sent with sendfile;
+// a client must take this much within -write-timeout.
+const transferChunk = 256 * 1024
+
+// newServer returns an http.Server configured with the timeout options.
+// It has no WriteTimeout, which would cut off every response that takes
+// longer than that in total, like large downloads, listings with
+// checksums, archives and the change feed; writeDeadlines applies
+// -write-timeout to each write instead.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+// writeDeadlines gives each write of a response -write-timeout to
+// complete, so a response only times out when the client stops reading
+// it. Handlers may take their time before they start writing.
+func writeDeadlines(handler http.Handler) http.Handler {
+	if writeTimeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := &deadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+		d.extend()
+		handler.ServeHTTP(d, r)
+		// For what the server still sends after the handler returns.
+		d.extend()
+	})
+}
+
+// deadlineWriter pushes the write deadline forward before every write.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (d *deadlineWriter) extend() {
+	d.rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.extend()
+	return d.ResponseWriter.Write(p)
+}
+
+func (d *deadlineWriter) FlushError() error {
+	d.extend()
+	return d.rc.Flush()
+}
+
+// ReadFrom keeps the kernel copy (sendfile) of the response writer for
+// files. The deadline is pushed forward before every chunk of
+// transferChunk bytes instead of every write.
+func (d *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	return readFromChunks(d.ResponseWriter, src, func() { d.extend() }, nil)
+}
+
+func (d *deadlineWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// readFromChunks copies src to w with w's ReadFrom, in chunks of
+// transferChunk bytes, calling before and after around each of them.
+// An error from after ends the copy.
+func readFromChunks(w http.ResponseWriter, src io.Reader, before func(), after func(n int64) error) (int64, error) {
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	// The kernel copy only works for an *os.File, or one wrapped in a
+	// single io.LimitedReader.
+	remain := int64(math.MaxInt64)
+	lr, limited := src.(*io.LimitedReader)
+	if limited {
+		src, remain = lr.R, lr.N
+	}
+	var total int64
+	for remain > 0 {
+		if before != nil {
+			before()
+		}
+		n, err := rf.ReadFrom(io.LimitReader(src, min(remain, transferChunk)))
+		total += n
+		remain -= n
+		if err == nil && n == 0 {
+			break
+		}
+		if err == nil && after != nil {
+			err = after(n)
+		}
+		if err != nil {
+			if limited {
+				lr.N = remain
+			}
+			return total, err
+		}
+	}
+	if limited {
+		lr.N = remain
+	}
+	return total, nil
+}
+
+// transferWriter is used for copying file content to the client.
+//
+// Clients that keep reading, but slower than -min-rate, are disconnected.
+// Only the time spent blocked in Write counts towards the rate, so
+// throttling by the server itself never trips it.
+type transferWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	minRate float64
+	busy    time.Duration // time blocked in Write during the current window
+	written int64         // bytes written during the current window
+}
+
+// newTransferWriter wraps w for copying a file body.
+func newTransferWriter(w http.ResponseWriter) http.ResponseWriter {
+	if minTransferRate <= 0 {
+		return w
+	}
+	return &transferWriter{
+		ResponseWriter: w,
+		rc:             http.NewResponseController(w),
+		minRate:        float64(minTransferRate),
+	}
+}
+
+func (t *transferWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.ResponseWriter.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, t.count(int64(n), time.Since(start))
+}
+
+// count adds a write to the current window and checks the rate once
+// the window is full.
+func (t *transferWriter) count(n int64, took time.Duration) error {
+	t.busy += took
+	t.written += n
+	if t.busy < minRateWindow {
+		return nil
+	}
+	slow := float64(t.written)/t.busy.Seconds() < t.minRate
+	t.busy, t.written = 0, 0
+	if slow {
+		// Make sure the connection goes away, not just this response.
+		t.rc.SetWriteDeadline(time.Now())
+		return errTransferTooSlow
+	}
+	return nil
+}
+
+// ReadFrom keeps the kernel copy (sendfile) of the response writer for
+// files, checking the rate after every chunk of transferChunk bytes.
+func (t *transferWriter) ReadFrom(src io.Reader) (int64, error) {
+	var start time.Time
+	return readFromChunks(t.ResponseWriter, src, func() { start = time.Now() }, func(n int64) error {
+		return t.count(n, time.Since(start))
+	})
+}
+
+func (t *transferWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// transferReader is the counterpart of transferWriter for request
+// bodies: reading an upload only times out when the client stops
+// sending for longer than -read-timeout or sends slower than -min-rate.
+type transferReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	minRate float64
+	busy    time.Duration // time blocked in Read during the current window
+	read    int64         // bytes read during the current window
+}
+
+// newTransferReader wraps the body of the request answered by w.
+func newTransferReader(w http.ResponseWriter, body io.Reader) io.Reader {
+	if readTimeout <= 0 && minTransferRate <= 0 {
+		return body
+	}
+	return &transferReader{
+		r:       body,
+		rc:      http.NewResponseController(w),
+		minRate: float64(minTransferRate),
+	}
+}
+
+func (t *transferReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	if readTimeout > 0 {
+		t.rc.SetReadDeadline(start.Add(readTimeout))
+	}
+	n, err := t.r.Read(p)
+	t.busy += time.Since(start)
+	t.read += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if t.minRate > 0 && t.busy >= minRateWindow {
+		if float64(t.read)/t.busy.Seconds() < t.minRate {
+			t.rc.SetReadDeadline(time.Now())
+			return n, errTransferTooSlow
+		}
+		t.busy, t.read = 0, 0
+	}
+	return n, nil
+}
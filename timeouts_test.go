@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A response may take longer than -write-timeout in total, as long as no
+// single write stalls for that long.
+func TestWriteDeadlines(t *testing.T) {
+	old := writeTimeout
+	writeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { writeTimeout = old })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(writeDeadlines(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond) // Working out the response
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "part\n")
+			http.NewResponseController(w).Flush()
+			time.Sleep(150 * time.Millisecond)
+		}
+	})))
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(data) != "part\npart\npart\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Hidden directory below the root where the server keeps its own data.
+// It never appears in listings and can't be requested.
+const STATEDIR = ".fileserver"
+
+// URL of the trash browser.
+const TRASHPREFIX = "/_trash/"
+
+// How often expired trash is purged.
+const trashPurgeInterval = time.Hour
+
+const TRASHTABLE = `
+{{- if .Trash}}
+<div class="toolbar"><a onclick="trash('restore')">restore selected</a><a onclick="trash('purge')">purge selected</a></div>
+{{- end}}
+<table>
+	<thead>
+		<th><input type="checkbox" id="all"></th>
+		<th>Original Path</th>
+		<th>Size</th>
+		<th>Deleted</th>
+		<th>Deleted By</th>
+		<th></th>
+	</thead>
+	{{- range .Trash}}
+	<tr>
+		<td><input type="checkbox" class="select" value="{{.ID}}"></td>
+		<td><div class="{{if .IsDir}}directory{{else}}file{{end}} icon" style="display: inline-block; vertical-align: middle;"></div> {{.Path}}</td>
+		<td>{{.SizeText}}</td>
+		<td>{{.Deleted.Format "2006-01-02 15:04:05"}}</td>
+		<td>{{.User}}</td>
+		<td class="actions"><a onclick="trash('restore', [{{.ID}}])">restore</a><a onclick="trash('purge', [{{.ID}}])">purge</a></td>
+	</tr>
+	{{- else}}
+	<tr><td></td><td>The trash is empty.</td></tr>
+	{{- end}}
+</table>
+<script>
+document.getElementById("all").onchange = function() {
+	var all = this;
+	document.querySelectorAll("input.select").forEach(function(box) { box.checked = all.checked; });
+};
+// trash restores or purges the given entries, or the selected ones.
+function trash(op, ids) {
+	ids = ids || Array.prototype.map.call(document.querySelectorAll("input.select:checked"), function(box) { return box.value; });
+	if (ids.length === 0) {
+		alert("Nothing selected.");
+		return;
+	}
+	if (op === "purge" && !confirm("Delete " + ids.length + " item(s) for good?")) {
+		return;
+	}
+	fetch("{{base}}/_api/trash/" + op, {
+		method: "POST",
+		credentials: "same-origin",
+		headers: {"Content-Type": "application/json", "Accept": "application/json"},
+		body: JSON.stringify({ids: ids})
+	}).then(function(r) {
+		return r.json().then(function(data) {
+			if (!r.ok) {
+				alert((data.results || []).filter(function(res) { return res.error; }).map(function(res) { return res.path + ": " + res.error; }).join("\n") || data.message || data.error);
+			}
+			location.reload();
+		});
+	});
+}
+</script>`
+
+// trashEntry describes a deleted file. It is stored as info.json next to
+// the file itself in .fileserver/trash/<id>/.
+type trashEntry struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`    // Original path below the root
+	Deleted  time.Time `json:"deleted"` // Time of deletion
+	User     string    `json:"user"`    // Who deleted it
+	Size     int64     `json:"size"`    // Total size in bytes
+	IsDir    bool      `json:"isDir"`
+	SizeText string    `json:"-"`
+}
+
+var errNotInTrash = errors.New("not in trash")
+
+// Directory of the trash in the backend.
+const trashDir = "/" + STATEDIR + "/trash"
+
+// isStatePath reports whether the cleaned URL path lies in STATEDIR.
+func isStatePath(p string) bool {
+	return hasPathPrefix(p, "/"+STATEDIR)
+}
+
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+// moveToTrash moves the file at the URL path p into the trash, with
+// its versions.
+func moveToTrash(p string, user *account) error {
+	p, err := checkPath(p)
+	if err != nil {
+		return err
+	}
+	defer lockVersions(p)()
+	info, err := storage.Stat(p)
+	if err != nil {
+		return err
+	}
+	entry := trashEntry{
+		ID:      newID(),
+		Path:    p,
+		Deleted: time.Now(),
+		User:    user.Name,
+		Size:    treeSize(p),
+		IsDir:   info.IsDir(),
+	}
+	entryDir := path.Join(trashDir, entry.ID)
+	if err := putJSON(path.Join(entryDir, "info.json"), entry); err != nil {
+		storage.RemoveAll(entryDir)
+		return err
+	}
+	u := quotaMeasure(p)
+	if err := storage.Rename(p, path.Join(entryDir, "data")); err != nil {
+		storage.RemoveAll(entryDir)
+		return err
+	}
+	quotaMoved(p, path.Join(entryDir, "data"), u)
+	moveVersions(versionsRoot(p), path.Join(entryDir, "versions"))
+	sizesChanged(p)
+	return nil
+}
+
+// treeSize adds up the sizes of all files below name.
+func treeSize(name string) (size int64) {
+	walkStorage(name, func(_ string, info os.FileInfo) error {
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// listTrash returns the trash, most recently deleted first.
+func listTrash() ([]trashEntry, error) {
+	dirs, err := storage.List(trashDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []trashEntry
+	for _, d := range dirs {
+		entry, err := readTrashEntry(d.Name())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.After(entries[j].Deleted) })
+	return entries, nil
+}
+
+func readTrashEntry(id string) (entry trashEntry, err error) {
+	if !validName(id) {
+		return entry, errNotInTrash
+	}
+	err = getJSON(path.Join(trashDir, id, "info.json"), &entry)
+	if os.IsNotExist(err) {
+		return entry, errNotInTrash
+	}
+	if err != nil {
+		return entry, err
+	}
+	entry.SizeText = formatSize(entry.Size)
+	return entry, nil
+}
+
+// restoreFromTrash moves a deleted file back to where it came from. It
+// fails if something else has taken its place in the meantime.
+func restoreFromTrash(id string) error {
+	entry, err := readTrashEntry(id)
+	if err != nil {
+		return err
+	}
+	p, err := checkPath(entry.Path)
+	if err != nil {
+		return err
+	}
+	entryDir := path.Join(trashDir, id)
+	if err := moveNoReplace(path.Join(entryDir, "data"), p); err != nil {
+		return err
+	}
+	moveVersions(path.Join(entryDir, "versions"), versionsRoot(p))
+	return storage.RemoveAll(entryDir)
+}
+
+func purgeFromTrash(id string) error {
+	if _, err := readTrashEntry(id); err != nil {
+		return err
+	}
+	if err := storage.RemoveAll(path.Join(trashDir, id)); err != nil {
+		return err
+	}
+	quotaRemoved(path.Join(trashDir, id))
+	return nil
+}
+
+// purgeExpiredTrash deletes everything that has been in the trash for
+// longer than -trash-retention, once at startup and then periodically.
+func purgeExpiredTrash() {
+	for {
+		entries, err := listTrash()
+		if err != nil {
+			log.Printf("trash: %v", err)
+		}
+		cutoff := time.Now().Add(-trashRetention)
+		for _, e := range entries {
+			if e.Deleted.Before(cutoff) {
+				if err := purgeFromTrash(e.ID); err != nil {
+					log.Printf("trash: purging %s: %v", e.Path, err)
+					continue
+				}
+				audit(auditEvent{Action: "trash.expire", Paths: []string{e.Path}, Detail: "trash entry " + e.ID})
+			}
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+// trashHandler serves the trash browser at /_trash/ and the trash API:
+//
+//	GET  /_api/trash          list the trash as JSON
+//	POST /_api/trash/restore  {"ids": [...]}
+//	POST /_api/trash/purge    {"ids": [...]}
+type trashHandler struct{}
+
+func (t *trashHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r, permWrite)
+	if user == nil {
+		return
+	}
+	if r.URL.Path == TRASHPREFIX || r.URL.Path == APIPREFIX+"trash" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			errorPage(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		entries, err := listTrash()
+		if err != nil {
+			serveError(w, r, err)
+			return
+		}
+		if r.URL.Path == TRASHPREFIX {
+			page := newPage("Trash", r.URL.Path)
+			page.Trash = entries
+			renderPage(w, page, "trash")
+			return
+		}
+		if entries == nil {
+			entries = []trashEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	var op func(id string) error
+	var action string
+	switch r.URL.Path {
+	case APIPREFIX + "trash/restore":
+		op, action = restoreFromTrash, "trash.restore"
+	case APIPREFIX + "trash/purge":
+		op, action = purgeFromTrash, "trash.purge"
+	default:
+		errorPage(w, r, http.StatusNotFound, "")
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !sameSiteJSON(w, r) {
+		return
+	}
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(&req); err != nil {
+		errorPage(w, r, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	replyResults(w, req.IDs, func(id string) error {
+		entry, _ := readTrashEntry(id)
+		if err := op(id); err != nil {
+			return err
+		}
+		auditRequest(r, user, action, "trash entry "+id, entry.Path)
+		return nil
+	})
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL prefix of the tus upload endpoint.
+const TUSPREFIX = "/_tus/"
+
+const (
+	TUSVERSION    = "1.0.0"
+	TUSEXTENSIONS = "creation,termination,checksum"
+)
+
+// How long the state of finished uploads is kept, so that clients can
+// still see that they are complete, and how long unfinished uploads are
+// kept before they are considered abandoned.
+const (
+	finishedUploadExpiry = 24 * time.Hour
+	staleUploadExpiry    = 7 * 24 * time.Hour
+)
+
+// Status sent when the checksum of a PATCH does not match its body.
+const statusChecksumMismatch = 460
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+var errUploadExists = &os.PathError{Op: "upload", Path: "target", Err: os.ErrExist}
+
+// tusUpload is the state of an upload, kept as <id>.info next to the
+// partial data <id>.bin in .fileserver/uploads so that uploads survive a
+// restart of the server. The current offset is the size of the data.
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	RawMeta   string            `json:"rawMetadata"`
+	Target    string            `json:"target"`    // URL path of the finished file
+	Overwrite bool              `json:"overwrite"` // Whether Target may be replaced
+	User      string            `json:"user"`
+	Created   time.Time         `json:"created"`
+	Finished  bool              `json:"finished"`
+}
+
+// Locks that keep two requests from working on the same upload. A lock
+// is dropped when nobody holds or waits for it, so finished and expired
+// uploads leave nothing behind.
+var (
+	uploadLocksMu sync.Mutex
+	uploadLocks   = make(map[string]*uploadLock)
+)
+
+type uploadLock struct {
+	sync.Mutex
+	users int
+}
+
+func lockUpload(id string) func() {
+	uploadLocksMu.Lock()
+	l := uploadLocks[id]
+	if l == nil {
+		l = new(uploadLock)
+		uploadLocks[id] = l
+	}
+	l.users++
+	uploadLocksMu.Unlock()
+	l.Lock()
+	return func() {
+		uploadLocksMu.Lock()
+		defer uploadLocksMu.Unlock()
+		l.Unlock()
+		if l.users--; l.users == 0 {
+			delete(uploadLocks, id)
+		}
+	}
+}
+
+// Space held for unfinished uploads, by ID, from their creation until
+// they are finished, deleted or expire.
+var (
+	uploadHoldsMu sync.Mutex
+	uploadHolds   = make(map[string]*uploadQuota)
+)
+
+// holdSpace holds the space of the unfinished upload u, unless that is
+// done already.
+func (u *tusUpload) holdSpace() error {
+	uploadHoldsMu.Lock()
+	defer uploadHoldsMu.Unlock()
+	if _, ok := uploadHolds[u.ID]; ok || quotas == nil {
+		return nil
+	}
+	hold, err := holdUpload(u.Target, u.Length, u.User)
+	if err != nil {
+		return err
+	}
+	uploadHolds[u.ID] = hold
+	return nil
+}
+
+// releaseSpace gives up the space held for u.
+func (u *tusUpload) releaseSpace() {
+	uploadHoldsMu.Lock()
+	defer uploadHoldsMu.Unlock()
+	uploadHolds[u.ID].release()
+	delete(uploadHolds, u.ID)
+}
+
+func uploadsDir() string {
+	return filepath.Join(stateDir(), "uploads")
+}
+
+func (u *tusUpload) dataFile() string {
+	return filepath.Join(uploadsDir(), u.ID+".bin")
+}
+
+func (u *tusUpload) infoFile() string {
+	return filepath.Join(uploadsDir(), u.ID+".info")
+}
+
+func loadUpload(id string) (*tusUpload, error) {
+	if !validName(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(uploadsDir(), id+".info"))
+	if err != nil {
+		return nil, err
+	}
+	u := new(tusUpload)
+	return u, json.Unmarshal(data, u)
+}
+
+func (u *tusUpload) offset() (int64, error) {
+	if u.Finished {
+		return u.Length, nil
+	}
+	info, err := os.Stat(u.dataFile())
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// parseMetadata parses an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseMetadata(header string) (map[string]string, bool) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.Fields(pair)
+		if len(fields) > 2 {
+			return nil, false
+		}
+		value := ""
+		if len(fields) == 2 {
+			b, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, false
+			}
+			value = string(b)
+		}
+		meta[fields[0]] = value
+	}
+	return meta, true
+}
+
+// uploadTarget returns the URL path an upload with the given metadata
+// is stored at: the "filename" below the "directory", which defaults to
+// the root.
+func uploadTarget(meta map[string]string) (string, error) {
+	name := meta["filename"]
+	if !validName(name) {
+		return "", errInvalidPath
+	}
+	target := path.Join("/", meta["directory"], name)
+	return checkPath(target)
+}
+
+// tusHandler implements the tus 1.0 resumable upload protocol with the
+// creation, termination and checksum extensions (https://tus.io).
+//
+//	POST   /_tus/      create an upload; Upload-Length and Upload-Metadata
+//	                   with "filename" and optionally "directory" and
+//	                   "overwrite" are required
+//	HEAD   /_tus/<id>  get the offset of an upload
+//	PATCH  /_tus/<id>  append to an upload
+//	DELETE /_tus/<id>  abort an upload
+//
+// Once all data has arrived the file is renamed into its directory.
+type tusHandler struct{}
+
+func (t *tusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Tus-Resumable", TUSVERSION)
+	if r.Method == "OPTIONS" {
+		h.Set("Tus-Version", TUSVERSION)
+		h.Set("Tus-Extension", TUSEXTENSIONS)
+		h.Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+		if maxUploadSize > 0 {
+			h.Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != TUSVERSION {
+		h.Set("Tus-Version", TUSVERSION)
+		errorPage(w, r, http.StatusPreconditionFailed, "unsupported tus version")
+		return
+	}
+	user := requireUser(w, r, permWrite)
+	if user == nil {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, TUSPREFIX)
+	if id == "" {
+		if r.Method != "POST" {
+			h.Set("Allow", "OPTIONS, POST")
+			errorPage(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		t.create(w, r, user)
+		return
+	}
+
+	defer lockUpload(id)()
+	u, err := loadUpload(id)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	if u.User != user.Name && !user.can(permAdmin) {
+		errorPage(w, r, http.StatusForbidden, "upload belongs to another user")
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		offset, err := u.offset()
+		if err != nil {
+			serveError(w, r, err)
+			return
+		}
+		h.Set("Cache-Control", "no-store")
+		h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		h.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		if u.RawMeta != "" {
+			h.Set("Upload-Metadata", u.RawMeta)
+		}
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		if u.Finished {
+			errorPage(w, r, http.StatusForbidden, "upload is complete")
+			return
+		}
+		t.patch(w, r, u)
+	case "DELETE":
+		os.Remove(u.dataFile())
+		os.Remove(u.infoFile())
+		u.releaseSpace()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h.Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func (t *tusHandler) create(w http.ResponseWriter, r *http.Request, user *account) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		errorPage(w, r, http.StatusBadRequest, "invalid Upload-Length")
+		return
+	}
+	if maxUploadSize > 0 && length > maxUploadSize {
+		errorPage(w, r, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	raw := r.Header.Get("Upload-Metadata")
+	meta, ok := parseMetadata(raw)
+	if !ok {
+		errorPage(w, r, http.StatusBadRequest, "invalid Upload-Metadata")
+		return
+	}
+	target, err := uploadTarget(meta)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	u := &tusUpload{
+		ID:        newID(),
+		Length:    length,
+		Metadata:  meta,
+		RawMeta:   raw,
+		Target:    target,
+		Overwrite: meta["overwrite"] == "true",
+		User:      user.Name,
+		Created:   time.Now(),
+	}
+	if err := u.checkTarget(); err != nil {
+		serveError(w, r, err)
+		return
+	}
+	if err := u.holdSpace(); err != nil {
+		serveError(w, r, err)
+		return
+	}
+	if err := os.MkdirAll(uploadsDir(), 0700); err != nil {
+		u.releaseSpace()
+		serveError(w, r, err)
+		return
+	}
+	f, err := os.OpenFile(u.dataFile(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		u.releaseSpace()
+		serveError(w, r, err)
+		return
+	}
+	f.Close()
+	if err := writeJSONFile(u.infoFile(), u); err != nil {
+		os.Remove(u.dataFile())
+		u.releaseSpace()
+		serveError(w, r, err)
+		return
+	}
+	if length == 0 {
+		if err := u.finish(); err != nil {
+			serveError(w, r, err)
+			return
+		}
+		audit(auditEvent{Action: "upload", User: u.User, IP: clientIP(r), Paths: []string{u.Target}, Detail: "tus, " + formatSize(u.Length)})
+	}
+	w.Header().Set("Location", basePath+TUSPREFIX+u.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (t *tusHandler) patch(w http.ResponseWriter, r *http.Request, u *tusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		errorPage(w, r, http.StatusUnsupportedMediaType, "")
+		return
+	}
+	offset, err := u.offset()
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		errorPage(w, r, http.StatusConflict, "Upload-Offset does not match")
+		return
+	}
+	var sum hash.Hash
+	var want []byte
+	if checksum := r.Header.Get("Upload-Checksum"); checksum != "" {
+		fields := strings.Fields(checksum)
+		newHash, ok := checksumAlgorithms[fields[0]]
+		if len(fields) != 2 || !ok {
+			errorPage(w, r, http.StatusBadRequest, "unsupported checksum algorithm")
+			return
+		}
+		if want, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			errorPage(w, r, http.StatusBadRequest, "invalid checksum")
+			return
+		}
+		sum = newHash()
+	}
+
+	f, err := os.OpenFile(u.dataFile(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	var body io.Reader = io.LimitReader(newTransferReader(w, r.Body), u.Length-offset)
+	if sum != nil {
+		body = io.TeeReader(body, sum)
+	}
+	n, copyErr := io.Copy(f, body)
+	if sum != nil && (copyErr != nil || string(sum.Sum(nil)) != string(want)) {
+		// Only checked data may become part of the upload.
+		f.Truncate(offset)
+		f.Close()
+		if copyErr != nil {
+			serveError(w, r, copyErr)
+		} else {
+			errorPage(w, r, statusChecksumMismatch, "checksum mismatch")
+		}
+		return
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	offset += n
+	if copyErr != nil {
+		// Whatever was written can be resumed from.
+		serveError(w, r, copyErr)
+		return
+	}
+	if offset == u.Length {
+		if err := u.finish(); err != nil {
+			serveError(w, r, err)
+			return
+		}
+		audit(auditEvent{Action: "upload", User: u.User, IP: clientIP(r), Paths: []string{u.Target}, Detail: "tus, " + formatSize(u.Length)})
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSONFile writes v as JSON to a local file.
+func writeJSONFile(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0600)
+}
+
+// checkTarget fails if the target exists and may not be replaced.
+func (u *tusUpload) checkTarget() error {
+	target, err := checkPath(u.Target)
+	if err != nil {
+		return err
+	}
+	info, err := storage.Stat(target)
+	switch {
+	case err != nil:
+		return nil
+	case info.IsDir() || !u.Overwrite:
+		return errUploadExists
+	}
+	return nil
+}
+
+// finish moves a complete upload to its target. The backend replaces it
+// in one step, so nobody ever sees a partial file; replaced content is kept as a version.
+func (u *tusUpload) finish() error {
+	if err := u.checkTarget(); err != nil {
+		return err
+	}
+	if err := os.Chmod(u.dataFile(), 0644); err != nil {
+		return err
+	}
+	uploadHoldsMu.Lock()
+	hold := uploadHolds[u.ID]
+	uploadHoldsMu.Unlock()
+	if err := replaceFile(u.dataFile(), u.Target, u.User, hold); err != nil {
+		return err
+	}
+	u.releaseSpace()
+	u.Finished = true
+	return writeJSONFile(u.infoFile(), u)
+}
+
+// purgeStaleUploads removes uploads that were abandoned or finished long
+// ago, once at startup and then periodically. At startup, the space of
+// the unfinished uploads that are kept is held again.
+func purgeStaleUploads() {
+	for {
+		entries, _ := os.ReadDir(uploadsDir())
+		for _, e := range entries {
+			id := strings.TrimSuffix(e.Name(), ".info")
+			if id == e.Name() {
+				continue
+			}
+			unlock := lockUpload(id)
+			u, err := loadUpload(id)
+			switch {
+			case err != nil:
+			case time.Since(u.Created) > uploadExpiry(u):
+				os.Remove(u.dataFile())
+				os.Remove(u.infoFile())
+				u.releaseSpace()
+			case !u.Finished:
+				if err := u.holdSpace(); err != nil {
+					log.Printf("upload %s to %s: %v", u.ID, u.Target, err)
+				}
+			}
+			unlock()
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func uploadExpiry(u *tusUpload) time.Duration {
+	if u.Finished {
+		return finishedUploadExpiry
+	}
+	return staleUploadExpiry
+}
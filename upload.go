@@ -0,0 +1,384 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+)
+
+// Script of the drag and drop upload. Dropped files and folders, or
+// those picked with the toolbar links, are uploaded with tus a few at a
+// time. Each file gets a progress bar; conflicts with existing files are
+// resolved by asking whether to overwrite, skip or rename. Finished
+// uploads are added to the table with rows rendered by the row API.
+const UPLOADSCRIPT = `
+document.addEventListener("DOMContentLoaded", function() {
+	var CHUNK = 8 * 1024 * 1024, PARALLEL = 3, RETRIES = 5;
+	var dir = decodeURIComponent(location.pathname).slice("{{base}}".length);
+	var table = document.querySelector("table");
+	var queue = [], running = 0, policy = null, decisions = Promise.resolve(), panel = null, folders = {};
+
+	function escapePath(p) {
+		return p.split("/").map(encodeURIComponent).join("/");
+	}
+	function wait(ms) {
+		return new Promise(function(resolve) { setTimeout(resolve, ms); });
+	}
+	function encodeMeta(meta) {
+		return Object.keys(meta).map(function(k) {
+			return k + " " + btoa(unescape(encodeURIComponent(meta[k])));
+		}).join(",");
+	}
+	function request(method, url, headers, body, onprogress) {
+		return new Promise(function(resolve, reject) {
+			var xhr = new XMLHttpRequest();
+			xhr.open(method, url);
+			xhr.setRequestHeader("Tus-Resumable", "1.0.0");
+			xhr.setRequestHeader("Accept", "application/json");
+			Object.keys(headers).forEach(function(k) { xhr.setRequestHeader(k, headers[k]); });
+			if (onprogress) {
+				xhr.upload.onprogress = onprogress;
+			}
+			xhr.onload = function() { resolve(xhr); };
+			xhr.onerror = function() { reject(new Error("network error")); };
+			xhr.send(body);
+		});
+	}
+	function errorOf(xhr) {
+		try {
+			var data = JSON.parse(xhr.responseText);
+			return data.message || data.error;
+		} catch (e) {
+			return xhr.status + " " + xhr.statusText;
+		}
+	}
+	function exists(p) {
+		return fetch("{{base}}" + escapePath(p), {method: "HEAD", credentials: "same-origin"}).then(function(r) { return r.ok; });
+	}
+
+	// Conflicts are decided one at a time, even with parallel uploads.
+	function decide(target) {
+		var decision = decisions.then(function() {
+			if (policy) {
+				return policy;
+			}
+			return new Promise(function(resolve) {
+				var dialog = document.createElement("div");
+				var text = document.createElement("p");
+				var all = document.createElement("label");
+				dialog.className = "uploadDialog";
+				text.textContent = target + " already exists.";
+				all.innerHTML = "<input type='checkbox'> Do this for all conflicts";
+				dialog.appendChild(text);
+				dialog.appendChild(all);
+				dialog.appendChild(document.createElement("p"));
+				["overwrite", "skip", "rename"].forEach(function(choice) {
+					var button = document.createElement("button");
+					button.textContent = choice;
+					button.onclick = function() {
+						if (all.querySelector("input").checked) {
+							policy = choice;
+						}
+						document.body.removeChild(dialog);
+						resolve(choice);
+					};
+					dialog.lastChild.appendChild(button);
+				});
+				document.body.appendChild(dialog);
+			});
+		});
+		decisions = decision;
+		return decision;
+	}
+	function freeName(directory, name, n) {
+		var i = name.lastIndexOf(".");
+		var candidate = i > 0 ? name.slice(0, i) + " (" + n + ")" + name.slice(i) : name + " (" + n + ")";
+		return exists(directory + candidate).then(function(taken) {
+			return taken ? freeName(directory, name, n + 1) : candidate;
+		});
+	}
+
+	function progress(label) {
+		if (panel === null) {
+			panel = document.createElement("div");
+			panel.className = "uploads";
+			document.body.appendChild(panel);
+		}
+		var line = document.createElement("div");
+		var name = document.createElement("span");
+		var bar = document.createElement("progress");
+		var status = document.createElement("span");
+		name.className = "name";
+		name.textContent = label;
+		name.title = label;
+		bar.max = 1;
+		bar.value = 0;
+		status.className = "status";
+		line.appendChild(name);
+		line.appendChild(bar);
+		line.appendChild(status);
+		panel.appendChild(line);
+		return {bar: bar, status: function(text) { status.textContent = text; }};
+	}
+
+	function upload(job) {
+		var target = job.directory + job.name;
+		return exists(target).then(function(taken) {
+			if (!taken) {
+				return "new";
+			}
+			return decide(target).then(function(choice) {
+				if (choice !== "rename") {
+					return choice;
+				}
+				return freeName(job.directory, job.name, 1).then(function(name) {
+					job.name = name;
+					return "new";
+				});
+			});
+		}).then(function(choice) {
+			if (choice === "skip") {
+				job.ui.status("skipped");
+				return;
+			}
+			var meta = {filename: job.name, directory: job.directory};
+			if (choice === "overwrite") {
+				meta.overwrite = "true";
+			}
+			job.ui.status("uploading");
+			return request("POST", "{{base}}/_tus/", {"Upload-Length": String(job.file.size), "Upload-Metadata": encodeMeta(meta)}, null).then(function(xhr) {
+				if (xhr.status !== 201) {
+					throw new Error(errorOf(xhr));
+				}
+				return send(xhr.getResponseHeader("Location"), job, 0, 0);
+			}).then(function() {
+				job.ui.bar.value = 1;
+				job.ui.status("done");
+				added(job);
+			});
+		}).catch(function(err) {
+			job.ui.status(err.message);
+		});
+	}
+	// send uploads the file from offset on. After a failure the offset is
+	// asked from the server and the upload resumed from there.
+	function send(url, job, offset, failures) {
+		if (offset >= job.file.size) {
+			return Promise.resolve();
+		}
+		function retry() {
+			if (failures >= RETRIES) {
+				throw new Error("failed");
+			}
+			job.ui.status("retrying");
+			return wait(1000 * (failures + 1)).then(function() {
+				return request("HEAD", url, {}, null);
+			}).then(function(xhr) {
+				if (xhr.status !== 200) {
+					throw new Error(errorOf(xhr));
+				}
+				job.ui.status("uploading");
+				return {offset: Number(xhr.getResponseHeader("Upload-Offset")), failures: failures + 1};
+			});
+		}
+		var chunk = job.file.slice(offset, offset + CHUNK);
+		var headers = {"Content-Type": "application/offset+octet-stream", "Upload-Offset": String(offset)};
+		return request("PATCH", url, headers, chunk, function(e) {
+			job.ui.bar.value = (offset + e.loaded) / job.file.size;
+		}).then(function(xhr) {
+			if (xhr.status === 204) {
+				return {offset: Number(xhr.getResponseHeader("Upload-Offset")), failures: 0};
+			}
+			if (xhr.status < 500 && xhr.status !== 409 && xhr.status !== 460) {
+				throw new Error(errorOf(xhr));
+			}
+			return retry();
+		}, retry).then(function(next) {
+			return send(url, job, next.offset, next.failures);
+		});
+	}
+
+	// added shows a finished upload in the table: the file itself, or the
+	// folder it was uploaded into.
+	function added(job) {
+		var rel = job.directory.slice(dir.length) + job.name;
+		var top = rel.split("/")[0];
+		var selector = "tr[data-name='" + CSS.escape(top) + "']";
+		if (!table || (top !== rel && table.querySelector(selector))) {
+			return;
+		}
+		fetch("{{base}}/_api/row?path=" + encodeURIComponent(dir + top), {credentials: "same-origin"}).then(function(r) {
+			return r.ok ? r.text() : "";
+		}).then(function(html) {
+			var rows = document.createElement("tbody");
+			rows.innerHTML = html;
+			var row = rows.querySelector("tr");
+			if (!row) {
+				return;
+			}
+			if (window.fileserverEnhanceRow) {
+				window.fileserverEnhanceRow(row);
+			}
+			var old = table.querySelector(selector);
+			if (old) {
+				old.parentNode.replaceChild(row, old);
+			} else {
+				(table.tBodies[0] || table).appendChild(row);
+			}
+		});
+	}
+
+	function enqueue(file, rel) {
+		var i = rel.lastIndexOf("/");
+		var job = {file: file, directory: dir + rel.slice(0, i + 1), name: rel.slice(i + 1)};
+		job.ui = progress(rel);
+		queue.push(job);
+		pump();
+	}
+	// mkdir creates the folder rel below the listed one once its parent
+	// is there, creating that first. Folders that exist are fine.
+	function mkdir(rel) {
+		if (!folders[rel]) {
+			var i = rel.lastIndexOf("/");
+			var parent = i < 0 ? Promise.resolve() : mkdir(rel.slice(0, i));
+			folders[rel] = parent.then(function() {
+				return fetch("{{base}}/_api/fs/mkdir", {
+					method: "POST",
+					credentials: "same-origin",
+					headers: {"Content-Type": "application/json"},
+					body: JSON.stringify({path: dir + rel})
+				});
+			}).then(function(r) {
+				if (r.ok || r.status === 409) {
+					return;
+				}
+				return r.text().then(function(text) {
+					throw new Error(errorOf({responseText: text, status: r.status, statusText: r.statusText}));
+				});
+			});
+		}
+		return folders[rel];
+	}
+	// folder keeps an empty folder, with a line in the upload list.
+	function folder(rel) {
+		var ui = progress(rel + "/");
+		ui.status("creating");
+		mkdir(rel).then(function() {
+			var i = rel.lastIndexOf("/");
+			ui.bar.value = 1;
+			ui.status("done");
+			added({directory: dir + rel.slice(0, i + 1), name: rel.slice(i + 1)});
+		}, function(err) {
+			ui.status(err.message);
+		});
+	}
+	function pump() {
+		while (running < PARALLEL && queue.length > 0) {
+			running++;
+			upload(queue.shift()).then(function() {
+				running--;
+				pump();
+			});
+		}
+	}
+	function walk(entry, prefix) {
+		if (entry.isFile) {
+			entry.file(function(file) { enqueue(file, prefix + file.name); });
+			return;
+		}
+		var reader = entry.createReader(), empty = true;
+		(function read() {
+			reader.readEntries(function(entries) {
+				if (entries.length === 0) {
+					if (empty) {
+						// Keep empty folders, too.
+						folder(prefix + entry.name);
+					}
+					return;
+				}
+				empty = false;
+				entries.forEach(function(e) { walk(e, prefix + entry.name + "/"); });
+				read();
+			});
+		})();
+	}
+
+	document.addEventListener("dragover", function(e) {
+		e.preventDefault();
+		document.body.classList.add("dragging");
+	});
+	document.addEventListener("dragleave", function(e) {
+		if (!e.relatedTarget) {
+			document.body.classList.remove("dragging");
+		}
+	});
+	document.addEventListener("drop", function(e) {
+		e.preventDefault();
+		document.body.classList.remove("dragging");
+		var items = e.dataTransfer.items;
+		if (items && items.length > 0 && items[0].webkitGetAsEntry) {
+			for (var i = 0; i < items.length; i++) {
+				var entry = items[i].webkitGetAsEntry();
+				if (entry) {
+					walk(entry, "");
+				}
+			}
+			return;
+		}
+		Array.prototype.forEach.call(e.dataTransfer.files, function(file) { enqueue(file, file.name); });
+	});
+
+	var toolbar = document.querySelector(".toolbar");
+	if (!toolbar) {
+		return;
+	}
+	[["upload files", false], ["upload folder", true]].forEach(function(choice) {
+		var input = document.createElement("input");
+		var a = document.createElement("a");
+		input.type = "file";
+		input.multiple = true;
+		input.webkitdirectory = choice[1];
+		input.hidden = true;
+		input.onchange = function() {
+			Array.prototype.forEach.call(input.files, function(file) {
+				enqueue(file, file.webkitRelativePath || file.name);
+			});
+			input.value = "";
+		};
+		a.textContent = choice[0];
+		a.onclick = function() { input.click(); };
+		toolbar.appendChild(a);
+		toolbar.appendChild(input);
+	});
+});
+`
+
+// rowHandler renders the listing row of ?path= with the row template,
+// so that the upload script can add rows in the same markup as the
+// listing.
+type rowHandler struct {
+	root http.FileSystem
+}
+
+func (h *rowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Query().Get("path"))
+	if isStatePath(name) {
+		errorPage(w, r, http.StatusNotFound, "")
+		return
+	}
+	f, err := h.root.Open(name)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplates.ExecuteTemplate(w, "row", newItem(d)); err != nil {
+		log.Printf("row template: %v", err)
+	}
+}
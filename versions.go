@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often versions older than -version-retention are pruned.
+const versionPruneInterval = time.Hour
+
+const VERSIONSTABLE = `
+<table>
+	<thead>
+		<th>Version</th>
+		<th>Size</th>
+		<th>Uploaded</th>
+		<th>Uploaded By</th>
+		<th></th>
+	</thead>
+	{{- range .Versions}}
+	<tr>
+		<td>{{if .Number}}{{.Number}}{{else}}current{{end}}</td>
+		<td>{{.SizeText}}</td>
+		<td>{{.Modified.Format "2006-01-02 15:04:05"}}</td>
+		<td>{{.User}}</td>
+		<td class="actions">{{if .Number}}<a href="?version={{.Number}}">download</a>{{if $.Manage}}<a onclick="restore({{.Number}})">restore</a>{{end}}{{else}}<a href="?">download</a>{{end}}</td>
+	</tr>
+	{{- end}}
+</table>
+<script>
+function restore(version) {
+	if (!confirm("Restore version " + version + "? The current content is kept as a new version.")) {
+		return;
+	}
+	fetch("{{base}}/_api/versions/restore", {
+		method: "POST",
+		credentials: "same-origin",
+		headers: {"Content-Type": "application/json", "Accept": "application/json"},
+		body: JSON.stringify({path: decodeURIComponent(location.pathname).slice("{{base}}".length), version: version})
+	}).then(function(r) {
+		return r.json().then(function(data) {
+			if (!r.ok) {
+				alert(data.message || data.error);
+			}
+			location.reload();
+		});
+	});
+}
+</script>`
+
+// fileVersion describes one version of a file. Earlier versions are
+// kept in .fileserver/versions/<path>/.v/ as <number> with the metadata
+// in <number>.json; who uploaded the current content is recorded in
+// current.json there.
+type fileVersion struct {
+	Number   int       `json:"number"`   // 1 for the oldest, 0 for the current content
+	Size     int64     `json:"size"`     // Size in bytes
+	Modified time.Time `json:"modified"` // When this content was uploaded
+	User     string    `json:"user"`     // Who uploaded it, if known
+	SizeText string    `json:"-"`
+}
+
+func versionsDir(urlPath string) string {
+	return path.Join(versionsRoot(urlPath), ".v")
+}
+
+// versionsRoot returns where the versions of urlPath and of the files
+// below it are kept.
+func versionsRoot(urlPath string) string {
+	return path.Join("/", STATEDIR, "versions", urlPath)
+}
+
+// Locks that keep two changes from working on the versions of the same
+// file at once. Entries are dropped once nobody holds or waits for them.
+var (
+	versionLocksMu sync.Mutex
+	versionLocks   = make(map[string]*versionLock)
+)
+
+type versionLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockVersions locks the versions of the files at paths, in a fixed
+// order so that changes locking several can't deadlock.
+func lockVersions(paths ...string) func() {
+	paths = slices.Compact(slices.Sorted(slices.Values(paths)))
+	locks := make([]*versionLock, len(paths))
+	versionLocksMu.Lock()
+	for i, p := range paths {
+		l := versionLocks[p]
+		if l == nil {
+			l = new(versionLock)
+			versionLocks[p] = l
+		}
+		l.users++
+		locks[i] = l
+	}
+	versionLocksMu.Unlock()
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		versionLocksMu.Lock()
+		defer versionLocksMu.Unlock()
+		for i, l := range locks {
+			l.Unlock()
+			if l.users--; l.users == 0 {
+				delete(versionLocks, paths[i])
+			}
+		}
+	}
+}
+
+// moveVersions moves the versions kept below the state path from to to,
+// along with the files they belong to.
+func moveVersions(from, to string) {
+	if _, err := storage.Stat(from); err != nil {
+		return
+	}
+	// Whatever is at to belonged to files that are gone.
+	dropVersions(to)
+	if err := storage.Rename(from, to); err != nil {
+		log.Printf("versions: moving %s: %v", from, err)
+		return
+	}
+	quotaMoved(from, to, usage{})
+}
+
+// dropVersions deletes the versions kept below the state path root, when
+// the files they belong to are deleted for good.
+func dropVersions(root string) {
+	if _, err := storage.Stat(root); err != nil {
+		return
+	}
+	if err := storage.RemoveAll(root); err != nil {
+		log.Printf("versions: deleting %s: %v", root, err)
+		return
+	}
+	quotaRemoved(root)
+}
+
+// replaceFile stores the finished upload src, a local file, at urlPath.
+// If a file exists there, its content becomes the newest version first.
+// The backend replaces the file in one step. hold is the space held for
+// the upload since it started, if any; the caller releases it.
+func replaceFile(src, urlPath, user string, hold *uploadQuota) error {
+	urlPath, err := checkPath(urlPath)
+	if err != nil {
+		return err
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	defer lockVersions(urlPath)()
+	if hold == nil {
+		if hold, err = holdUpload(urlPath, 0, user); err != nil {
+			return err
+		}
+		defer hold.release()
+	}
+	if err := hold.grow(srcInfo.Size()); err != nil {
+		return err
+	}
+	info, statErr := storage.Stat(urlPath)
+	replaced := statErr == nil && !info.IsDir()
+	if replaced && keepVersions > 0 {
+		if err := saveVersion(urlPath, info); err != nil {
+			return err
+		}
+	}
+	if !replaced {
+		// Left over from a file that was there before; a new file
+		// starts without history.
+		dropVersions(versionsRoot(urlPath))
+	}
+	if err := storage.Put(urlPath, src); err != nil {
+		return err
+	}
+	var oldSize int64
+	if replaced {
+		oldSize = info.Size()
+	}
+	quotaReplaced(urlPath, srcInfo.Size(), user, replaced, oldSize)
+	sizesChanged(urlPath)
+	if keepVersions > 0 {
+		putJSON(path.Join(versionsDir(urlPath), "current.json"), fileVersion{User: user})
+	}
+	return nil
+}
+
+// saveVersion keeps the current content of urlPath as a new version. A
+// hard link is used where the backend has them, a copy otherwise. The
+// versions of urlPath are locked.
+func saveVersion(urlPath string, info os.FileInfo) error {
+	vdir := versionsDir(urlPath)
+	versions, _ := listVersions(urlPath)
+	v := fileVersion{Number: 1, Size: info.Size(), Modified: info.ModTime()}
+	if len(versions) > 0 {
+		v.Number = versions[0].Number + 1
+	}
+	var current fileVersion
+	if getJSON(path.Join(vdir, "current.json"), &current) == nil {
+		v.User = current.User
+	}
+	name := path.Join(vdir, strconv.Itoa(v.Number))
+	err := errors.ErrUnsupported
+	if l, ok := storage.(linker); ok {
+		err = l.Link(urlPath, name)
+	}
+	if err != nil {
+		if err := storage.Copy(urlPath, name); err != nil {
+			return err
+		}
+	}
+	if err := putJSON(name+".json", v); err != nil {
+		storage.RemoveAll(name)
+		return err
+	}
+	quotaVersioned(urlPath, name, v.Size)
+	pruneVersions(urlPath)
+	return nil
+}
+
+// listVersions returns the earlier versions of a file, newest first.
+func listVersions(urlPath string) ([]fileVersion, error) {
+	vdir := versionsDir(urlPath)
+	entries, err := storage.List(vdir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []fileVersion
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") || e.Name() == "current.json" {
+			continue
+		}
+		var v fileVersion
+		if getJSON(path.Join(vdir, e.Name()), &v) != nil || v.Number <= 0 {
+			continue
+		}
+		v.SizeText = formatSize(v.Size)
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number > versions[j].Number })
+	return versions, nil
+}
+
+// pruneVersions deletes the versions beyond -keep-versions and those
+// older than -version-retention. The versions of urlPath are locked.
+func pruneVersions(urlPath string) {
+	versions, err := listVersions(urlPath)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-versionRetention)
+	for i, v := range versions {
+		if i >= keepVersions || (versionRetention > 0 && v.Modified.Before(cutoff)) {
+			name := path.Join(versionsDir(urlPath), strconv.Itoa(v.Number))
+			storage.RemoveAll(name)
+			storage.RemoveAll(name + ".json")
+			quotaRemoved(name)
+		}
+	}
+}
+
+// pruneAllVersions applies the retention to every versioned file, once
+// at startup and then periodically.
+func pruneAllVersions() {
+	root := path.Join("/", STATEDIR, "versions")
+	for {
+		walkStorage(root, func(name string, info os.FileInfo) error {
+			if info.IsDir() && info.Name() == ".v" {
+				urlPath := strings.TrimPrefix(path.Dir(name), root)
+				unlock := lockVersions(urlPath)
+				pruneVersions(urlPath)
+				unlock()
+				return fs.SkipDir
+			}
+			return nil
+		})
+		time.Sleep(versionPruneInterval)
+	}
+}
+
+// serveVersions handles ?versions, the version history of a file, and
+// ?version=N, the content of one version. They are served to whoever
+// may read the file itself from root, and only while it exists.
+func serveVersions(w http.ResponseWriter, r *http.Request, root http.FileSystem, urlPath string) {
+	urlPath, err := checkPath(urlPath)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	f, err := root.Open(urlPath)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	if info.IsDir() {
+		errorPage(w, r, http.StatusBadRequest, "directories have no versions")
+		return
+	}
+	if n := r.URL.Query().Get("version"); n != "" {
+		serveVersion(w, r, urlPath, n)
+		return
+	}
+	versions, err := listVersions(urlPath)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	current := fileVersion{Size: info.Size(), SizeText: formatSize(info.Size()), Modified: info.ModTime()}
+	var v fileVersion
+	if getJSON(path.Join(versionsDir(urlPath), "current.json"), &v) == nil {
+		current.User = v.User
+	}
+	versions = append([]fileVersion{current}, versions...)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(versions)
+		return
+	}
+	page := newPage(urlPath, r.URL.Path)
+	page.Versions = versions
+	renderPage(w, page, "versions")
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request, urlPath, n string) {
+	number, err := strconv.Atoi(n)
+	if err != nil || number <= 0 {
+		errorPage(w, r, http.StatusBadRequest, "invalid version")
+		return
+	}
+	name := path.Join(versionsDir(urlPath), strconv.Itoa(number))
+	d, err := storage.Stat(name)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	f, err := storage.Open(name)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	defer f.Close()
+	sizeFunc := func() (int64, error) { return d.Size(), nil }
+	serveContent(w, r, path.Base(urlPath), d.ModTime(), sizeFunc, f)
+}
+
+// restoreVersion makes a copy of an earlier version the current content.
+// The content it replaces becomes a new version, so nothing is lost.
+func restoreVersion(urlPath string, number int, user string) error {
+	src, err := storage.Open(path.Join(versionsDir(urlPath), strconv.Itoa(number)))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := tempFile("restore-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = replaceFile(tmp.Name(), urlPath, user, nil)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// versionsHandler implements
+//
+//	POST /_api/versions/restore  {"path": "/file", "version": 3}
+type versionsHandler struct{}
+
+func (v *versionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		errorPage(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !sameSiteJSON(w, r) {
+		return
+	}
+	user := requireUser(w, r, permWrite)
+	if user == nil {
+		return
+	}
+	var req struct {
+		Path    string `json:"path"`
+		Version int    `json:"version"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(&req); err != nil || req.Version <= 0 {
+		errorPage(w, r, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	replyResults(w, []string{req.Path}, func(p string) error {
+		if err := restoreVersion(p, req.Version, user.Name); err != nil {
+			return err
+		}
+		auditRequest(r, user, "version.restore", "version "+strconv.Itoa(req.Version), p)
+		return nil
+	})
+}
+
+// putFile stores the body of a PUT request at the requested path.
+func putFile(w http.ResponseWriter, r *http.Request, urlPath string) {
+	user := requireUser(w, r, permWrite)
+	if user == nil {
+		return
+	}
+	urlPath, err := checkPath(urlPath)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	if maxUploadSize > 0 && r.ContentLength > maxUploadSize {
+		errorPage(w, r, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	info, statErr := storage.Stat(urlPath)
+	if statErr == nil && info.IsDir() {
+		errorPage(w, r, http.StatusConflict, "is a directory")
+		return
+	}
+	if quotas != nil && r.ContentLength < 0 {
+		errorPage(w, r, http.StatusLengthRequired, "")
+		return
+	}
+	hold, err := holdUpload(urlPath, r.ContentLength, user.Name)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	defer hold.release()
+	tmp, err := tempFile("put-")
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	var body io.Reader = r.Body
+	if maxUploadSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	}
+	n, err := io.Copy(tmp, newTransferReader(w, body))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = replaceFile(tmp.Name(), urlPath, user.Name, hold)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("PUT %s: %v", urlPath, err)
+		serveError(w, r, err)
+		return
+	}
+	auditRequest(r, user, "upload", "PUT, "+formatSize(n), urlPath)
+	if statErr == nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
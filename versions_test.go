@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testStorage serves a temporary directory for the duration of a test.
+func testStorage(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	oldStorage, oldKeep := storage, keepVersions
+	storage, keepVersions = &localBackend{root: root}, 100
+	t.Cleanup(func() { storage, keepVersions = oldStorage, oldKeep })
+	return root
+}
+
+// storeFile stores content at p as user.
+func storeFile(t *testing.T, p, content, user string) {
+	t.Helper()
+	tmp, err := tempFile("test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.WriteString(content)
+	tmp.Close()
+	if err := replaceFile(tmp.Name(), p, user, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionsConcurrent(t *testing.T) {
+	testStorage(t)
+	storeFile(t, "/f.txt", "first", "alice")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			storeFile(t, "/f.txt", fmt.Sprint(i), "alice")
+		}()
+	}
+	wg.Wait()
+	versions, err := listVersions("/f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 20 {
+		t.Fatalf("%d versions, want 20", len(versions))
+	}
+	for i, v := range versions {
+		if v.Number != 20-i {
+			t.Fatalf("version %d numbered %d", 20-i, v.Number)
+		}
+	}
+	if len(versionLocks) != 0 {
+		t.Errorf("%d locks left", len(versionLocks))
+	}
+}
+
+func TestVersionsFollowFile(t *testing.T) {
+	root := testStorage(t)
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	storeFile(t, "/dir/f.txt", "one", "alice")
+	storeFile(t, "/dir/f.txt", "two", "alice")
+	count := func(p string) int {
+		t.Helper()
+		versions, err := listVersions(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(versions)
+	}
+
+	// Renaming the file or its directory takes the history along.
+	if _, _, err := fsMoveTo("/dir/f.txt", "/dir/g.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if count("/dir/f.txt") != 0 || count("/dir/g.txt") != 1 {
+		t.Errorf("after rename: %d and %d versions", count("/dir/f.txt"), count("/dir/g.txt"))
+	}
+	if _, _, err := fsMoveTo("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if count("/dir/g.txt") != 0 || count("/moved/g.txt") != 1 {
+		t.Errorf("after moving the directory: %d and %d versions", count("/dir/g.txt"), count("/moved/g.txt"))
+	}
+
+	// A new file where a deleted one was starts without history, which
+	// comes back when the deleted file is restored.
+	if err := moveToTrash("/moved/g.txt", &account{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	storeFile(t, "/moved/g.txt", "stranger", "bob")
+	if n := count("/moved/g.txt"); n != 0 {
+		t.Errorf("new file has %d versions", n)
+	}
+	entries, err := listTrash()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("trash: %v, %v", entries, err)
+	}
+	if err := moveToTrash("/moved/g.txt", &account{Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreFromTrash(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("/moved/g.txt"); n != 1 {
+		t.Errorf("restored file has %d versions, want 1", n)
+	}
+}